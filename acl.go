@@ -0,0 +1,512 @@
+package redis
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	ErrNoAuth         = newErrorCode("NOAUTH", "Authentication required.")
+	ErrWrongPass      = newErrorCode("WRONGPASS", "invalid username-password pair or user is disabled.")
+	ErrNoPermKey      = newErrorCode("NOPERM", "this user has no permissions to access one of the keys used as arguments")
+	ErrNoPermChannel  = newErrorCode("NOPERM", "this user has no permissions to access one of the channels used as arguments")
+	ErrAuthNoPassword = newErrorCode("ERR", "AUTH <password> called without any password configured for the default user. Are you sure your configuration is correct?")
+)
+
+// aclUser is an ACL user. Users are never modified once published in
+// aclUsers: ACL SETUSER replaces them with an updated copy.
+type aclUser struct {
+	name    string
+	enabled bool
+	nopass  bool
+	// passwords holds the SHA-256 of the passwords, in hex.
+	passwords []string
+
+	// allCommands allows the commands absent from allowed, which holds
+	// the commands, and subcommands, explicitly allowed or denied.
+	allCommands  bool
+	allowed      map[string]bool
+	commandRules []string
+
+	allKeys     bool
+	keys        []string
+	keyRE       []*regexp.Regexp
+	allChannels bool
+	channels    []string
+	channelRE   []*regexp.Regexp
+}
+
+func newACLUser(name string) *aclUser {
+	return &aclUser{name: name, allowed: make(map[string]bool)}
+}
+
+func (u *aclUser) clone() *aclUser {
+	c := *u
+	c.passwords = append([]string(nil), u.passwords...)
+	c.allowed = make(map[string]bool, len(u.allowed))
+	for k, v := range u.allowed {
+		c.allowed[k] = v
+	}
+	c.commandRules = append([]string(nil), u.commandRules...)
+	c.keys = append([]string(nil), u.keys...)
+	c.keyRE = append([]*regexp.Regexp(nil), u.keyRE...)
+	c.channels = append([]string(nil), u.channels...)
+	c.channelRE = append([]*regexp.Regexp(nil), u.channelRE...)
+	return &c
+}
+
+func hashPassword(password string) string {
+	sum := sha256.Sum256([]byte(password))
+	return hex.EncodeToString(sum[:])
+}
+
+func aclRuleError(rule, reason string) *ErrorReply {
+	return newErrorCode("ERR", "Error in ACL SETUSER modifier '"+rule+"': "+reason)
+}
+
+// setCommand allows or denies a command and its subcommands.
+func (u *aclUser) setCommand(name string, allow bool) {
+	u.allowed[name] = allow
+	if spec := commands[name]; spec != nil {
+		for _, sub := range spec.subcommands {
+			u.allowed[sub.fullName()] = allow
+		}
+	}
+}
+
+// setRule applies one rule of ACL SETUSER to u.
+func (u *aclUser) setRule(rule string) *ErrorReply {
+	lower := strings.ToLower(rule)
+	switch lower {
+	case "on":
+		u.enabled = true
+		return nil
+	case "off":
+		u.enabled = false
+		return nil
+	case "nopass":
+		u.nopass, u.passwords = true, nil
+		return nil
+	case "resetpass":
+		u.nopass, u.passwords = false, nil
+		return nil
+	case "allkeys":
+		return u.setRule("~*")
+	case "resetkeys":
+		u.allKeys, u.keys, u.keyRE = false, nil, nil
+		return nil
+	case "allchannels":
+		return u.setRule("&*")
+	case "resetchannels":
+		u.allChannels, u.channels, u.channelRE = false, nil, nil
+		return nil
+	case "allcommands":
+		return u.setRule("+@all")
+	case "nocommands":
+		return u.setRule("-@all")
+	case "reset":
+		for _, r := range []string{"resetpass", "resetkeys", "resetchannels", "off", "-@all"} {
+			u.setRule(r)
+		}
+		return nil
+	}
+	if rule == "" {
+		return aclRuleError(rule, "Syntax error")
+	}
+
+	switch rule[0] {
+	case '>', '<':
+		hash := hashPassword(rule[1:])
+		if rule[0] == '>' {
+			return u.setRule("#" + hash)
+		}
+		return u.setRule("!" + hash)
+	case '#', '!':
+		hash := lower[1:]
+		if _, err := hex.DecodeString(hash); err != nil || len(hash) != 2*sha256.Size {
+			return aclRuleError(rule, "The password hash must be exactly 64 characters and contain only lowercase hexadecimal characters")
+		}
+		passwords := u.passwords[:0]
+		for _, p := range u.passwords {
+			if p != hash {
+				passwords = append(passwords, p)
+			}
+		}
+		if rule[0] == '#' {
+			passwords = append(passwords, hash)
+			u.nopass = false
+		}
+		u.passwords = passwords
+		return nil
+	case '~':
+		if u.allKeys {
+			return aclRuleError(rule, "Adding a pattern after the * pattern (or the 'allkeys' flag) is not valid and does not have any effect. Try 'resetkeys' to start with an empty list of patterns")
+		}
+		if rule == "~*" {
+			u.allKeys, u.keys, u.keyRE = true, nil, nil
+			return nil
+		}
+		u.keys = append(u.keys, rule[1:])
+		u.keyRE = append(u.keyRE, patternRE(rule[1:]))
+		return nil
+	case '&':
+		if u.allChannels {
+			return aclRuleError(rule, "Adding a pattern after the * pattern (or the 'allchannels' flag) is not valid and does not have any effect. Try 'resetchannels' to start with an empty list of channels")
+		}
+		if rule == "&*" {
+			u.allChannels, u.channels, u.channelRE = true, nil, nil
+			return nil
+		}
+		u.channels = append(u.channels, rule[1:])
+		u.channelRE = append(u.channelRE, patternRE(rule[1:]))
+		return nil
+	case '+', '-':
+		allow := rule[0] == '+'
+		name := lower[1:]
+		if strings.HasPrefix(name, "@") {
+			category := name[1:]
+			if category == "all" {
+				u.allCommands = allow
+				u.allowed = make(map[string]bool)
+				u.commandRules = []string{lower}
+				return nil
+			}
+			found := false
+			for _, spec := range commands {
+				if spec.inCategory(category) {
+					u.allowed[spec.fullName()] = allow
+					found = true
+				}
+			}
+			if !found {
+				return aclRuleError(rule, "Unknown command or category name in ACL")
+			}
+		} else {
+			if name == "" {
+				return aclRuleError(rule, "Syntax error")
+			}
+			u.setCommand(name, allow)
+		}
+		u.commandRules = append(u.commandRules, lower)
+		return nil
+	}
+	return aclRuleError(rule, "Syntax error")
+}
+
+// describe formats u as a line of ACL LIST.
+func (u *aclUser) describe() string {
+	desc := []string{"user", u.name}
+	if u.enabled {
+		desc = append(desc, "on")
+	} else {
+		desc = append(desc, "off")
+	}
+	if u.nopass {
+		desc = append(desc, "nopass")
+	}
+	for _, p := range u.passwords {
+		desc = append(desc, "#"+p)
+	}
+	if u.allKeys {
+		desc = append(desc, "~*")
+	}
+	for _, k := range u.keys {
+		desc = append(desc, "~"+k)
+	}
+	if u.allChannels {
+		desc = append(desc, "&*")
+	} else {
+		desc = append(desc, "resetchannels")
+		for _, c := range u.channels {
+			desc = append(desc, "&"+c)
+		}
+	}
+	rules := u.commandRules
+	if len(rules) == 0 || (rules[0] != "+@all" && rules[0] != "-@all") {
+		rules = append([]string{"-@all"}, rules...)
+	}
+	return strings.Join(append(desc, rules...), " ")
+}
+
+func (u *aclUser) checkPassword(password string) bool {
+	if u.nopass {
+		return true
+	}
+	hash := []byte(hashPassword(password))
+	for _, p := range u.passwords {
+		if subtle.ConstantTimeCompare(hash, []byte(p)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+func (u *aclUser) canRun(spec *commandSpec, name string) bool {
+	if spec != nil {
+		name = spec.fullName()
+	}
+	if allow, exists := u.allowed[name]; exists {
+		return allow
+	}
+	return u.allCommands
+}
+
+func matchAny(patterns []*regexp.Regexp, values [][]byte) bool {
+	for _, v := range values {
+		matched := false
+		for _, re := range patterns {
+			if re != nil && re.Match(v) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// check returns the NOPERM error for u running the command name with args,
+// or nil when it is allowed.
+func (u *aclUser) check(name string, args [][]byte) *ErrorReply {
+	spec := lookupCommand(name, args)
+	if !u.canRun(spec, strings.ToLower(name)) {
+		full := strings.ToLower(name)
+		if spec != nil {
+			full = spec.fullName()
+		}
+		return newErrorCode("NOPERM", "this user has no permissions to run the '"+full+"' command")
+	}
+	if spec == nil {
+		return nil
+	}
+	if !u.allKeys && !matchAny(u.keyRE, spec.keys(args)) {
+		return ErrNoPermKey
+	}
+	if !u.allChannels && !matchAny(u.channelRE, spec.channels(args)) {
+		return ErrNoPermChannel
+	}
+	return nil
+}
+
+// aclUsers holds the users of the server.
+type aclUsers struct {
+	mu    sync.RWMutex
+	users map[string]*aclUser
+}
+
+// newACLUsers creates the default user, which runs everything with the
+// password requirePass, or without password when it is empty.
+func newACLUsers(requirePass string) *aclUsers {
+	def := newACLUser("default")
+	for _, rule := range []string{"on", "nopass", "~*", "&*", "+@all"} {
+		def.setRule(rule)
+	}
+	if requirePass != "" {
+		def.setRule(">" + requirePass)
+	}
+	return &aclUsers{users: map[string]*aclUser{"default": def}}
+}
+
+func (a *aclUsers) get(name string) *aclUser {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.users[name]
+}
+
+// noAuth reports whether clients are authenticated as the default user
+// without AUTH.
+func (a *aclUsers) noAuth() bool {
+	def := a.get("default")
+	return def != nil && def.enabled && def.nopass
+}
+
+func (a *aclUsers) authenticate(name, password string) bool {
+	u := a.get(name)
+	return u != nil && u.enabled && u.checkPassword(password)
+}
+
+func (a *aclUsers) setUser(name string, rules []string) *ErrorReply {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	u, exists := a.users[name]
+	if exists {
+		u = u.clone()
+	} else {
+		u = newACLUser(name)
+	}
+	for _, rule := range rules {
+		if err := u.setRule(rule); err != nil {
+			return err
+		}
+	}
+	a.users[name] = u
+	return nil
+}
+
+func (a *aclUsers) delUser(name string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	_, exists := a.users[name]
+	delete(a.users, name)
+	return exists
+}
+
+func (a *aclUsers) list() []*aclUser {
+	a.mu.RLock()
+	users := make([]*aclUser, 0, len(a.users))
+	for _, u := range a.users {
+		users = append(users, u)
+	}
+	a.mu.RUnlock()
+	sort.Slice(users, func(i, j int) bool { return users[i].name < users[j].name })
+	return users
+}
+
+// checkAccess returns the error replied to the client sending r when it is
+// not authenticated or its user may not run r, or nil. Requests applied
+// directly to the server, without a client, are not checked.
+func (srv *Server) checkAccess(r *Request) ReplyWriter {
+	if r.Client == nil || srv.users == nil {
+		return nil
+	}
+	name := strings.ToLower(r.Name)
+	switch name {
+	case "auth", "hello", "quit":
+		// They authenticate the client.
+		return nil
+	}
+	user, ok := r.Client.authUser()
+	if !ok {
+		return ErrNoAuth
+	}
+	u := srv.users.get(user)
+	if u == nil {
+		return ErrNoAuth
+	}
+	if err := u.check(name, r.Args); err != nil {
+		return err
+	}
+	return nil
+}
+
+// authenticate logs the client sending r in as user.
+func (srv *Server) authenticate(r *Request, user, password string) *ErrorReply {
+	if srv.users == nil || !srv.users.authenticate(user, password) {
+		return ErrWrongPass
+	}
+	r.Client.setUser(user)
+	return nil
+}
+
+// auth implements AUTH [username] password.
+func (srv *Server) auth(r *Request) (ReplyWriter, error) {
+	user := "default"
+	var password string
+	switch len(r.Args) {
+	case 1:
+		if srv.users != nil && srv.users.noAuth() {
+			return ErrAuthNoPassword, nil
+		}
+		password = string(r.Args[0])
+	case 2:
+		user, password = string(r.Args[0]), string(r.Args[1])
+	default:
+		return ErrSyntax, nil
+	}
+	if err := srv.authenticate(r, user, password); err != nil {
+		return err, nil
+	}
+	return &StatusReply{Code: "OK"}, nil
+}
+
+// acl implements ACL CAT|DELUSER|LIST|SETUSER|USERS|WHOAMI.
+func (srv *Server) acl(r *Request) (ReplyWriter, error) {
+	if len(r.Args) == 0 {
+		return newErrorCode("ERR", "wrong number of arguments for 'acl' command"), nil
+	}
+	sub := strings.ToLower(string(r.Args[0]))
+	args := r.Args[1:]
+	switch sub {
+	case "whoami":
+		user := "default"
+		if r.Client != nil {
+			user = r.Client.User()
+		}
+		return &BulkReply{value: []byte(user)}, nil
+	case "list", "users":
+		var values []interface{}
+		for _, u := range srv.users.list() {
+			if sub == "list" {
+				values = append(values, u.describe())
+			} else {
+				values = append(values, u.name)
+			}
+		}
+		return &MultiBulkReply{values: values}, nil
+	case "cat":
+		var values []interface{}
+		if len(args) == 0 {
+			for _, c := range categories() {
+				values = append(values, c)
+			}
+			return &MultiBulkReply{values: values}, nil
+		}
+		category := strings.ToLower(strings.TrimPrefix(string(args[0]), "@"))
+		var names []string
+		for _, spec := range commands {
+			if spec.inCategory(category) {
+				names = append(names, spec.fullName())
+			}
+		}
+		if len(names) == 0 {
+			return newErrorCode("ERR", "Unknown category '"+string(args[0])+"'"), nil
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			values = append(values, name)
+		}
+		return &MultiBulkReply{values: values}, nil
+	case "setuser":
+		if len(args) == 0 {
+			return newErrorCode("ERR", "wrong number of arguments for 'acl|setuser' command"), nil
+		}
+		rules := make([]string, 0, len(args)-1)
+		for _, rule := range args[1:] {
+			rules = append(rules, string(rule))
+		}
+		if err := srv.users.setUser(string(args[0]), rules); err != nil {
+			return err, nil
+		}
+		return &StatusReply{Code: "OK"}, nil
+	case "deluser":
+		if len(args) == 0 {
+			return newErrorCode("ERR", "wrong number of arguments for 'acl|deluser' command"), nil
+		}
+		deleted := make(map[string]bool)
+		for _, name := range args {
+			if string(name) == "default" {
+				return newErrorCode("ERR", "The 'default' user cannot be removed"), nil
+			}
+		}
+		for _, name := range args {
+			if srv.users.delUser(string(name)) {
+				deleted[string(name)] = true
+			}
+		}
+		// Like redis, disconnect the clients authenticated as them.
+		for _, c := range srv.Clients() {
+			if user, ok := c.authUser(); ok && deleted[user] {
+				c.kill(c == r.Client)
+			}
+		}
+		return &IntegerReply{number: len(deleted)}, nil
+	}
+	return wrongSubcommand("acl", sub), nil
+}
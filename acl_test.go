@@ -0,0 +1,108 @@
+package redis
+
+import (
+	"io/ioutil"
+	"testing"
+)
+
+func TestRequirePass(t *testing.T) {
+	srv, _ := startServer(t, DefaultConfig().RequirePass("secret"))
+
+	_, r := dial(t, srv, "GET key", "HELLO 3", "AUTH wrong", "AUTH default secret", "GET key")
+	expectLine(t, r, "-NOAUTH Authentication required.")
+	expectLine(t, r, "-NOAUTH HELLO must be called with the client already authenticated, otherwise the HELLO <proto> AUTH <user> <pass> option can be used to authenticate the client and select the RESP protocol version at the same time")
+	expectLine(t, r, "-WRONGPASS invalid username-password pair or user is disabled.")
+	expectLine(t, r, "+OK")
+	expectLine(t, r, "$-1")
+
+	_, r = dial(t, srv, "HELLO 3 AUTH default secret", "ACL WHOAMI")
+	if reply, ok := readReply(t, r).(map[string]interface{}); !ok || reply["proto"] != int64(3) {
+		t.Fatalf("Unexpected HELLO reply %#v", reply)
+	}
+	expectReply(t, r, "default")
+
+	srv2, _ := startServer(t, DefaultConfig())
+	_, r = dial(t, srv2, "AUTH secret", "GET key")
+	expectLine(t, r, "-ERR AUTH <password> called without any password configured for the default user. Are you sure your configuration is correct?")
+	expectLine(t, r, "$-1")
+}
+
+func TestACL(t *testing.T) {
+	srv, _ := startServer(t, DefaultConfig())
+
+	adminConn, admin := dial(t, srv,
+		"ACL SETUSER alice on >pw ~cache:* &news -@all +get +@hash +publish",
+		"ACL SETUSER bob whatever",
+		"ACL LIST",
+	)
+	expectLine(t, admin, "+OK")
+	expectLine(t, admin, "-ERR Error in ACL SETUSER modifier 'whatever': Syntax error")
+	expectReply(t, admin, []interface{}{
+		"user alice on #" + hashPassword("pw") + " ~cache:* resetchannels &news -@all +get +@hash +publish",
+		"user default on nopass ~* &* +@all",
+	})
+
+	alice, r := dial(t, srv,
+		"AUTH alice wrong",
+		"AUTH alice pw",
+		"ACL WHOAMI",
+		"GET cache:1",
+		"GET other",
+		"SET cache:1 v",
+		"HSET cache:h f v",
+		"PUBLISH news hello",
+		"PUBLISH sports hello",
+	)
+	expectLine(t, r, "-WRONGPASS invalid username-password pair or user is disabled.")
+	expectLine(t, r, "+OK")
+	expectLine(t, r, "-NOPERM this user has no permissions to run the 'acl|whoami' command")
+	expectLine(t, r, "$-1")
+	expectLine(t, r, "-NOPERM this user has no permissions to access one of the keys used as arguments")
+	expectLine(t, r, "-NOPERM this user has no permissions to run the 'set' command")
+	expectLine(t, r, ":1")
+	expectLine(t, r, ":0")
+	expectLine(t, r, "-NOPERM this user has no permissions to access one of the channels used as arguments")
+
+	// Changes apply to the connected clients.
+	adminConn.Write([]byte("ACL SETUSER alice +acl|whoami\r\n"))
+	expectLine(t, admin, "+OK")
+	alice.Write([]byte("ACL WHOAMI\r\n"))
+	expectReply(t, r, "alice")
+
+	adminConn.Write([]byte("ACL DELUSER default\r\nACL DELUSER alice nobody\r\nACL USERS\r\n"))
+	expectLine(t, admin, "-ERR The 'default' user cannot be removed")
+	expectLine(t, admin, ":1")
+	expectReply(t, admin, []interface{}{"default"})
+	if _, err := ioutil.ReadAll(r); err != nil {
+		t.Fatalf("Expected the client of the deleted user to be disconnected, got %v", err)
+	}
+}
+
+func TestACLUserCheck(t *testing.T) {
+	u := newACLUser("u")
+	for _, rule := range []string{"on", "allkeys", "+@all", "-client", "+client|id", "-@dangerous"} {
+		if err := u.setRule(rule); err != nil {
+			t.Fatalf("%s: %s", rule, err)
+		}
+	}
+	for _, v := range []struct {
+		args    []string
+		allowed bool
+	}{
+		{[]string{"get", "k"}, true},
+		{[]string{"custom"}, true},
+		{[]string{"keys", "*"}, false},
+		{[]string{"client", "id"}, true},
+		{[]string{"client", "setname", "x"}, false},
+		{[]string{"acl", "whoami"}, true},
+		{[]string{"acl", "setuser", "x"}, false},
+	} {
+		args := make([][]byte, 0, len(v.args)-1)
+		for _, a := range v.args[1:] {
+			args = append(args, []byte(a))
+		}
+		if err := u.check(v.args[0], args); (err == nil) != v.allowed {
+			t.Fatalf("%v: expected allowed=%v, got %v", v.args, v.allowed, err)
+		}
+	}
+}
@@ -1,10 +1,11 @@
 package redis
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"math/big"
 	"reflect"
-	"time"
 )
 
 type CheckerFn func(request *Request) (reflect.Value, ReplyWriter)
@@ -54,35 +55,6 @@ func (srv *Server) handlerFn(autoHandler interface{}, f *reflect.Value, checkers
 			}
 			input = append(input, value)
 		}
-		var monitorString string
-		if len(request.Host) > 0 {
-			monitorString = fmt.Sprintf("%.6f [%s %s] \"%s\" ",
-				float64(time.Now().UTC().UnixNano())/1e9,
-				string(request.Numdb[0]),
-				request.Host,
-				request.Name,
-			)
-
-			if len(request.Args) > 0 {
-				for i, a := range request.Args {
-					monitorString += fmt.Sprint(" ", i, ":")
-					if len(a) > 50 {
-						monitorString += fmt.Sprint("size ", len(a))
-					} else {
-						monitorString += `"` + string(a) + `"`
-					}
-				}
-			}
-
-			for _, c := range srv.MonitorChans {
-				select {
-				case c <- monitorString:
-				default:
-				}
-			}
-
-			Debugf("%s (connected monitors: %d)\n", monitorString, len(srv.MonitorChans))
-		}
 		var result []reflect.Value
 
 		// If we don't have any input, it means we are dealing with a function.
@@ -104,6 +76,10 @@ func (srv *Server) handlerFn(autoHandler interface{}, f *reflect.Value, checkers
 		var ret interface{}
 		if ierr := result[len(result)-1].Interface(); ierr != nil {
 			// Last return value is an error, wrap it to redis error
+			// unless it already is one.
+			if reply, ok := ierr.(*ErrorReply); ok {
+				return reply, nil
+			}
 			err := ierr.(error)
 			// convert to redis error reply
 			return NewError(err.Error()), nil
@@ -116,17 +92,21 @@ func (srv *Server) handlerFn(autoHandler interface{}, f *reflect.Value, checkers
 	}, nil
 }
 
-func hashValueReply(v HashValue) (*MultiBulkReply, error) {
+func hashValueReply(v HashValue) (*MapReply, error) {
 	m := make(map[string]interface{})
 	for k, v := range v {
 		m[k] = v
 	}
-	return MultiBulkFromMap(m), nil
+	return MapFromMap(m), nil
 }
 
 func (srv *Server) createReply(r *Request, val interface{}) (ReplyWriter, error) {
-	Debugf("CREATE REPLY: %T", val)
+	if srv.logs(LevelDebug) {
+		srv.log(LevelDebug, "Creating reply", Field{"type", fmt.Sprintf("%T", val)})
+	}
 	switch v := val.(type) {
+	case nil:
+		return &NullReply{}, nil
 	case []interface{}:
 		return &MultiBulkReply{values: v}, nil
 	case string:
@@ -147,21 +127,37 @@ func (srv *Server) createReply(r *Request, val interface{}) (ReplyWriter, error)
 	case map[string][]byte:
 		return hashValueReply(v)
 	case map[string]interface{}:
-		return MultiBulkFromMap(v), nil
+		return MapFromMap(v), nil
 	case int:
 		return &IntegerReply{number: v}, nil
-	case *StatusReply:
-		return v, nil
+	case int64:
+		return &IntegerReply{number: int(v)}, nil
+	case float64:
+		return &DoubleReply{value: v}, nil
+	case bool:
+		return &BooleanReply{value: v}, nil
+	case *big.Int:
+		return &BigNumberReply{value: v}, nil
+	case *StatusReply, *ErrorReply, *NullReply, *NullArrayReply, *BooleanReply, *DoubleReply,
+		*BigNumberReply, *VerbatimReply, *MapReply, *SetReply, *PushReply,
+		*BulkReply, *IntegerReply, *MultiBulkReply:
+		return v.(ReplyWriter), nil
 	case *MonitorReply:
-		c := make(chan string)
-		srv.MonitorChans = append(srv.MonitorChans, c)
-		v.c = c
+		v.done = srv.streamDone(r)
+		if r.Client != nil {
+			v.queue.bind(r.Client)
+		}
+		srv.addMonitor(v)
+		r.Client.setFlag(ClientMonitor, true)
 		return v, nil
 	case *ChannelWriter:
+		r.Client.setFlag(ClientPubSub, true)
+		srv.bindChannelWriter(r, v)
 		return v, nil
 	case *MultiChannelWriter:
+		r.Client.setFlag(ClientPubSub, true)
 		for _, mcw := range v.Chans {
-			mcw.clientChan = r.ClientChan
+			srv.bindChannelWriter(r, mcw)
 		}
 		return v, nil
 	default:
@@ -180,30 +176,90 @@ func createCheckers(autoHandler interface{}, f *reflect.Value) ([]CheckerFn, err
 		start = 1
 	}
 
+	// A *Request parameter receives the request itself and consumes no
+	// argument, so that handlers can see the client it comes from. A
+	// context.Context first parameter receives the context of the request.
+	arg := 0
 	for i := start; i < mtype.NumIn(); i += 1 {
 		switch mtype.In(i) {
+		case contextType:
+			if i != start {
+				return nil, errors.New("Context should be the first argument")
+			}
+			checkers = append(checkers, contextChecker)
+			continue
+		case reflect.TypeOf(&Request{}):
+			checkers = append(checkers, requestChecker)
+			continue
 		case reflect.TypeOf(""):
-			checkers = append(checkers, stringChecker(i-start))
+			checkers = append(checkers, stringChecker(arg))
 		case reflect.TypeOf([]string{}):
-			checkers = append(checkers, stringSliceChecker(i-start))
+			checkers = append(checkers, stringSliceChecker(arg))
 		case reflect.TypeOf([]byte{}):
-			checkers = append(checkers, byteChecker(i-start))
+			checkers = append(checkers, byteChecker(arg))
 		case reflect.TypeOf([][]byte{}):
-			checkers = append(checkers, byteSliceChecker(i-start))
+			checkers = append(checkers, byteSliceChecker(arg))
 		case reflect.TypeOf(map[string][]byte{}):
 			if i != mtype.NumIn()-1 {
 				return nil, errors.New("Map should be the last argument")
 			}
-			checkers = append(checkers, mapChecker(i-start))
+			checkers = append(checkers, mapChecker(arg))
 		case reflect.TypeOf(1):
-			checkers = append(checkers, intChecker(i-start))
+			checkers = append(checkers, intChecker(arg))
 		default:
 			return nil, fmt.Errorf("Argument %d: wrong type %s (%s)", i, mtype.In(i), mtype.Name())
 		}
+		arg++
 	}
 	return checkers, nil
 }
 
+// bindChannelWriter ties the subscription c to the client of r.
+func (srv *Server) bindChannelWriter(r *Request, c *ChannelWriter) {
+	c.clientChan = r.ClientChan
+	c.done = srv.streamDone(r)
+	if r.Client != nil {
+		c.queue.bind(r.Client)
+	}
+}
+
+// handlerArity returns the arity of the command served by f, counting
+// the name. It is negative, a minimum, when the last arguments are
+// variadic or when f takes the *Request, whose Args it may read itself.
+func handlerArity(autoHandler interface{}, f *reflect.Value) int {
+	mtype := f.Type()
+	start := 0
+	if mtype.NumIn() > 0 && mtype.In(0).AssignableTo(reflect.TypeOf(autoHandler)) {
+		start = 1
+	}
+	arity, variadic := 1, false
+	for i := start; i < mtype.NumIn(); i++ {
+		switch mtype.In(i) {
+		case contextType:
+		case reflect.TypeOf(&Request{}):
+			variadic = true
+		case reflect.TypeOf([]string{}), reflect.TypeOf([][]byte{}), reflect.TypeOf(map[string][]byte{}):
+			return -arity
+		default:
+			arity++
+		}
+	}
+	if variadic {
+		return -arity
+	}
+	return arity
+}
+
+var contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+
+func requestChecker(request *Request) (reflect.Value, ReplyWriter) {
+	return reflect.ValueOf(request), nil
+}
+
+func contextChecker(request *Request) (reflect.Value, ReplyWriter) {
+	return reflect.ValueOf(request.Context()), nil
+}
+
 func stringChecker(index int) CheckerFn {
 	return func(request *Request) (reflect.Value, ReplyWriter) {
 		v, err := request.GetString(index)
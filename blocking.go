@@ -0,0 +1,188 @@
+package redis
+
+import (
+	"math"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrTimeoutNotFloat = newErrorCode("ERR", "timeout is not a float or out of range")
+	ErrTimeoutNegative = newErrorCode("ERR", "timeout is negative")
+)
+
+// The states of a waiter. A waiter leaves waiting exactly once, either
+// served by a push or cancelled by its timeout.
+const (
+	waiting int32 = iota
+	served
+	cancelled
+)
+
+// waiter is a client blocked in BLPOP or BRPOP. It is queued on every key
+// it waits for, in the order clients blocked.
+type waiter struct {
+	keys  []string
+	front bool // pop from the head of the list, as BLPOP does
+	state int32
+	reply chan [][]byte
+}
+
+// parseTimeout parses a blocking timeout given in seconds, possibly
+// fractional. Zero means no timeout.
+func parseTimeout(timeout string) (time.Duration, error) {
+	f, err := strconv.ParseFloat(timeout, 64)
+	if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0, ErrTimeoutNotFloat
+	}
+	if f < 0 {
+		return 0, ErrTimeoutNegative
+	}
+	ms := f * 1000
+	if ms > float64(math.MaxInt64/int64(time.Millisecond)) {
+		return 0, ErrTimeoutNotFloat
+	}
+	return time.Duration(int64(ms)) * time.Millisecond, nil
+}
+
+// pop removes the head, or the tail, of the list at key and deletes the
+// list once empty. The caller holds the write lock on the shard.
+func (s *shard) pop(key string, list *Stack, front bool) []byte {
+	var value []byte
+	if front {
+		value = list.PopFront()
+	} else {
+		value = list.PopBack()
+	}
+	if list.Len() == 0 {
+		s.del(key)
+	}
+	return value
+}
+
+// serveBlocked hands the elements of the list at key to the clients blocked
+// on it, first come first served. The caller holds the write lock on the
+// shard, after the command which may have filled the list is done.
+func (s *shard) serveBlocked(key string) {
+	queue := s.blocked[key]
+	for len(queue) > 0 {
+		list, _ := s.list(key, false)
+		if list == nil || list.Len() == 0 {
+			break
+		}
+		w := queue[0]
+		queue = queue[1:]
+		// A client blocked on several keys is only served once.
+		if atomic.CompareAndSwapInt32(&w.state, waiting, served) {
+			w.reply <- [][]byte{[]byte(key), s.pop(key, list, w.front)}
+		}
+	}
+	if len(queue) == 0 {
+		delete(s.blocked, key)
+	} else {
+		s.blocked[key] = queue
+	}
+}
+
+// popOrBlock pops from the first non-empty list of w.keys. If they are all
+// empty, it queues w on each of them and returns nil. It fails with
+// ErrWrongType if a key holds something else than a list.
+func (db *Database) popOrBlock(w *waiter) ([][]byte, error) {
+	defer db.lock(w.keys...)()
+	for _, key := range w.keys {
+		s := db.shard(key)
+		list, err := s.list(key, false)
+		if err != nil {
+			return nil, err
+		}
+		if list != nil && list.Len() > 0 {
+			return [][]byte{[]byte(key), s.pop(key, list, w.front)}, nil
+		}
+	}
+	for _, key := range w.keys {
+		s := db.shard(key)
+		s.blocked[key] = append(s.blocked[key], w)
+	}
+	return nil, nil
+}
+
+// unblock removes w from the queues it is still in.
+func (db *Database) unblock(w *waiter) {
+	defer db.lock(w.keys...)()
+	for _, key := range w.keys {
+		s := db.shard(key)
+		queue := s.blocked[key][:0]
+		for _, other := range s.blocked[key] {
+			if other != w {
+				queue = append(queue, other)
+			}
+		}
+		if len(queue) == 0 {
+			delete(s.blocked, key)
+		} else {
+			s.blocked[key] = queue
+		}
+	}
+}
+
+// bpop implements BLPOP and BRPOP. The last of args is the timeout. The
+// client waits outside of any lock, until a push on one of the keys, its
+// timeout or the server shutdown.
+func (h *DefaultHandler) bpop(r *Request, front bool, args []string) (interface{}, error) {
+	if len(args) < 2 {
+		return nil, ErrNotEnoughArgs
+	}
+	timeout, err := parseTimeout(args[len(args)-1])
+	if err != nil {
+		return nil, err
+	}
+	db := h.db(r)
+	w := &waiter{
+		keys:  args[:len(args)-1],
+		front: front,
+		reply: make(chan [][]byte, 1),
+	}
+	data, err := db.popOrBlock(w)
+	if err != nil {
+		return nil, err
+	}
+	if data != nil {
+		return h.popped(r, front, data), nil
+	}
+	defer db.unblock(w)
+
+	r.Client.setFlag(ClientBlocked, true)
+	defer r.Client.setFlag(ClientBlocked, false)
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case data := <-w.reply:
+		return h.popped(r, front, data), nil
+	case <-expired:
+	// The context of the request ends with its client or its server, not
+	// with the handler which other servers may share.
+	case <-r.Context().Done():
+	}
+	if !atomic.CompareAndSwapInt32(&w.state, waiting, cancelled) {
+		// A push served the client as it was timing out.
+		return h.popped(r, front, <-w.reply), nil
+	}
+	return NewNullArrayReply(), nil
+}
+
+// popped sends the keyspace notification of the pop of data, the key and
+// the value replied to a blocked client.
+func (h *DefaultHandler) popped(r *Request, front bool, data [][]byte) [][]byte {
+	event := "rpop"
+	if front {
+		event = "lpop"
+	}
+	h.notify(r, notifyList, event, string(data[0]))
+	return data
+}
@@ -0,0 +1,113 @@
+package redis
+
+import (
+	"testing"
+	"time"
+)
+
+// waitBlocked waits until n clients of srv are blocked.
+func waitBlocked(t *testing.T, srv *Server, n int) {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		blocked := 0
+		for _, c := range srv.Clients() {
+			if c.Flags()&ClientBlocked != 0 {
+				blocked++
+			}
+		}
+		if blocked == n {
+			return
+		}
+	}
+	t.Fatalf("Expected %d blocked clients", n)
+}
+
+func TestParseTimeout(t *testing.T) {
+	for _, v := range []struct {
+		timeout  string
+		expected time.Duration
+		err      error
+	}{
+		{"0", 0, nil},
+		{"2", 2 * time.Second, nil},
+		{"0.25", 250 * time.Millisecond, nil},
+		{"1e-1", 100 * time.Millisecond, nil},
+		{"-1", 0, ErrTimeoutNegative},
+		{"x", 0, ErrTimeoutNotFloat},
+		{"inf", 0, ErrTimeoutNotFloat},
+		{"1e300", 0, ErrTimeoutNotFloat},
+	} {
+		timeout, err := parseTimeout(v.timeout)
+		if timeout != v.expected || err != v.err {
+			t.Fatalf("%q: expected %v %v, got %v %v", v.timeout, v.expected, v.err, timeout, err)
+		}
+	}
+}
+
+func TestBlockingFIFO(t *testing.T) {
+	srv, _ := startServer(t, DefaultConfig())
+
+	_, first := dial(t, srv, "BLPOP q 0")
+	waitBlocked(t, srv, 1)
+	_, second := dial(t, srv, "BRPOP other q 0")
+	waitBlocked(t, srv, 2)
+
+	_, r := dial(t, srv, "RPUSH q a b c", "LRANGE q 0 -1")
+	expectLine(t, r, ":3")
+	// The clients blocked first are served first, each with one element.
+	expectLine(t, r, "*1")
+	expectLine(t, r, "$1")
+	expectLine(t, r, "b")
+
+	for _, c := range []struct {
+		conn    interface{ ReadString(byte) (string, error) }
+		element string
+	}{{first, "a"}, {second, "c"}} {
+		for _, expected := range []string{"*2\r\n", "$1\r\n", "q\r\n", "$1\r\n", c.element + "\r\n"} {
+			if line, err := c.conn.ReadString('\n'); err != nil || line != expected {
+				t.Fatalf("Expected %q, got %q %v", expected, line, err)
+			}
+		}
+	}
+	waitBlocked(t, srv, 0)
+}
+
+func TestBlockingMultipleKeys(t *testing.T) {
+	srv, _ := startServer(t, DefaultConfig())
+
+	// The first non-empty key in the order given is popped.
+	_, r := dial(t, srv, "RPUSH b 1", "RPUSH c 2", "BLPOP a c b 0")
+	expectLine(t, r, ":1")
+	expectLine(t, r, ":1")
+	expectLine(t, r, "*2")
+	expectLine(t, r, "$1")
+	expectLine(t, r, "c")
+	expectLine(t, r, "$1")
+	expectLine(t, r, "2")
+
+	// A client blocked on several keys is served once.
+	_, blocked := dial(t, srv, "BRPOP x y 0")
+	waitBlocked(t, srv, 1)
+	_, r = dial(t, srv, "LPUSH y 1", "LPUSH x 2", "LLEN x")
+	expectLine(t, r, ":1")
+	expectLine(t, r, ":1")
+	expectLine(t, r, ":1")
+	expectLine(t, blocked, "*2")
+	expectLine(t, blocked, "$1")
+	expectLine(t, blocked, "y")
+}
+
+func TestBlockingTimeout(t *testing.T) {
+	srv, _ := startServer(t, DefaultConfig())
+
+	start := time.Now()
+	_, r := dial(t, srv, "BRPOP q 0.1", "BLPOP q -1", "BLPOP q soon", "RPUSH q a", "LLEN q")
+	expectLine(t, r, "*-1")
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond || elapsed > time.Second {
+		t.Fatalf("Expected a 100ms timeout, waited %v", elapsed)
+	}
+	expectLine(t, r, "-ERR timeout is negative")
+	expectLine(t, r, "-ERR timeout is not a float or out of range")
+	// The client which timed out does not consume pushes.
+	expectLine(t, r, ":1")
+	expectLine(t, r, ":1")
+}
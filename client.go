@@ -0,0 +1,483 @@
+package redis
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Client flags, as shown by CLIENT LIST.
+const (
+	ClientMonitor = 1 << iota // O: the client runs MONITOR
+	ClientPubSub              // P: the client is subscribed to channels
+	ClientBlocked             // b: the client waits in a blocking command
+)
+
+// Client is a connection to the server, registered for its whole life.
+// It backs the CLIENT command.
+type Client struct {
+	id      int64
+	addr    string
+	laddr   string
+	created time.Time
+	conn    net.Conn
+
+	// state is connIdle or connActive, for Shutdown.
+	state      int32
+	clientChan chan struct{}
+	// ctx is cancelled once the client disconnected or the server shut
+	// down. The contexts of the requests derive from it.
+	ctx       context.Context
+	cancel    context.CancelFunc
+	closeOnce sync.Once
+	// closing is set once the client was killed, so its connection is
+	// closed as soon as the current reply is sent.
+	closing int32
+
+	mu              sync.Mutex
+	name            string
+	user            string
+	authenticated   bool
+	db              int
+	proto           int
+	flags           int
+	lastCmd         string
+	lastInteraction time.Time
+	// pendingOutput is the size of the pub/sub messages and MONITOR lines
+	// queued for the client, and overSoftLimit when it went over the soft
+	// limit of its class.
+	pendingOutput int64
+	overSoftLimit time.Time
+
+	srv *Server
+}
+
+func newClient(srv *Server, parent context.Context, id int64, conn net.Conn, addr string) *Client {
+	now := time.Now()
+	ctx, cancel := context.WithCancel(parent)
+	return &Client{
+		ctx:             ctx,
+		cancel:          cancel,
+		id:              id,
+		addr:            addr,
+		laddr:           conn.LocalAddr().String(),
+		created:         now,
+		conn:            conn,
+		state:           connActive,
+		clientChan:      make(chan struct{}),
+		user:            "default",
+		proto:           RESP2,
+		lastInteraction: now,
+		srv:             srv,
+	}
+}
+
+// ID returns the unique, increasing, identifier of the client.
+func (c *Client) ID() int64 {
+	return c.id
+}
+
+// Addr returns the address of the client.
+func (c *Client) Addr() string {
+	return c.addr
+}
+
+// Name returns the name set with CLIENT SETNAME.
+func (c *Client) Name() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.name
+}
+
+func (c *Client) setName(name string) {
+	c.mu.Lock()
+	c.name = name
+	c.mu.Unlock()
+}
+
+// User returns the user the client is authenticated as.
+func (c *Client) User() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.user
+}
+
+// setUser records that the client authenticated as user.
+func (c *Client) setUser(user string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	c.user = user
+	c.authenticated = true
+	c.mu.Unlock()
+}
+
+// authUser returns the user the client is authenticated as, and whether
+// it is authenticated at all.
+func (c *Client) authUser() (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.user, c.authenticated
+}
+
+// DB returns the database selected by the client.
+func (c *Client) DB() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.db
+}
+
+func (c *Client) setProto(proto int) {
+	c.mu.Lock()
+	c.proto = proto
+	c.mu.Unlock()
+}
+
+func (c *Client) setDB(db int) {
+	c.mu.Lock()
+	c.db = db
+	c.mu.Unlock()
+}
+
+// Age returns how long the client has been connected.
+func (c *Client) Age() time.Duration {
+	return time.Since(c.created)
+}
+
+// Idle returns how long since the client last sent a command.
+func (c *Client) Idle() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return time.Since(c.lastInteraction)
+}
+
+// LastCommand returns the name of the last command run by the client.
+func (c *Client) LastCommand() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lastCmd
+}
+
+// Flags returns the Client* flags set on the client.
+func (c *Client) Flags() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.flags
+}
+
+// setFlag sets or clears flag. It is a no-op on a nil client, the one of
+// requests applied directly to the server.
+func (c *Client) setFlag(flag int, on bool) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	if on {
+		c.flags |= flag
+	} else {
+		c.flags &^= flag
+	}
+	c.mu.Unlock()
+}
+
+// interact records that the client sent command.
+func (c *Client) interact(command string) {
+	c.mu.Lock()
+	c.lastCmd = command
+	c.lastInteraction = time.Now()
+	c.mu.Unlock()
+}
+
+func (c *Client) setState(state int32) {
+	atomic.StoreInt32(&c.state, state)
+}
+
+// kill closes the connection of the client. When the client kills itself,
+// the connection is closed once the reply was sent.
+func (c *Client) kill(self bool) {
+	atomic.StoreInt32(&c.closing, 1)
+	if !self {
+		c.conn.Close()
+	}
+}
+
+func (c *Client) killed() bool {
+	return atomic.LoadInt32(&c.closing) != 0
+}
+
+// disconnect cancels the context of the client and closes its clientChan,
+// ending the commands still running for it.
+func (c *Client) disconnect() {
+	c.closeOnce.Do(func() {
+		c.cancel()
+		close(c.clientChan)
+	})
+}
+
+func (c *Client) typeName() string {
+	if c.Flags()&ClientPubSub != 0 {
+		return "pubsub"
+	}
+	return "normal"
+}
+
+// info formats the client the way CLIENT LIST does.
+func (c *Client) info() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	flags := ""
+	if c.flags&ClientMonitor != 0 {
+		flags += "O"
+	}
+	if c.flags&ClientPubSub != 0 {
+		flags += "P"
+	}
+	if c.flags&ClientBlocked != 0 {
+		flags += "b"
+	}
+	if flags == "" {
+		flags = "N"
+	}
+	now := time.Now()
+	return "id=" + strconv.FormatInt(c.id, 10) +
+		" addr=" + c.addr +
+		" laddr=" + c.laddr +
+		" name=" + c.name +
+		" age=" + strconv.Itoa(int(now.Sub(c.created).Seconds())) +
+		" idle=" + strconv.Itoa(int(now.Sub(c.lastInteraction).Seconds())) +
+		" flags=" + flags +
+		" db=" + strconv.Itoa(c.db) +
+		" cmd=" + c.lastCmd +
+		" user=" + c.user +
+		" omem=" + strconv.FormatInt(c.pendingOutput, 10) +
+		" resp=" + strconv.Itoa(c.proto) +
+		"\n"
+}
+
+// errMaxClients refuses the connections over maxclients.
+var errMaxClients = newErrorCode("ERR", "max number of clients reached")
+
+// trackClient registers or unregisters a client. Registration fails once
+// the server is shutting down, or with errMaxClients when maxclients are
+// already connected.
+func (srv *Server) trackClient(c *Client, add bool) error {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.clients == nil {
+		srv.clients = make(map[int64]*Client)
+	}
+	if add {
+		if srv.shuttingDown() {
+			return ErrServerClosed
+		}
+		if len(srv.clients) >= srv.conf().maxClients {
+			atomic.AddInt64(&srv.stats.rejected, 1)
+			return errMaxClients
+		}
+		srv.clients[c.id] = c
+		atomic.AddInt64(&srv.stats.connections, 1)
+	} else {
+		delete(srv.clients, c.id)
+	}
+	return nil
+}
+
+// Clients returns the connected clients, by increasing id.
+func (srv *Server) Clients() []*Client {
+	srv.mu.Lock()
+	clients := make([]*Client, 0, len(srv.clients))
+	for _, c := range srv.clients {
+		clients = append(clients, c)
+	}
+	srv.mu.Unlock()
+	sort.Slice(clients, func(i, j int) bool { return clients[i].id < clients[j].id })
+	return clients
+}
+
+var (
+	ErrNoSuchClient      = newErrorCode("ERR", "No such client")
+	ErrInvalidClientName = newErrorCode("ERR", "Client names cannot contain spaces, newlines or special characters.")
+)
+
+// validClientName reports whether name is made of printable characters
+// other than space, as redis requires.
+func validClientName(name string) bool {
+	for i := 0; i < len(name); i++ {
+		if name[i] < '!' || name[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+func wrongSubcommand(command, sub string) *ErrorReply {
+	return newErrorCode("ERR", "unknown subcommand '"+sub+"'. Try "+strings.ToUpper(command)+" HELP.")
+}
+
+// client implements CLIENT ID|INFO|LIST|KILL|SETNAME|GETNAME.
+func (srv *Server) client(r *Request) (ReplyWriter, error) {
+	if len(r.Args) == 0 {
+		return newErrorCode("ERR", "wrong number of arguments for 'client' command"), nil
+	}
+	self := r.Client
+	sub := strings.ToLower(string(r.Args[0]))
+	args := r.Args[1:]
+	switch sub {
+	case "id":
+		if self == nil {
+			return &IntegerReply{number: 0}, nil
+		}
+		return &IntegerReply{number: int(self.id)}, nil
+	case "info":
+		if self == nil {
+			return &NullReply{}, nil
+		}
+		return NewVerbatimReply("txt", []byte(self.info())), nil
+	case "getname":
+		if self == nil || self.Name() == "" {
+			return &NullReply{}, nil
+		}
+		return &BulkReply{value: []byte(self.Name())}, nil
+	case "setname":
+		if len(args) != 1 {
+			return newErrorCode("ERR", "wrong number of arguments for 'client|setname' command"), nil
+		}
+		if !validClientName(string(args[0])) {
+			return ErrInvalidClientName, nil
+		}
+		if self != nil {
+			self.setName(string(args[0]))
+		}
+		return &StatusReply{Code: "OK"}, nil
+	case "list":
+		return srv.clientList(args)
+	case "kill":
+		return srv.clientKill(self, args)
+	}
+	return wrongSubcommand("client", sub), nil
+}
+
+// clientList implements CLIENT LIST [TYPE normal|pubsub] [ID id [id ...]].
+func (srv *Server) clientList(args [][]byte) (ReplyWriter, error) {
+	var typ string
+	var ids map[int64]bool
+	for i := 0; i < len(args); i++ {
+		switch strings.ToLower(string(args[i])) {
+		case "type":
+			if i+1 >= len(args) {
+				return ErrSyntax, nil
+			}
+			i++
+			typ = strings.ToLower(string(args[i]))
+			switch typ {
+			case "normal", "pubsub", "master", "replica", "slave":
+			default:
+				return newErrorCode("ERR", "Unknown client type '"+string(args[i])+"'"), nil
+			}
+		case "id":
+			if i+1 >= len(args) {
+				return ErrSyntax, nil
+			}
+			ids = make(map[int64]bool)
+			for i++; i < len(args); i++ {
+				id, err := strconv.ParseInt(string(args[i]), 10, 64)
+				if err != nil || id <= 0 {
+					return newErrorCode("ERR", "Invalid client ID"), nil
+				}
+				ids[id] = true
+			}
+		default:
+			return ErrSyntax, nil
+		}
+	}
+
+	var b bytes.Buffer
+	for _, c := range srv.Clients() {
+		if typ != "" && c.typeName() != typ {
+			continue
+		}
+		if ids != nil && !ids[c.id] {
+			continue
+		}
+		b.WriteString(c.info())
+	}
+	return NewVerbatimReply("txt", b.Bytes()), nil
+}
+
+// clientKill implements both CLIENT KILL addr:port, and CLIENT KILL with
+// ID, ADDR, LADDR, USER, TYPE and SKIPME filters.
+func (srv *Server) clientKill(self *Client, args [][]byte) (ReplyWriter, error) {
+	if len(args) == 1 {
+		for _, c := range srv.Clients() {
+			if c.addr == string(args[0]) {
+				c.kill(c == self)
+				return &StatusReply{Code: "OK"}, nil
+			}
+		}
+		return ErrNoSuchClient, nil
+	}
+	if len(args) == 0 || len(args)%2 != 0 {
+		return ErrSyntax, nil
+	}
+
+	var id int64
+	var addr, laddr, user, typ string
+	skipme := true
+	for i := 0; i < len(args); i += 2 {
+		value := string(args[i+1])
+		switch strings.ToLower(string(args[i])) {
+		case "id":
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || n <= 0 {
+				return newErrorCode("ERR", "client-id should be greater than 0"), nil
+			}
+			id = n
+		case "addr":
+			addr = value
+		case "laddr":
+			laddr = value
+		case "user":
+			user = value
+		case "type":
+			typ = strings.ToLower(value)
+			switch typ {
+			case "normal", "pubsub", "master", "replica", "slave":
+			default:
+				return newErrorCode("ERR", "Unknown client type '"+value+"'"), nil
+			}
+		case "skipme":
+			switch strings.ToLower(value) {
+			case "yes":
+				skipme = true
+			case "no":
+				skipme = false
+			default:
+				return ErrSyntax, nil
+			}
+		default:
+			return ErrSyntax, nil
+		}
+	}
+
+	killed := 0
+	for _, c := range srv.Clients() {
+		if (id != 0 && c.id != id) ||
+			(addr != "" && c.addr != addr) ||
+			(laddr != "" && c.laddr != laddr) ||
+			(user != "" && c.User() != user) ||
+			(typ != "" && c.typeName() != typ) ||
+			(skipme && c == self) {
+			continue
+		}
+		c.kill(c == self)
+		killed++
+	}
+	return &IntegerReply{number: killed}, nil
+}
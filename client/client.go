@@ -0,0 +1,209 @@
+// Package client is a redis client built on the protocol encoders and
+// decoders of go-redis-server. It sends commands as redis.Request values,
+// and decodes replies with redis.ReplyReader into plain Go values.
+package client
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	redis "github.com/platinasystems/go-redis-server"
+)
+
+// Error is an error reply sent by the server, such as
+// "ERR unknown command".
+type Error string
+
+func (e Error) Error() string {
+	return string(e)
+}
+
+var ErrNil = errors.New("redis: nil reply")
+
+// Conn is a single connection to a redis server. It is not safe for
+// concurrent use; share a Pool instead.
+type Conn struct {
+	conn   net.Conn
+	reader *redis.ReplyReader
+	writer *bufio.Writer
+	err    error
+}
+
+// Dial connects to the redis server listening on addr.
+func Dial(network, addr string) (*Conn, error) {
+	return DialContext(context.Background(), network, addr)
+}
+
+// DialContext connects to the redis server listening on addr, giving up
+// when ctx is done.
+func DialContext(ctx context.Context, network, addr string) (*Conn, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return NewConn(conn), nil
+}
+
+// NewConn speaks the redis protocol over an established connection.
+func NewConn(conn net.Conn) *Conn {
+	return &Conn{
+		conn:   conn,
+		reader: redis.NewReplyReader(bufio.NewReader(conn)),
+		writer: bufio.NewWriter(conn),
+	}
+}
+
+// Close closes the connection.
+func (c *Conn) Close() error {
+	return c.conn.Close()
+}
+
+// Err returns the error that broke the connection, if any. A broken
+// connection must be closed.
+func (c *Conn) Err() error {
+	return c.err
+}
+
+// Do sends a command and returns its reply. Error replies are returned as
+// an Error. The deadline of ctx, if any, bounds the whole exchange.
+func (c *Conn) Do(ctx context.Context, name string, args ...interface{}) (interface{}, error) {
+	replies, err := c.exec(ctx, []*redis.Request{newRequest(name, args)})
+	if err != nil {
+		return nil, err
+	}
+	if err, ok := replies[0].(Error); ok {
+		return nil, err
+	}
+	return replies[0], nil
+}
+
+// exec sends all requests at once, then reads one reply for each.
+func (c *Conn) exec(ctx context.Context, requests []*redis.Request) ([]interface{}, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+	if err := c.watch(ctx); err != nil {
+		return nil, err
+	}
+	defer c.conn.SetDeadline(time.Time{})
+	stop := context.AfterFunc(ctx, func() {
+		// Unblock reads and writes at once on cancellation.
+		c.conn.SetDeadline(time.Unix(1, 0))
+	})
+	defer stop()
+
+	for _, r := range requests {
+		if _, err := r.WriteTo(c.writer); err != nil {
+			return nil, c.fatal(ctx, err)
+		}
+	}
+	if err := c.writer.Flush(); err != nil {
+		return nil, c.fatal(ctx, err)
+	}
+
+	replies := make([]interface{}, len(requests))
+	for i := range requests {
+		reply, err := c.reader.ReadReply()
+		if err != nil {
+			return nil, c.fatal(ctx, err)
+		}
+		if e, ok := reply.(*redis.ErrorReply); ok {
+			reply = Error(e.Code() + " " + e.Message())
+		}
+		replies[i] = reply
+	}
+	return replies, nil
+}
+
+// watch applies the deadline of ctx to the connection.
+func (c *Conn) watch(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	deadline, _ := ctx.Deadline()
+	return c.conn.SetDeadline(deadline)
+}
+
+// fatal marks the connection as broken: the stream is out of sync once an
+// exchange failed half way.
+func (c *Conn) fatal(ctx context.Context, err error) error {
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		if _, ok := ctx.Deadline(); ok {
+			// The socket deadline is the one of ctx, which is about to
+			// expire as well.
+			<-ctx.Done()
+		}
+	}
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		err = ctxErr
+	}
+	c.err = err
+	c.conn.Close()
+	return err
+}
+
+// Pipeline queues commands to send them in a single round trip.
+type Pipeline struct {
+	conn     *Conn
+	requests []*redis.Request
+}
+
+// Pipeline starts a batch of commands on the connection.
+func (c *Conn) Pipeline() *Pipeline {
+	return &Pipeline{conn: c}
+}
+
+// Send queues a command.
+func (p *Pipeline) Send(name string, args ...interface{}) {
+	p.requests = append(p.requests, newRequest(name, args))
+}
+
+// Exec sends the queued commands and returns their replies, in order.
+// Error replies are returned in place as an Error; the returned error is
+// only set when the exchange itself failed.
+func (p *Pipeline) Exec(ctx context.Context) ([]interface{}, error) {
+	requests := p.requests
+	p.requests = nil
+	if len(requests) == 0 {
+		return nil, nil
+	}
+	return p.conn.exec(ctx, requests)
+}
+
+func newRequest(name string, args []interface{}) *redis.Request {
+	r := &redis.Request{Name: name, Args: make([][]byte, len(args))}
+	for i, arg := range args {
+		r.Args[i] = argBytes(arg)
+	}
+	return r
+}
+
+// argBytes formats a command argument the way redis expects it.
+func argBytes(arg interface{}) []byte {
+	switch v := arg.(type) {
+	case []byte:
+		return v
+	case string:
+		return []byte(v)
+	case int:
+		return strconv.AppendInt(nil, int64(v), 10)
+	case int64:
+		return strconv.AppendInt(nil, v, 10)
+	case float64:
+		return strconv.AppendFloat(nil, v, 'g', -1, 64)
+	case bool:
+		if v {
+			return []byte("1")
+		}
+		return []byte("0")
+	case nil:
+		return []byte{}
+	}
+	return []byte(fmt.Sprint(arg))
+}
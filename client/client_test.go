@@ -0,0 +1,165 @@
+package client
+
+import (
+	"context"
+	"math"
+	"sync"
+	"testing"
+	"time"
+
+	redis "github.com/platinasystems/go-redis-server"
+)
+
+func startServer(t *testing.T) *redis.Server {
+	srv, err := redis.NewServer(redis.DefaultConfig().Port(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.RegisterFct("sleep", func() ([]byte, error) {
+		time.Sleep(200 * time.Millisecond)
+		return []byte("awake"), nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	go srv.Start()
+	t.Cleanup(func() { srv.Close() })
+	return srv
+}
+
+func TestDo(t *testing.T) {
+	srv := startServer(t)
+	ctx := context.Background()
+	c, err := Dial("tcp", srv.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if s, err := String(c.Do(ctx, "SET", "key", "hello world")); err != nil || s != "OK" {
+		t.Fatalf("Expected OK, got %q, %v", s, err)
+	}
+	if s, err := String(c.Do(ctx, "GET", "key")); err != nil || s != "hello world" {
+		t.Fatalf("Expected hello world, got %q, %v", s, err)
+	}
+	if n, err := Int64(c.Do(ctx, "INCR", "counter")); err != nil || n != 1 {
+		t.Fatalf("Expected 1, got %d, %v", n, err)
+	}
+	if _, err := c.Do(ctx, "HELLO", 4); err == nil || err.Error() != "NOPROTO unsupported protocol version" {
+		t.Fatalf("Expected NOPROTO error, got %v", err)
+	}
+
+	if _, err := c.Do(ctx, "HSET", "hash", "field", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Do(ctx, "HELLO", 3); err != nil {
+		t.Fatal(err)
+	}
+	reply, err := c.Do(ctx, "HGETALL", "hash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, ok := reply.(map[string]interface{})
+	if !ok || string(m["field"].([]byte)) != "value" {
+		t.Fatalf("Expected a RESP3 map, got %#v", reply)
+	}
+}
+
+func TestIntegerLimits(t *testing.T) {
+	srv := startServer(t)
+	for name, n := range map[string]int64{"maxint": math.MaxInt64, "minint": math.MinInt64} {
+		n := n
+		if err := srv.RegisterFct(name, func() (int, error) { return int(n), nil }); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c, err := Dial("tcp", srv.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	ctx := context.Background()
+	if n, err := Int64(c.Do(ctx, "MAXINT")); err != nil || n != math.MaxInt64 {
+		t.Fatalf("Expected %d, got %d, %v", int64(math.MaxInt64), n, err)
+	}
+	if n, err := Int64(c.Do(ctx, "MININT")); err != nil || n != math.MinInt64 {
+		t.Fatalf("Expected %d, got %d, %v", int64(math.MinInt64), n, err)
+	}
+}
+
+func TestPipeline(t *testing.T) {
+	srv := startServer(t)
+	c, err := Dial("tcp", srv.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	p := c.Pipeline()
+	p.Send("RPUSH", "list", "a", "b", "c")
+	p.Send("LRANGE", "list", 0, -1)
+	p.Send("NOSUCHCOMMAND")
+	p.Send("PING")
+	replies, err := p.Exec(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(replies) != 4 {
+		t.Fatalf("Expected 4 replies, got %d", len(replies))
+	}
+	if n, _ := Int64(replies[0], nil); n != 3 {
+		t.Fatalf("Expected 3, got %v", replies[0])
+	}
+	if s, _ := Strings(replies[1], nil); len(s) != 3 || s[0] != "a" || s[2] != "c" {
+		t.Fatalf("Expected [a b c], got %q", s)
+	}
+	if _, ok := replies[2].(Error); !ok {
+		t.Fatalf("Expected an error reply, got %#v", replies[2])
+	}
+	if replies[3] != "PONG" {
+		t.Fatalf("Expected PONG, got %#v", replies[3])
+	}
+}
+
+func TestDeadline(t *testing.T) {
+	srv := startServer(t)
+	c, err := Dial("tcp", srv.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := c.Do(ctx, "SLEEP"); err != context.DeadlineExceeded {
+		t.Fatalf("Expected deadline exceeded, got %v", err)
+	}
+	if c.Err() == nil {
+		t.Fatal("Expected the connection to be marked broken")
+	}
+}
+
+func TestPool(t *testing.T) {
+	srv := startServer(t)
+	pool := NewPool("tcp", srv.Addr, 2)
+	pool.MaxActive = 4
+	defer pool.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := pool.Do(context.Background(), "INCR", "pooled"); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n, err := Int64(pool.Do(context.Background(), "GET", "pooled")); err != nil || n != 20 {
+		t.Fatalf("Expected 20, got %d, %v", n, err)
+	}
+	if len(pool.idle) > 2 || pool.active > 4 {
+		t.Fatalf("Pool holds %d idle and %d active connections", len(pool.idle), pool.active)
+	}
+}
@@ -0,0 +1,145 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+var ErrPoolClosed = errors.New("redis: pool is closed")
+
+// Pool keeps idle connections to a redis server for reuse. It is safe for
+// concurrent use.
+type Pool struct {
+	// Dial opens a new connection.
+	Dial func(ctx context.Context) (*Conn, error)
+	// MaxIdle is the number of idle connections kept around.
+	MaxIdle int
+	// MaxActive, when positive, limits the number of open connections;
+	// Get then waits for a connection to be released.
+	MaxActive int
+	// IdleTimeout, when positive, closes connections left idle longer.
+	IdleTimeout time.Duration
+
+	mu     sync.Mutex
+	idle   []idleConn
+	active int
+	closed bool
+	wait   chan struct{}
+}
+
+type idleConn struct {
+	c     *Conn
+	since time.Time
+}
+
+// NewPool returns a pool of connections to the server at addr, keeping up
+// to size idle connections.
+func NewPool(network, addr string, size int) *Pool {
+	return &Pool{
+		Dial: func(ctx context.Context) (*Conn, error) {
+			return DialContext(ctx, network, addr)
+		},
+		MaxIdle: size,
+	}
+}
+
+// Get returns an idle connection, or dials a new one. The connection must
+// be handed back with Put.
+func (p *Pool) Get(ctx context.Context) (*Conn, error) {
+	for {
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			return nil, ErrPoolClosed
+		}
+		for len(p.idle) > 0 {
+			ic := p.idle[len(p.idle)-1]
+			p.idle = p.idle[:len(p.idle)-1]
+			if p.IdleTimeout > 0 && time.Since(ic.since) > p.IdleTimeout {
+				p.active--
+				ic.c.Close()
+				continue
+			}
+			p.mu.Unlock()
+			return ic.c, nil
+		}
+		if p.MaxActive <= 0 || p.active < p.MaxActive {
+			p.active++
+			p.mu.Unlock()
+			c, err := p.Dial(ctx)
+			if err != nil {
+				p.release()
+				return nil, err
+			}
+			return c, nil
+		}
+		if p.wait == nil {
+			p.wait = make(chan struct{})
+		}
+		wait := p.wait
+		p.mu.Unlock()
+
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Put hands a connection back to the pool. Broken connections, and those
+// in excess of MaxIdle, are closed.
+func (p *Pool) Put(c *Conn) {
+	p.mu.Lock()
+	if !p.closed && c.Err() == nil && len(p.idle) < p.MaxIdle {
+		p.idle = append(p.idle, idleConn{c: c, since: time.Now()})
+		p.signal()
+		p.mu.Unlock()
+		return
+	}
+	p.mu.Unlock()
+	c.Close()
+	p.release()
+}
+
+// release accounts for a closed connection.
+func (p *Pool) release() {
+	p.mu.Lock()
+	p.active--
+	p.signal()
+	p.mu.Unlock()
+}
+
+// signal wakes up callers of Get waiting for a connection.
+func (p *Pool) signal() {
+	if p.wait != nil {
+		close(p.wait)
+		p.wait = nil
+	}
+}
+
+// Do runs a single command on a pooled connection.
+func (p *Pool) Do(ctx context.Context, name string, args ...interface{}) (interface{}, error) {
+	c, err := p.Get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer p.Put(c)
+	return c.Do(ctx, name, args...)
+}
+
+// Close closes the idle connections, and those handed back from now on.
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	for _, ic := range p.idle {
+		ic.c.Close()
+		p.active--
+	}
+	p.idle = nil
+	p.signal()
+	return nil
+}
@@ -0,0 +1,85 @@
+package client
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// String converts a reply to a string. It is meant to wrap a call to Do:
+//
+//	s, err := client.String(c.Do(ctx, "GET", "key"))
+func String(reply interface{}, err error) (string, error) {
+	if err != nil {
+		return "", err
+	}
+	switch v := reply.(type) {
+	case string:
+		return v, nil
+	case []byte:
+		return string(v), nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case nil:
+		return "", ErrNil
+	}
+	return "", fmt.Errorf("redis: unexpected %T reply for String", reply)
+}
+
+// Bytes converts a reply to a byte slice.
+func Bytes(reply interface{}, err error) ([]byte, error) {
+	if err != nil {
+		return nil, err
+	}
+	switch v := reply.(type) {
+	case []byte:
+		return v, nil
+	case string:
+		return []byte(v), nil
+	case nil:
+		return nil, ErrNil
+	}
+	return nil, fmt.Errorf("redis: unexpected %T reply for Bytes", reply)
+}
+
+// Int64 converts a reply to an integer.
+func Int64(reply interface{}, err error) (int64, error) {
+	if err != nil {
+		return 0, err
+	}
+	switch v := reply.(type) {
+	case int64:
+		return v, nil
+	case []byte:
+		return strconv.ParseInt(string(v), 10, 64)
+	case string:
+		return strconv.ParseInt(v, 10, 64)
+	case nil:
+		return 0, ErrNil
+	}
+	return 0, fmt.Errorf("redis: unexpected %T reply for Int64", reply)
+}
+
+// Strings converts an array reply to a slice of strings, nil elements
+// becoming empty strings.
+func Strings(reply interface{}, err error) ([]string, error) {
+	if err != nil {
+		return nil, err
+	}
+	values, ok := reply.([]interface{})
+	if !ok {
+		if reply == nil {
+			return nil, ErrNil
+		}
+		return nil, fmt.Errorf("redis: unexpected %T reply for Strings", reply)
+	}
+	ret := make([]string, len(values))
+	for i, v := range values {
+		if v == nil {
+			continue
+		}
+		if ret[i], err = String(v, nil); err != nil {
+			return nil, err
+		}
+	}
+	return ret, nil
+}
@@ -0,0 +1,91 @@
+package redis
+
+import (
+	"bufio"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// readReply decodes the next reply sent to r.
+func readReply(t *testing.T, r *bufio.Reader) interface{} {
+	reply, err := NewReplyReader(r).ReadReply()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bytesToStrings(reply)
+}
+
+// bytesToStrings turns the bulk strings of a decoded reply into strings.
+func bytesToStrings(reply interface{}) interface{} {
+	switch v := reply.(type) {
+	case []byte:
+		return string(v)
+	case []interface{}:
+		for i := range v {
+			v[i] = bytesToStrings(v[i])
+		}
+	case map[string]interface{}:
+		for k := range v {
+			v[k] = bytesToStrings(v[k])
+		}
+	}
+	return reply
+}
+
+func expectReply(t *testing.T, r *bufio.Reader, expected interface{}) {
+	if reply := readReply(t, r); !reflect.DeepEqual(reply, expected) {
+		t.Fatalf("Expected %#v, got %#v", expected, reply)
+	}
+}
+
+func TestClientCommands(t *testing.T) {
+	srv, _ := startServer(t, DefaultConfig())
+
+	_, first := dial(t, srv, "CLIENT SETNAME first", "CLIENT GETNAME", "CLIENT ID", "SELECT 3")
+	expectReply(t, first, "OK")
+	expectReply(t, first, "first")
+	expectReply(t, first, int64(1))
+	expectReply(t, first, "OK")
+
+	second, r := dial(t, srv, "CLIENT GETNAME", "CLIENT SETNAME \"bad name\"", "HELLO 2 SETNAME second")
+	expectReply(t, r, nil)
+	expectLine(t, r, "-ERR Client names cannot contain spaces, newlines or special characters.")
+	hello, ok := readReply(t, r).([]interface{})
+	if !ok || len(hello) != 14 || !reflect.DeepEqual(hello[7], int64(2)) {
+		t.Fatalf("Unexpected HELLO reply %#v", hello)
+	}
+
+	second.Write([]byte("CLIENT LIST\r\n"))
+	list := readReply(t, r).(string)
+	lines := strings.Split(strings.TrimSuffix(list, "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 clients, got %q", list)
+	}
+	if !strings.HasPrefix(lines[0], "id=1 ") || !strings.Contains(lines[0], " name=first ") ||
+		!strings.Contains(lines[0], " db=3 ") || !strings.Contains(lines[0], " cmd=select ") {
+		t.Fatalf("Unexpected first client %q", lines[0])
+	}
+	if !strings.HasPrefix(lines[1], "id=2 ") || !strings.Contains(lines[1], " name=second ") ||
+		!strings.Contains(lines[1], " flags=N ") {
+		t.Fatalf("Unexpected second client %q", lines[1])
+	}
+
+	second.Write([]byte("CLIENT INFO\r\n"))
+	expectReply(t, r, lines[1]+"\n")
+
+	second.Write([]byte("CLIENT KILL 1.2.3.4:5\r\nCLIENT KILL ID 1\r\nCLIENT NOPE\r\n"))
+	expectLine(t, r, "-ERR No such client")
+	expectReply(t, r, int64(1))
+	expectLine(t, r, "-ERR unknown subcommand 'nope'. Try CLIENT HELP.")
+	if _, err := ioutil.ReadAll(first); err != nil {
+		t.Fatalf("Expected the first client to be disconnected, got %v", err)
+	}
+
+	second.Write([]byte("CLIENT KILL ID 2 SKIPME no\r\n"))
+	expectReply(t, r, int64(1))
+	if _, err := ioutil.ReadAll(r); err != nil {
+		t.Fatalf("Expected the second client to be disconnected, got %v", err)
+	}
+}
@@ -0,0 +1,493 @@
+package redis
+
+import (
+	"sort"
+	"strings"
+)
+
+// commandSpec describes a redis command: its arity, where its keys and
+// channels are in the arguments and the ACL categories it belongs to.
+// Positions count the command name as 0; negative ones count from the end.
+type commandSpec struct {
+	name string
+	// arity is the number of arguments including the name, or minus the
+	// minimum for variadic commands.
+	arity int
+
+	firstKey, lastKey, keyStep int
+	firstChannel, lastChannel  int
+
+	// categories lists the ACL categories, without their @.
+	categories string
+	// denyOOM commands may use more memory, and are refused once over
+	// maxmemory.
+	denyOOM bool
+
+	subcommands []*commandSpec
+	parent      *commandSpec
+}
+
+var commandTable = []*commandSpec{
+	// Strings
+	{name: "get", arity: 2, firstKey: 1, lastKey: 1, keyStep: 1, categories: "read string fast"},
+	{name: "set", arity: -3, firstKey: 1, lastKey: 1, keyStep: 1, categories: "write string slow", denyOOM: true},
+	{name: "setex", arity: 4, firstKey: 1, lastKey: 1, keyStep: 1, categories: "write string slow", denyOOM: true},
+	{name: "mget", arity: -2, firstKey: 1, lastKey: -1, keyStep: 1, categories: "read string fast"},
+	{name: "mset", arity: -3, firstKey: 1, lastKey: -1, keyStep: 2, categories: "write string slow", denyOOM: true},
+	{name: "incr", arity: 2, firstKey: 1, lastKey: 1, keyStep: 1, categories: "write string fast", denyOOM: true},
+	{name: "decr", arity: 2, firstKey: 1, lastKey: 1, keyStep: 1, categories: "write string fast", denyOOM: true},
+
+	// Keys
+	{name: "del", arity: -2, firstKey: 1, lastKey: -1, keyStep: 1, categories: "keyspace write slow"},
+	{name: "exists", arity: -2, firstKey: 1, lastKey: -1, keyStep: 1, categories: "keyspace read fast"},
+	{name: "keys", arity: 2, categories: "keyspace read slow dangerous"},
+	{name: "scan", arity: -2, categories: "keyspace read slow"},
+	{name: "type", arity: 2, firstKey: 1, lastKey: 1, keyStep: 1, categories: "keyspace read fast"},
+	{name: "ttl", arity: 2, firstKey: 1, lastKey: 1, keyStep: 1, categories: "keyspace read fast"},
+	{name: "pttl", arity: 2, firstKey: 1, lastKey: 1, keyStep: 1, categories: "keyspace read fast"},
+	{name: "expiretime", arity: 2, firstKey: 1, lastKey: 1, keyStep: 1, categories: "keyspace read fast"},
+	{name: "pexpiretime", arity: 2, firstKey: 1, lastKey: 1, keyStep: 1, categories: "keyspace read fast"},
+	{name: "expire", arity: -3, firstKey: 1, lastKey: 1, keyStep: 1, categories: "keyspace write fast"},
+	{name: "pexpire", arity: -3, firstKey: 1, lastKey: 1, keyStep: 1, categories: "keyspace write fast"},
+	{name: "expireat", arity: -3, firstKey: 1, lastKey: 1, keyStep: 1, categories: "keyspace write fast"},
+	{name: "pexpireat", arity: -3, firstKey: 1, lastKey: 1, keyStep: 1, categories: "keyspace write fast"},
+	{name: "persist", arity: 2, firstKey: 1, lastKey: 1, keyStep: 1, categories: "keyspace write fast"},
+	{name: "rename", arity: 3, firstKey: 1, lastKey: 2, keyStep: 1, categories: "keyspace write slow"},
+	{name: "dbsize", arity: 1, categories: "keyspace read fast"},
+	{name: "flushdb", arity: -1, categories: "keyspace write slow dangerous"},
+	{name: "flushall", arity: -1, categories: "keyspace write slow dangerous"},
+
+	// Hashes
+	{name: "hget", arity: 3, firstKey: 1, lastKey: 1, keyStep: 1, categories: "read hash fast"},
+	{name: "hset", arity: -4, firstKey: 1, lastKey: 1, keyStep: 1, categories: "write hash fast", denyOOM: true},
+	{name: "hmset", arity: -4, firstKey: 1, lastKey: 1, keyStep: 1, categories: "write hash fast", denyOOM: true},
+	{name: "hgetall", arity: 2, firstKey: 1, lastKey: 1, keyStep: 1, categories: "read hash slow"},
+	{name: "hlen", arity: 2, firstKey: 1, lastKey: 1, keyStep: 1, categories: "read hash fast"},
+
+	// Lists
+	{name: "rpush", arity: -3, firstKey: 1, lastKey: 1, keyStep: 1, categories: "write list fast", denyOOM: true},
+	{name: "lpush", arity: -3, firstKey: 1, lastKey: 1, keyStep: 1, categories: "write list fast", denyOOM: true},
+	{name: "brpop", arity: -3, firstKey: 1, lastKey: -2, keyStep: 1, categories: "write list slow blocking"},
+	{name: "blpop", arity: -3, firstKey: 1, lastKey: -2, keyStep: 1, categories: "write list slow blocking"},
+	{name: "lrange", arity: 4, firstKey: 1, lastKey: 1, keyStep: 1, categories: "read list slow"},
+	{name: "lindex", arity: 3, firstKey: 1, lastKey: 1, keyStep: 1, categories: "read list slow"},
+	{name: "llen", arity: 2, firstKey: 1, lastKey: 1, keyStep: 1, categories: "read list fast"},
+	{name: "lset", arity: 4, firstKey: 1, lastKey: 1, keyStep: 1, categories: "write list slow", denyOOM: true},
+	{name: "lrem", arity: 4, firstKey: 1, lastKey: 1, keyStep: 1, categories: "write list slow"},
+
+	// Sorted sets
+	{name: "zadd", arity: -4, firstKey: 1, lastKey: 1, keyStep: 1, categories: "write sortedset fast", denyOOM: true},
+	{name: "zrange", arity: -4, firstKey: 1, lastKey: 1, keyStep: 1, categories: "read sortedset slow"},
+	{name: "zrangebyscore", arity: -4, firstKey: 1, lastKey: 1, keyStep: 1, categories: "read sortedset slow"},
+	{name: "zrem", arity: -3, firstKey: 1, lastKey: 1, keyStep: 1, categories: "write sortedset fast"},
+	{name: "zremrangebyscore", arity: 4, firstKey: 1, lastKey: 1, keyStep: 1, categories: "write sortedset slow"},
+	{name: "zcard", arity: 2, firstKey: 1, lastKey: 1, keyStep: 1, categories: "read sortedset fast"},
+	{name: "zscore", arity: 3, firstKey: 1, lastKey: 1, keyStep: 1, categories: "read sortedset fast"},
+
+	// Pub/Sub
+	{name: "subscribe", arity: -2, firstChannel: 1, lastChannel: -1, categories: "pubsub slow"},
+	{name: "publish", arity: 3, firstChannel: 1, lastChannel: 1, categories: "pubsub fast"},
+
+	// Connection and server
+	{name: "auth", arity: -2, categories: "fast connection"},
+	{name: "hello", arity: -1, categories: "fast connection"},
+	{name: "ping", arity: -1, categories: "fast connection"},
+	{name: "select", arity: 2, categories: "fast connection"},
+	{name: "quit", arity: -1, categories: "fast connection"},
+	{name: "client", arity: -2, categories: "slow", subcommands: []*commandSpec{
+		{name: "id", arity: 2, categories: "slow connection"},
+		{name: "info", arity: 2, categories: "slow connection"},
+		{name: "list", arity: -2, categories: "admin slow dangerous connection"},
+		{name: "kill", arity: -3, categories: "admin slow dangerous connection"},
+		{name: "getname", arity: 2, categories: "slow connection"},
+		{name: "setname", arity: 3, categories: "slow connection"},
+	}},
+	{name: "acl", arity: -2, categories: "slow", subcommands: []*commandSpec{
+		{name: "cat", arity: -2, categories: "slow"},
+		{name: "deluser", arity: -3, categories: "admin slow dangerous"},
+		{name: "list", arity: 2, categories: "admin slow dangerous"},
+		{name: "setuser", arity: -3, categories: "admin slow dangerous"},
+		{name: "users", arity: 2, categories: "admin slow dangerous"},
+		{name: "whoami", arity: 2, categories: "slow"},
+	}},
+	{name: "monitor", arity: 1, categories: "admin slow dangerous"},
+	{name: "info", arity: -1, categories: "slow dangerous"},
+	{name: "config", arity: -2, categories: "slow", subcommands: []*commandSpec{
+		{name: "get", arity: -3, categories: "admin slow dangerous"},
+		{name: "set", arity: -4, categories: "admin slow dangerous"},
+		{name: "resetstat", arity: 2, categories: "admin slow dangerous"},
+		{name: "rewrite", arity: 2, categories: "admin slow dangerous"},
+		{name: "help", arity: 2, categories: "slow"},
+	}},
+	{name: "slowlog", arity: -2, categories: "slow", subcommands: []*commandSpec{
+		{name: "get", arity: -2, categories: "admin slow dangerous"},
+		{name: "len", arity: 2, categories: "admin slow dangerous"},
+		{name: "reset", arity: 2, categories: "admin slow dangerous"},
+		{name: "help", arity: 2, categories: "slow"},
+	}},
+	{name: "command", arity: -1, categories: "slow connection", subcommands: []*commandSpec{
+		{name: "count", arity: 2, categories: "slow connection"},
+		{name: "docs", arity: -2, categories: "slow connection"},
+		{name: "getkeys", arity: -3, categories: "slow connection"},
+		{name: "info", arity: -2, categories: "slow connection"},
+		{name: "list", arity: -2, categories: "slow connection"},
+		{name: "help", arity: 2, categories: "slow connection"},
+	}},
+	{name: "time", arity: 1, categories: "fast"},
+}
+
+// commands indexes commandTable by name. Subcommands are indexed as
+// "container|subcommand".
+var commands = make(map[string]*commandSpec)
+
+func init() {
+	for _, spec := range commandTable {
+		commands[spec.name] = spec
+		for _, sub := range spec.subcommands {
+			sub.parent = spec
+			commands[spec.name+"|"+sub.name] = sub
+		}
+	}
+}
+
+// fullName is the name of the command, prefixed by its container for
+// subcommands.
+func (spec *commandSpec) fullName() string {
+	if spec.parent != nil {
+		return spec.parent.name + "|" + spec.name
+	}
+	return spec.name
+}
+
+func (spec *commandSpec) inCategory(category string) bool {
+	for _, c := range strings.Fields(spec.categories) {
+		if c == category {
+			return true
+		}
+	}
+	return false
+}
+
+// lookupCommand returns the spec of the command name called with args,
+// resolving subcommands. It returns nil for unknown commands.
+func lookupCommand(name string, args [][]byte) *commandSpec {
+	return commands[strings.ToLower(name)].subcommand(args)
+}
+
+// subcommand returns the subcommand of spec named by args, or spec.
+func (spec *commandSpec) subcommand(args [][]byte) *commandSpec {
+	if spec != nil && len(spec.subcommands) > 0 && len(args) > 0 {
+		if sub := commands[spec.name+"|"+strings.ToLower(string(args[0]))]; sub != nil {
+			return sub
+		}
+	}
+	return spec
+}
+
+// argRange returns the arguments from first to last by step, positions
+// counting the command name, and subcommand, as redis does.
+func (spec *commandSpec) argRange(args [][]byte, first, last, step int) [][]byte {
+	if first == 0 {
+		return nil
+	}
+	// args does not hold the command name.
+	argc := len(args) + 1
+	if last < 0 {
+		last = argc + last
+	}
+	if step < 1 {
+		step = 1
+	}
+	var ret [][]byte
+	for i := first; i <= last && i < argc; i += step {
+		ret = append(ret, args[i-1])
+	}
+	return ret
+}
+
+// keys returns the keys named by args.
+func (spec *commandSpec) keys(args [][]byte) [][]byte {
+	return spec.argRange(args, spec.firstKey, spec.lastKey, spec.keyStep)
+}
+
+// channels returns the pub/sub channels named by args.
+func (spec *commandSpec) channels(args [][]byte) [][]byte {
+	return spec.argRange(args, spec.firstChannel, spec.lastChannel, 1)
+}
+
+// categories lists every ACL category, sorted.
+func categories() []string {
+	seen := make(map[string]bool)
+	for _, spec := range commands {
+		for _, c := range strings.Fields(spec.categories) {
+			seen[c] = true
+		}
+	}
+	ret := make([]string, 0, len(seen))
+	for c := range seen {
+		ret = append(ret, c)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// commandFlags maps the ACL categories to the flags of COMMAND INFO.
+var commandFlags = []struct{ category, flag string }{
+	{"write", "write"},
+	{"read", "readonly"},
+	{"admin", "admin"},
+	{"pubsub", "pubsub"},
+	{"blocking", "blocking"},
+	{"fast", "fast"},
+}
+
+// docGroups maps the ACL categories to the groups of COMMAND DOCS.
+var docGroups = []struct{ category, group string }{
+	{"string", "string"},
+	{"list", "list"},
+	{"hash", "hash"},
+	{"sortedset", "sorted-set"},
+	{"pubsub", "pubsub"},
+	{"keyspace", "generic"},
+	{"connection", "connection"},
+}
+
+// redisHandler is implemented by the handlers whose methods take the
+// arguments of the redis commands of the same name, such as
+// DefaultHandler and the handlers embedding it. Their commands keep the
+// arity of commandTable.
+type redisHandler interface {
+	redisCommands()
+}
+
+// addCommandSpec adds name to the commands of the server, with arity,
+// counting the name and negative for variadic commands. Zero keeps the
+// arity of commandTable. Commands missing from commandTable have no flags
+// or keys.
+func (srv *Server) addCommandSpec(name string, arity int) {
+	if srv.commandSpecs == nil {
+		srv.commandSpecs = make(map[string]*commandSpec)
+	}
+	spec := commands[name]
+	switch {
+	case spec == nil:
+		if arity == 0 {
+			arity = -1
+		}
+		spec = &commandSpec{name: name, arity: arity}
+	case arity != 0 && arity != spec.arity:
+		custom := *spec
+		custom.arity = arity
+		spec = &custom
+	}
+	srv.commandSpecs[name] = spec
+}
+
+// sortedCommandSpecs returns the commands of the server, sorted by name.
+func (srv *Server) sortedCommandSpecs() []*commandSpec {
+	specs := make([]*commandSpec, 0, len(srv.commandSpecs))
+	for _, spec := range srv.commandSpecs {
+		specs = append(specs, spec)
+	}
+	sort.Slice(specs, func(i, j int) bool { return specs[i].name < specs[j].name })
+	return specs
+}
+
+// lookupCommandSpec is lookupCommand for the commands of the server.
+func (srv *Server) lookupCommandSpec(name string, args [][]byte) *commandSpec {
+	return srv.commandSpecs[strings.ToLower(name)].subcommand(args)
+}
+
+// info is the reply of COMMAND INFO: name, arity, flags, key positions,
+// ACL categories, tips, key specifications and subcommands.
+func (spec *commandSpec) info() []interface{} {
+	var flags, categories []interface{}
+	for _, f := range commandFlags {
+		if spec.inCategory(f.category) {
+			flags = append(flags, &StatusReply{Code: f.flag})
+		}
+	}
+	if spec.denyOOM {
+		flags = append(flags, &StatusReply{Code: "denyoom"})
+	}
+	for _, c := range strings.Fields(spec.categories) {
+		categories = append(categories, &StatusReply{Code: "@" + c})
+	}
+	subcommands := make([]interface{}, len(spec.subcommands))
+	for i, sub := range spec.subcommands {
+		subcommands[i] = sub.info()
+	}
+	return []interface{}{
+		spec.fullName(),
+		spec.arity,
+		&SetReply{values: flags},
+		spec.firstKey,
+		spec.lastKey,
+		spec.keyStep,
+		&SetReply{values: categories},
+		[]interface{}{},
+		[]interface{}{},
+		subcommands,
+	}
+}
+
+// docs is the reply of COMMAND DOCS for the command.
+func (spec *commandSpec) docs() *MapReply {
+	group := "server"
+	categorized := spec
+	if len(spec.subcommands) > 0 {
+		categorized = spec.subcommands[0]
+	}
+	for _, g := range docGroups {
+		if categorized.inCategory(g.category) {
+			group = g.group
+			break
+		}
+	}
+	values := []interface{}{"group", group}
+	if len(spec.subcommands) > 0 {
+		var subcommands []interface{}
+		for _, sub := range spec.subcommands {
+			subcommands = append(subcommands, sub.fullName(), sub.docs())
+		}
+		values = append(values, "subcommands", &MapReply{values: subcommands})
+	}
+	return &MapReply{values: values}
+}
+
+// command implements COMMAND [COUNT|INFO|LIST|GETKEYS|DOCS].
+func (srv *Server) command(r *Request) (ReplyWriter, error) {
+	if len(r.Args) == 0 {
+		var values []interface{}
+		for _, spec := range srv.sortedCommandSpecs() {
+			values = append(values, spec.info())
+		}
+		return &MultiBulkReply{values: values}, nil
+	}
+	sub := strings.ToLower(string(r.Args[0]))
+	args := r.Args[1:]
+	switch sub {
+	case "count":
+		return &IntegerReply{number: len(srv.commandSpecs)}, nil
+	case "info":
+		var values []interface{}
+		if len(args) == 0 {
+			for _, spec := range srv.sortedCommandSpecs() {
+				values = append(values, spec.info())
+			}
+		}
+		for _, arg := range args {
+			name := strings.ToLower(string(arg))
+			spec := srv.commandSpecs[name]
+			if i := strings.IndexByte(name, '|'); i >= 0 && srv.commandSpecs[name[:i]] != nil {
+				spec = commands[name]
+			}
+			if spec == nil {
+				values = append(values, nil)
+				continue
+			}
+			values = append(values, spec.info())
+		}
+		if values == nil {
+			return &MultiBulkReply{values: []interface{}{}}, nil
+		}
+		return &MultiBulkReply{values: values}, nil
+	case "docs":
+		var values []interface{}
+		for _, spec := range srv.sortedCommandSpecs() {
+			if len(args) > 0 && !containsFold(args, spec.name) {
+				continue
+			}
+			values = append(values, spec.name, spec.docs())
+		}
+		return &MapReply{values: values}, nil
+	case "list":
+		var match func(spec *commandSpec) bool
+		switch {
+		case len(args) == 0:
+		case len(args) == 3 && strings.EqualFold(string(args[0]), "filterby"):
+			value := strings.ToLower(string(args[2]))
+			switch strings.ToLower(string(args[1])) {
+			case "aclcat":
+				match = func(spec *commandSpec) bool { return spec.inCategory(value) }
+			case "pattern":
+				re := patternRE(value)
+				match = func(spec *commandSpec) bool { return re != nil && re.MatchString(spec.fullName()) }
+			case "module":
+				match = func(*commandSpec) bool { return false }
+			default:
+				return newErrorCode("ERR", "syntax error"), nil
+			}
+		default:
+			return newErrorCode("ERR", "syntax error"), nil
+		}
+		values := []interface{}{}
+		for _, spec := range srv.sortedCommandSpecs() {
+			for _, s := range append([]*commandSpec{spec}, spec.subcommands...) {
+				if match == nil || match(s) {
+					values = append(values, s.fullName())
+				}
+			}
+		}
+		return &MultiBulkReply{values: values}, nil
+	case "getkeys":
+		if len(args) == 0 {
+			return newErrorCode("ERR", "wrong number of arguments for 'command|getkeys' command"), nil
+		}
+		spec := srv.lookupCommandSpec(string(args[0]), args[1:])
+		switch {
+		case spec == nil:
+			return newErrorCode("ERR", "Invalid command specified"), nil
+		case !spec.arityMatches(len(args)):
+			return newErrorCode("ERR", "Invalid number of arguments specified for command"), nil
+		}
+		keys := spec.keys(args[1:])
+		if len(keys) == 0 {
+			return newErrorCode("ERR", "The command has no key arguments"), nil
+		}
+		values := make([]interface{}, len(keys))
+		for i, key := range keys {
+			values[i] = key
+		}
+		return &MultiBulkReply{values: values}, nil
+	case "help":
+		return &MultiBulkReply{values: []interface{}{
+			"COMMAND <subcommand> [<arg> [value] [opt] ...]. Subcommands are:",
+			"(no subcommand)",
+			"    Return details about all commands.",
+			"COUNT",
+			"    Return the total number of commands in this server.",
+			"LIST [FILTERBY (MODULE <module-name>|ACLCAT <category>|PATTERN <pattern>)]",
+			"    Return a list of all commands in this server.",
+			"INFO [<command-name> ...]",
+			"    Return details about multiple commands.",
+			"    If no command names are given, documentation details for all",
+			"    commands are returned.",
+			"DOCS [<command-name> ...]",
+			"    Return documentation details about multiple commands.",
+			"    If no command names are given, documentation details for all",
+			"    commands are returned.",
+			"GETKEYS <full-command>",
+			"    Return the keys from a full Redis command.",
+		}}, nil
+	}
+	return wrongSubcommand("command", sub), nil
+}
+
+// arityMatches tells whether argc arguments, counting the name, suit
+// the arity of the command.
+func (spec *commandSpec) arityMatches(argc int) bool {
+	if spec.arity < 0 {
+		return argc >= -spec.arity
+	}
+	return argc == spec.arity
+}
+
+func containsFold(args [][]byte, s string) bool {
+	for _, arg := range args {
+		if strings.EqualFold(string(arg), s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,46 @@
+package redis
+
+import (
+	"testing"
+)
+
+func TestCommandCommand(t *testing.T) {
+	srv, _ := startServer(t, DefaultConfig())
+	if err := srv.RegisterFct("sum", func(a string, b ...[]byte) ([]byte, error) { return nil, nil }); err != nil {
+		t.Fatal(err)
+	}
+
+	_, r := dial(t, srv,
+		"COMMAND INFO get nosuch config|get sum",
+		"COMMAND LIST FILTERBY ACLCAT hash",
+		"COMMAND LIST FILTERBY PATTERN config*",
+		"COMMAND GETKEYS MSET a 1 b 2",
+		"COMMAND GETKEYS GET",
+		"COMMAND GETKEYS nosuch x",
+		"COMMAND GETKEYS PING",
+		"COMMAND DOCS get",
+		"COMMAND COUNT",
+		"COMMAND",
+	)
+	none := []interface{}{}
+	expectReply(t, r, []interface{}{
+		[]interface{}{"get", int64(2), []interface{}{"readonly", "fast"}, int64(1), int64(1), int64(1),
+			[]interface{}{"@read", "@string", "@fast"}, none, none, none},
+		nil,
+		[]interface{}{"config|get", int64(-3), []interface{}{"admin"}, int64(0), int64(0), int64(0),
+			[]interface{}{"@admin", "@slow", "@dangerous"}, none, none, none},
+		[]interface{}{"sum", int64(-2), none, int64(0), int64(0), int64(0), none, none, none, none},
+	})
+	expectReply(t, r, []interface{}{"hget", "hgetall", "hlen", "hmset", "hset"})
+	expectReply(t, r, []interface{}{"config", "config|get", "config|set", "config|resetstat", "config|rewrite", "config|help"})
+	expectReply(t, r, []interface{}{"a", "b"})
+	expectLine(t, r, "-ERR Invalid number of arguments specified for command")
+	expectLine(t, r, "-ERR Invalid command specified")
+	expectLine(t, r, "-ERR The command has no key arguments")
+	expectReply(t, r, []interface{}{"get", []interface{}{"group", "string"}})
+
+	count := readReply(t, r).(int64)
+	if all := readReply(t, r).([]interface{}); int64(len(all)) != count || count < 50 {
+		t.Fatalf("Expected %d commands, got %d", count, len(all))
+	}
+}
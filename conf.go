@@ -0,0 +1,750 @@
+package redis
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrNoConfigFile = newErrorCode("ERR", "The server is running without a config file")
+
+// configParam is a parameter of redis.conf, read and changed with CONFIG
+// GET and CONFIG SET.
+type configParam struct {
+	name string
+	// get formats the value of the parameter in c.
+	get func(c *Config) string
+	// set parses value into c.
+	set func(c *Config, value string) error
+	// mutable parameters can be changed by CONFIG SET.
+	mutable bool
+	// multiArg parameters are written as several arguments, like bind.
+	multiArg bool
+	// apply, if set, makes a change of the running server effective.
+	apply func(srv *Server, c *Config)
+}
+
+// configWatcher is implemented by handlers applying parameters of the
+// configuration, like notify-keyspace-events. configChanged is called with
+// every parameter when the server is created, and on CONFIG SET.
+type configWatcher interface {
+	configChanged(name, value string)
+}
+
+var configParams = []*configParam{
+	{
+		name: "bind",
+		get: func(c *Config) string {
+			if len(c.bindHosts) > 0 {
+				return strings.Join(c.bindHosts, " ")
+			}
+			return c.host
+		},
+		set: func(c *Config, v string) error {
+			c.bindHosts = strings.Fields(v)
+			return nil
+		},
+		multiArg: true,
+	},
+	{
+		name: "port",
+		get:  func(c *Config) string { return strconv.Itoa(c.port) },
+		set:  intParam(func(c *Config, n int) { c.port = n }, 0, 65535),
+	},
+	{
+		name: "tls-port",
+		get:  func(c *Config) string { return strconv.Itoa(c.tlsPort) },
+		set:  intParam(func(c *Config, n int) { c.tlsPort = n }, 0, 65535),
+	},
+	{
+		name: "unixsocket",
+		get:  func(c *Config) string { return c.unixSocket },
+		set:  func(c *Config, v string) error { c.unixSocket = v; return nil },
+	},
+	{
+		name: "unixsocketperm",
+		get:  func(c *Config) string { return strconv.FormatUint(uint64(c.unixSocketPerm), 8) },
+		set: func(c *Config, v string) error {
+			perm, err := strconv.ParseUint(v, 8, 32)
+			if err != nil || perm > 0777 {
+				return errors.New("argument must be an octal number between 0 and 777")
+			}
+			c.unixSocketPerm = os.FileMode(perm)
+			return nil
+		},
+	},
+	{
+		name: "tls-cert-file",
+		get:  func(c *Config) string { return c.tlsCertFile },
+		set:  func(c *Config, v string) error { c.tlsCertFile = v; return nil },
+	},
+	{
+		name: "tls-key-file",
+		get:  func(c *Config) string { return c.tlsKeyFile },
+		set:  func(c *Config, v string) error { c.tlsKeyFile = v; return nil },
+	},
+	{
+		name: "tls-ca-cert-file",
+		get:  func(c *Config) string { return c.tlsCACertFile },
+		set:  func(c *Config, v string) error { c.tlsCACertFile = v; return nil },
+	},
+	{
+		name: "tls-auth-clients",
+		get: func(c *Config) string {
+			if c.authClients == "" {
+				return "no"
+			}
+			return c.authClients
+		},
+		set: func(c *Config, v string) error {
+			switch v = strings.ToLower(v); v {
+			case "yes", "no", "optional":
+				c.authClients = v
+				return nil
+			}
+			return errors.New("argument(s) must be one of the following: no, yes, optional")
+		},
+	},
+	{
+		name: "databases",
+		get:  func(c *Config) string { return strconv.Itoa(c.databases) },
+		set:  intParam(func(c *Config, n int) { c.databases = n }, 1, 1<<31-1),
+	},
+	{
+		name: "proto-max-bulk-len",
+		get:  func(c *Config) string { return strconv.Itoa(c.maxBulkLen) },
+		set: func(c *Config, v string) error {
+			n, err := parseMemory(v)
+			if err != nil || n < 1024*1024 || n > 1<<31-1 {
+				return errors.New("argument must be a memory value between 1mb and 2gb")
+			}
+			c.maxBulkLen = int(n)
+			return nil
+		},
+	},
+	{
+		name:    "requirepass",
+		get:     func(c *Config) string { return c.requirePass },
+		set:     func(c *Config, v string) error { c.requirePass = v; return nil },
+		mutable: true,
+		apply: func(srv *Server, c *Config) {
+			rules := []string{"resetpass", "nopass"}
+			if c.requirePass != "" {
+				rules[1] = ">" + c.requirePass
+			}
+			srv.users.setUser("default", rules)
+		},
+	},
+	{
+		name: "loglevel",
+		get:  func(c *Config) string { return c.logLevel.String() },
+		set: func(c *Config, v string) error {
+			level, err := ParseLogLevel(v)
+			if err != nil {
+				return err
+			}
+			c.logLevel = level
+			return nil
+		},
+		mutable: true,
+	},
+	{
+		name:    "timeout",
+		get:     func(c *Config) string { return strconv.Itoa(int(c.timeout / time.Second)) },
+		set:     intParam(func(c *Config, n int) { c.timeout = time.Duration(n) * time.Second }, 0, 1<<31-1),
+		mutable: true,
+	},
+	{
+		name:    "tcp-keepalive",
+		get:     func(c *Config) string { return strconv.Itoa(int(c.tcpKeepAlive / time.Second)) },
+		set:     intParam(func(c *Config, n int) { c.tcpKeepAlive = time.Duration(n) * time.Second }, 0, 1<<31-1),
+		mutable: true,
+	},
+	{
+		name:    "write-timeout",
+		get:     func(c *Config) string { return strconv.FormatInt(int64(c.writeTimeout/time.Millisecond), 10) },
+		set:     intParam(func(c *Config, n int) { c.writeTimeout = time.Duration(n) * time.Millisecond }, 0, 1<<31-1),
+		mutable: true,
+	},
+	{
+		name: "client-output-buffer-limit",
+		get:  func(c *Config) string { return formatOutputLimits(c.outputLimits[:]) },
+		set: func(c *Config, v string) error {
+			return parseOutputLimits(c.outputLimits[:], v)
+		},
+		mutable:  true,
+		multiArg: true,
+	},
+	{
+		name:    "command-timeout",
+		get:     func(c *Config) string { return strconv.FormatInt(int64(c.commandTimeout/time.Millisecond), 10) },
+		set:     intParam(func(c *Config, n int) { c.commandTimeout = time.Duration(n) * time.Millisecond }, 0, 1<<31-1),
+		mutable: true,
+	},
+	{
+		name:    "maxclients",
+		get:     func(c *Config) string { return strconv.Itoa(c.maxClients) },
+		set:     intParam(func(c *Config, n int) { c.maxClients = n }, 1, 1<<31-1),
+		mutable: true,
+	},
+	{
+		name: "maxmemory",
+		get:  func(c *Config) string { return strconv.FormatInt(c.maxMemory, 10) },
+		set: func(c *Config, v string) error {
+			n, err := parseMemory(v)
+			if err != nil {
+				return err
+			}
+			c.maxMemory = n
+			return nil
+		},
+		mutable: true,
+	},
+	{
+		name:    "slowlog-log-slower-than",
+		get:     func(c *Config) string { return strconv.FormatInt(int64(c.slowlogSlowerThan/time.Microsecond), 10) },
+		set:     intParam(func(c *Config, n int) { c.slowlogSlowerThan = time.Duration(n) * time.Microsecond }, -1<<31, 1<<31-1),
+		mutable: true,
+	},
+	{
+		name:    "slowlog-max-len",
+		get:     func(c *Config) string { return strconv.Itoa(c.slowlogMaxLen) },
+		set:     intParam(func(c *Config, n int) { c.slowlogMaxLen = n }, 0, 1<<31-1),
+		mutable: true,
+	},
+	{
+		name: "notify-keyspace-events",
+		get:  func(c *Config) string { return c.notifyKeyspaceEvents },
+		set: func(c *Config, v string) error {
+			flags, ok := parseKeyspaceEvents(v)
+			if !ok {
+				return errors.New("Invalid event class character. Use 'Ag$lshzxeKEtmdn'.")
+			}
+			c.notifyKeyspaceEvents = formatKeyspaceEvents(flags)
+			return nil
+		},
+		mutable: true,
+	},
+}
+
+// intParam returns the setter of an integer parameter between min and max.
+func intParam(set func(c *Config, n int), min, max int) func(c *Config, v string) error {
+	return func(c *Config, v string) error {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return errors.New("argument couldn't be parsed into an integer")
+		}
+		if n < min || n > max {
+			return fmt.Errorf("argument must be between %d and %d inclusive", min, max)
+		}
+		set(c, n)
+		return nil
+	}
+}
+
+func lookupConfigParam(name string) *configParam {
+	name = strings.ToLower(name)
+	for _, p := range configParams {
+		if p.name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+// parseMemory parses a number of bytes with an optional unit, as in
+// redis.conf: k is 1000 bytes and kb 1024, and likewise for m and g.
+func parseMemory(v string) (int64, error) {
+	lower := strings.ToLower(v)
+	mul := int64(1)
+	for _, unit := range []struct {
+		suffix string
+		mul    int64
+	}{
+		{"kb", 1 << 10}, {"mb", 1 << 20}, {"gb", 1 << 30},
+		{"k", 1000}, {"m", 1000 * 1000}, {"g", 1000 * 1000 * 1000},
+		{"b", 1},
+	} {
+		if strings.HasSuffix(lower, unit.suffix) {
+			lower, mul = strings.TrimSuffix(lower, unit.suffix), unit.mul
+			break
+		}
+	}
+	n, err := strconv.ParseInt(lower, 10, 64)
+	if err != nil || n < 0 || n > (1<<63-1)/mul {
+		return 0, errors.New("argument must be a memory value")
+	}
+	return n * mul, nil
+}
+
+// Keyspace notification classes, as in notify-keyspace-events.
+const (
+	notifyKeyspace = 1 << iota // K
+	notifyKeyevent             // E
+	notifyGeneric              // g
+	notifyString               // $
+	notifyList                 // l
+	notifySet                  // s
+	notifyHash                 // h
+	notifyZset                 // z
+	notifyExpired              // x
+	notifyEvicted              // e
+	notifyStream               // t
+	notifyKeyMiss              // m
+	notifyModule               // d
+	notifyNew                  // n
+
+	notifyAll = notifyGeneric | notifyString | notifyList | notifySet | notifyHash |
+		notifyZset | notifyExpired | notifyEvicted | notifyStream | notifyModule
+)
+
+var keyspaceEventClasses = []struct {
+	c    byte
+	flag int
+}{
+	{'g', notifyGeneric}, {'$', notifyString}, {'l', notifyList}, {'s', notifySet},
+	{'h', notifyHash}, {'z', notifyZset}, {'x', notifyExpired}, {'e', notifyEvicted},
+	{'t', notifyStream}, {'d', notifyModule},
+}
+
+func parseKeyspaceEvents(v string) (int, bool) {
+	flags := 0
+	for i := 0; i < len(v); i++ {
+		switch v[i] {
+		case 'A':
+			flags |= notifyAll
+		case 'K':
+			flags |= notifyKeyspace
+		case 'E':
+			flags |= notifyKeyevent
+		case 'm':
+			flags |= notifyKeyMiss
+		case 'n':
+			flags |= notifyNew
+		default:
+			found := false
+			for _, class := range keyspaceEventClasses {
+				if class.c == v[i] {
+					flags |= class.flag
+					found = true
+				}
+			}
+			if !found {
+				return 0, false
+			}
+		}
+	}
+	return flags, true
+}
+
+func formatKeyspaceEvents(flags int) string {
+	var b strings.Builder
+	if flags&notifyAll == notifyAll {
+		b.WriteByte('A')
+	} else {
+		for _, class := range keyspaceEventClasses {
+			if flags&class.flag != 0 {
+				b.WriteByte(class.c)
+			}
+		}
+	}
+	for _, class := range []struct {
+		c    byte
+		flag int
+	}{{'K', notifyKeyspace}, {'E', notifyKeyevent}, {'m', notifyKeyMiss}, {'n', notifyNew}} {
+		if flags&class.flag != 0 {
+			b.WriteByte(class.c)
+		}
+	}
+	return b.String()
+}
+
+// LoadConfig reads a redis.conf file into a DefaultConfig. CONFIG REWRITE
+// writes the changes made with CONFIG SET back to it.
+func LoadConfig(path string) (*Config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	c := DefaultConfig()
+	if err := c.load(f, path); err != nil {
+		return nil, err
+	}
+	c.file = path
+	return c, nil
+}
+
+// load parses the directives of a redis.conf file into c.
+func (c *Config) load(r io.Reader, name string) error {
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		args, err := splitConfigLine(scanner.Text())
+		if err != nil {
+			return fmt.Errorf("%s:%d: %s", name, n, err)
+		}
+		if len(args) == 0 {
+			continue
+		}
+		p := lookupConfigParam(args[0])
+		if p == nil || (len(args) != 2 && !p.multiArg) {
+			return fmt.Errorf("%s:%d: Bad directive or wrong number of arguments", name, n)
+		}
+		if err := p.set(c, strings.Join(args[1:], " ")); err != nil {
+			return fmt.Errorf("%s:%d: %s: %s", name, n, p.name, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return c.loadTLSFiles()
+}
+
+// loadTLSFiles sets the TLS configuration from tls-cert-file, tls-key-file
+// and tls-ca-cert-file.
+func (c *Config) loadTLSFiles() error {
+	if c.tlsCertFile == "" {
+		return nil
+	}
+	cert, err := tls.LoadX509KeyPair(c.tlsCertFile, c.tlsKeyFile)
+	if err != nil {
+		return err
+	}
+	t := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if c.tlsCACertFile != "" {
+		pem, err := ioutil.ReadFile(c.tlsCACertFile)
+		if err != nil {
+			return err
+		}
+		t.ClientCAs = x509.NewCertPool()
+		if !t.ClientCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificate in %s", c.tlsCACertFile)
+		}
+	}
+	c.tls = t
+	return nil
+}
+
+// splitConfigLine splits a line of redis.conf in arguments, handling
+// quotes the way redis does. Comments and blank lines have none.
+func splitConfigLine(line string) ([]string, error) {
+	line = strings.TrimSpace(line)
+	if line == "" || line[0] == '#' {
+		return nil, nil
+	}
+	var args []string
+	for i := 0; i < len(line); {
+		for i < len(line) && (line[i] == ' ' || line[i] == '\t') {
+			i++
+		}
+		if i == len(line) {
+			break
+		}
+		var arg []byte
+		switch line[i] {
+		case '"':
+			for i++; ; i++ {
+				if i == len(line) {
+					return nil, errors.New("Unbalanced quotes in configuration line")
+				}
+				if line[i] == '"' {
+					break
+				}
+				if line[i] == '\\' && i+1 < len(line) {
+					i++
+					switch line[i] {
+					case 'n':
+						arg = append(arg, '\n')
+					case 'r':
+						arg = append(arg, '\r')
+					case 't':
+						arg = append(arg, '\t')
+					case 'b':
+						arg = append(arg, '\b')
+					case 'a':
+						arg = append(arg, '\a')
+					case 'x':
+						if i+3 > len(line) {
+							arg = append(arg, 'x')
+						} else if b, err := strconv.ParseUint(line[i+1:i+3], 16, 8); err != nil {
+							arg = append(arg, 'x')
+						} else {
+							arg = append(arg, byte(b))
+							i += 2
+						}
+					default:
+						arg = append(arg, line[i])
+					}
+					continue
+				}
+				arg = append(arg, line[i])
+			}
+			i++
+		case '\'':
+			for i++; ; i++ {
+				if i == len(line) {
+					return nil, errors.New("Unbalanced quotes in configuration line")
+				}
+				if line[i] == '\'' {
+					break
+				}
+				if line[i] == '\\' && i+1 < len(line) && line[i+1] == '\'' {
+					i++
+				}
+				arg = append(arg, line[i])
+			}
+			i++
+		default:
+			for ; i < len(line) && line[i] != ' ' && line[i] != '\t'; i++ {
+				arg = append(arg, line[i])
+			}
+		}
+		if i < len(line) && line[i] != ' ' && line[i] != '\t' {
+			return nil, errors.New("Unbalanced quotes in configuration line")
+		}
+		args = append(args, string(arg))
+	}
+	return args, nil
+}
+
+// quoteConfigArg quotes an argument of redis.conf when it needs to.
+func quoteConfigArg(arg string) string {
+	plain := arg != ""
+	for i := 0; i < len(arg) && plain; i++ {
+		plain = arg[i] > ' ' && arg[i] < 0x7f && arg[i] != '"' && arg[i] != '\'' && arg[i] != '\\'
+	}
+	if plain {
+		return arg
+	}
+	var b bytes.Buffer
+	b.WriteByte('"')
+	for i := 0; i < len(arg); i++ {
+		switch c := arg[i]; {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c == '\n':
+			b.WriteString(`\n`)
+		case c == '\r':
+			b.WriteString(`\r`)
+		case c == '\t':
+			b.WriteString(`\t`)
+		case c < ' ' || c >= 0x7f:
+			fmt.Fprintf(&b, `\x%02x`, c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// line formats the parameter as a line of redis.conf.
+func (p *configParam) line(c *Config) string {
+	value := p.get(c)
+	if !p.multiArg {
+		return p.name + " " + quoteConfigArg(value)
+	}
+	line := p.name
+	for _, arg := range strings.Fields(value) {
+		line += " " + quoteConfigArg(arg)
+	}
+	return line
+}
+
+var (
+	bareConfigOnce sync.Once
+	bareConfig     *Config
+)
+
+// conf returns the configuration of the running server, or the default
+// one for a Server not created by NewServer.
+func (srv *Server) conf() *Config {
+	if c, _ := srv.liveConfig.Load().(*Config); c != nil {
+		return c
+	}
+	bareConfigOnce.Do(func() {
+		bareConfig = DefaultConfig().Handler(nil)
+	})
+	return bareConfig
+}
+
+// configure notifies the handler of every parameter of c.
+func (srv *Server) configure(c *Config) {
+	w, ok := srv.handler.(configWatcher)
+	if !ok {
+		return
+	}
+	for _, p := range configParams {
+		w.configChanged(p.name, p.get(c))
+	}
+}
+
+// configSet implements CONFIG SET: the parameters are all changed, or
+// none is.
+func (srv *Server) configSet(args [][]byte) ReplyWriter {
+	srv.configMu.Lock()
+	defer srv.configMu.Unlock()
+	c := srv.conf().clone()
+	var changed []*configParam
+	for i := 0; i < len(args); i += 2 {
+		name := string(args[i])
+		p := lookupConfigParam(name)
+		if p == nil {
+			return newErrorCode("ERR", "Unknown option or number of arguments for CONFIG SET - '"+name+"'")
+		}
+		failed := "CONFIG SET failed (possibly related to argument '" + name + "') - "
+		if !p.mutable {
+			return newErrorCode("ERR", failed+"can't set immutable config")
+		}
+		for _, q := range changed {
+			if q == p {
+				return newErrorCode("ERR", failed+"duplicate parameter")
+			}
+		}
+		if err := p.set(c, string(args[i+1])); err != nil {
+			return newErrorCode("ERR", failed+err.Error())
+		}
+		changed = append(changed, p)
+	}
+	srv.liveConfig.Store(c)
+	w, _ := srv.handler.(configWatcher)
+	for _, p := range changed {
+		if p.apply != nil {
+			p.apply(srv, c)
+		}
+		if w != nil {
+			w.configChanged(p.name, p.get(c))
+		}
+	}
+	return &StatusReply{Code: "OK"}
+}
+
+// rewriteConfig implements CONFIG REWRITE. The lines of the parameters
+// are updated in place, keeping the comments and the other lines, and
+// the parameters changed from their default are appended.
+func (srv *Server) rewriteConfig() error {
+	srv.configMu.Lock()
+	defer srv.configMu.Unlock()
+	c := srv.conf()
+	if c.file == "" {
+		return ErrNoConfigFile
+	}
+	data, err := ioutil.ReadFile(c.file)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	var lines []string
+	written := make(map[*configParam]bool)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Text()
+		args, err := splitConfigLine(line)
+		var p *configParam
+		if err == nil && len(args) > 0 {
+			p = lookupConfigParam(args[0])
+		}
+		switch {
+		case p == nil:
+			lines = append(lines, line)
+		case !written[p]:
+			lines = append(lines, p.line(c))
+			written[p] = true
+		}
+	}
+	def := DefaultConfig()
+	generated := false
+	for _, p := range configParams {
+		if written[p] || p.get(c) == p.get(def) {
+			continue
+		}
+		if !generated {
+			lines = append(lines, "# Generated by CONFIG REWRITE")
+			generated = true
+		}
+		lines = append(lines, p.line(c))
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(c.file), ".redis.conf")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString(strings.Join(lines, "\n") + "\n"); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if fi, err := os.Stat(c.file); err == nil {
+		os.Chmod(f.Name(), fi.Mode())
+	}
+	return os.Rename(f.Name(), c.file)
+}
+
+// config implements CONFIG GET|SET|RESETSTAT|REWRITE.
+func (srv *Server) config(r *Request) (ReplyWriter, error) {
+	if len(r.Args) == 0 {
+		return newErrorCode("ERR", "wrong number of arguments for 'config' command"), nil
+	}
+	sub := strings.ToLower(string(r.Args[0]))
+	args := r.Args[1:]
+	switch sub {
+	case "get":
+		if len(args) == 0 {
+			return newErrorCode("ERR", "wrong number of arguments for 'config|get' command"), nil
+		}
+		c := srv.conf()
+		var values []interface{}
+		for _, p := range configParams {
+			for _, pattern := range args {
+				if re := patternRE(strings.ToLower(string(pattern))); re != nil && re.MatchString(p.name) {
+					values = append(values, p.name, p.get(c))
+					break
+				}
+			}
+		}
+		return NewMapReply(values...), nil
+	case "set":
+		if len(args) == 0 || len(args)%2 != 0 {
+			return newErrorCode("ERR", "wrong number of arguments for 'config|set' command"), nil
+		}
+		return srv.configSet(args), nil
+	case "resetstat":
+		srv.resetStats()
+		return &StatusReply{Code: "OK"}, nil
+	case "rewrite":
+		if err := srv.rewriteConfig(); err != nil {
+			if reply, ok := err.(*ErrorReply); ok {
+				return reply, nil
+			}
+			return newErrorCode("ERR", "Rewriting config file: "+err.Error()), nil
+		}
+		return &StatusReply{Code: "OK"}, nil
+	case "help":
+		return &MultiBulkReply{values: []interface{}{
+			"CONFIG <subcommand> [<arg> [value] [opt] ...]. Subcommands are:",
+			"GET <pattern>",
+			"    Return parameters matching the glob-like <pattern> and their values.",
+			"SET <directive> <value>",
+			"    Set the configuration <directive> to <value>.",
+			"RESETSTAT",
+			"    Reset statistics reported by the INFO command.",
+			"REWRITE",
+			"    Rewrite the configuration file.",
+		}}, nil
+	}
+	return wrongSubcommand("config", sub), nil
+}
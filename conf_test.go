@@ -0,0 +1,162 @@
+package redis
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSplitConfigLine(t *testing.T) {
+	for _, v := range []struct {
+		line     string
+		expected []string
+		err      bool
+	}{
+		{"# comment", nil, false},
+		{"   ", nil, false},
+		{"bind 127.0.0.1  ::1", []string{"bind", "127.0.0.1", "::1"}, false},
+		{`requirepass "a b\n\x41\"c"`, []string{"requirepass", "a b\nA\"c"}, false},
+		{`requirepass 'it\'s'`, []string{"requirepass", "it's"}, false},
+		{`requirepass ""`, []string{"requirepass", ""}, false},
+		{`requirepass "open`, nil, true},
+		{`requirepass "a"b`, nil, true},
+	} {
+		args, err := splitConfigLine(v.line)
+		if (err != nil) != v.err || !reflect.DeepEqual(args, v.expected) {
+			t.Fatalf("%s: expected %q (error %v), got %q, %v", v.line, v.expected, v.err, args, err)
+		}
+		if len(args) == 2 {
+			if quoted, _ := splitConfigLine("x " + quoteConfigArg(args[1])); quoted[1] != args[1] {
+				t.Fatalf("%s: %q does not round trip", v.line, args[1])
+			}
+		}
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "redis.conf")
+	ioutil.WriteFile(path, []byte(`# Test configuration
+bind 127.0.0.1 ::1
+port 7000
+unixsocket /tmp/test.sock
+unixsocketperm 700
+timeout 30
+maxmemory 2mb
+notify-keyspace-events KEA
+requirepass "s3cr3t pass"
+`), 0644)
+	c, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.port != 7000 || c.unixSocketPerm != 0700 || c.timeout != 30*time.Second ||
+		c.maxMemory != 2<<20 || c.notifyKeyspaceEvents != "AKE" || c.requirePass != "s3cr3t pass" {
+		t.Fatalf("Unexpected configuration %+v", c)
+	}
+	expected := []bindAddr{
+		{proto: "tcp", addr: "127.0.0.1:7000"},
+		{proto: "tcp", addr: "[::1]:7000"},
+		{proto: "unix", addr: "/tmp/test.sock"},
+	}
+	if binds := c.listenAddrs(); !reflect.DeepEqual(binds, expected) {
+		t.Fatalf("Expected %v, got %v", expected, binds)
+	}
+
+	for _, v := range []struct{ conf, err string }{
+		{"nope 1", "redis.conf:1: Bad directive or wrong number of arguments"},
+		{"port 1 2", "redis.conf:1: Bad directive or wrong number of arguments"},
+		{"\nport x", "redis.conf:2: port: argument couldn't be parsed into an integer"},
+		{"maxmemory 1xb", "redis.conf:1: maxmemory: argument must be a memory value"},
+	} {
+		ioutil.WriteFile(path, []byte(v.conf), 0644)
+		if _, err := LoadConfig(path); err == nil || !strings.HasSuffix(err.Error(), v.err) {
+			t.Fatalf("%q: expected %q, got %v", v.conf, v.err, err)
+		}
+	}
+}
+
+func TestConfigCommand(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "redis.conf")
+	ioutil.WriteFile(path, []byte("# Keep me\nmaxclients 100\n"), 0644)
+	c, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, _ := startServer(t, c)
+
+	_, r := dial(t, srv,
+		"CONFIG GET max*",
+		"CONFIG SET maxclients 5 maxmemory 1kb",
+		"CONFIG GET maxclients maxmemory",
+		"CONFIG SET port 1",
+		"CONFIG SET nope 1",
+		"CONFIG SET maxclients x",
+		"CONFIG SET maxclients 6 maxclients 7",
+		"CONFIG GET maxclients",
+		"CONFIG SET notify-keyspace-events Kl",
+		"CONFIG REWRITE",
+	)
+	expectReply(t, r, []interface{}{"maxclients", "100", "maxmemory", "0"})
+	expectLine(t, r, "+OK")
+	expectReply(t, r, []interface{}{"maxclients", "5", "maxmemory", "1024"})
+	expectLine(t, r, "-ERR CONFIG SET failed (possibly related to argument 'port') - can't set immutable config")
+	expectLine(t, r, "-ERR Unknown option or number of arguments for CONFIG SET - 'nope'")
+	expectLine(t, r, "-ERR CONFIG SET failed (possibly related to argument 'maxclients') - argument couldn't be parsed into an integer")
+	expectLine(t, r, "-ERR CONFIG SET failed (possibly related to argument 'maxclients') - duplicate parameter")
+	expectReply(t, r, []interface{}{"maxclients", "5"})
+	expectLine(t, r, "+OK")
+	expectLine(t, r, "+OK")
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "# Keep me\nmaxclients 5\n# Generated by CONFIG REWRITE\nport 0\nmaxmemory 1024\nnotify-keyspace-events lK\n"
+	if string(data) != expected {
+		t.Fatalf("Expected %q, got %q", expected, data)
+	}
+
+	// Keyspace notifications are published as configured.
+	_, sub := dial(t, srv, "SUBSCRIBE __keyspace@0__:list")
+	expectReply(t, sub, []interface{}{"subscribe", "__keyspace@0__:list", int64(1)})
+	// Publishing does not wait for subscribers busy writing.
+	time.Sleep(20 * time.Millisecond)
+	_, r = dial(t, srv, "CONFIG SET maxmemory 0", "SET key v", "RPUSH list a")
+	expectLine(t, r, "+OK")
+	expectLine(t, r, "+OK")
+	expectLine(t, r, ":1")
+	expectReply(t, sub, []interface{}{"message", "__keyspace@0__:list", "rpush"})
+
+	// requirepass applies to the new clients.
+	_, r = dial(t, srv, "CONFIG SET requirepass secret")
+	expectLine(t, r, "+OK")
+	_, r = dial(t, srv, "GET key", "AUTH secret")
+	expectLine(t, r, "-NOAUTH Authentication required.")
+	expectLine(t, r, "+OK")
+}
+
+func TestMaxMemory(t *testing.T) {
+	srv, _ := startServer(t, DefaultConfig())
+
+	_, r := dial(t, srv,
+		"SET a 1",
+		"CONFIG SET maxmemory 1",
+		"SET b 2",
+		"RPUSH list x",
+		"GET a",
+		"DEL a",
+		"CONFIG SET maxmemory 0",
+		"SET b 2",
+	)
+	expectLine(t, r, "+OK")
+	expectLine(t, r, "+OK")
+	expectLine(t, r, "-OOM command not allowed when used memory > 'maxmemory'")
+	expectLine(t, r, "-OOM command not allowed when used memory > 'maxmemory'")
+	expectReply(t, r, "1")
+	expectReply(t, r, int64(1))
+	expectLine(t, r, "+OK")
+	expectLine(t, r, "+OK")
+}
@@ -1,21 +1,93 @@
 package redis
 
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
 type Config struct {
-	proto   string
-	host    string
-	port    int
-	handler interface{}
+	proto       string
+	host        string
+	port        int
+	handler     interface{}
+	maxBulkLen  int
+	maxArgs     int
+	tls         *tls.Config
+	authClients string
+	requirePass string
+
+	commandTimeout time.Duration
+
+	binds          []bindAddr
+	unixSocketPerm os.FileMode
+
+	// bindHosts, unixSocket and tlsPort are the bind, unixsocket and
+	// tls-port of redis.conf.
+	bindHosts     []string
+	unixSocket    string
+	tlsPort       int
+	tlsCertFile   string
+	tlsKeyFile    string
+	tlsCACertFile string
+
+	timeout              time.Duration
+	tcpKeepAlive         time.Duration
+	writeTimeout         time.Duration
+	outputLimits         [len(defaultOutputLimits)]outputLimit
+	maxClients           int
+	maxMemory            int64
+	notifyKeyspaceEvents string
+	databases            int
+
+	logger   Logger
+	logLevel LogLevel
+
+	metricsAddr string
+
+	slowlogSlowerThan time.Duration
+	slowlogMaxLen     int
+
+	// file is the redis.conf the configuration was loaded from.
+	file string
+}
+
+// bindAddr is an address the server listens on.
+type bindAddr struct {
+	proto string
+	addr  string
+	tls   bool
 }
 
 func DefaultConfig() *Config {
 	return &Config{
-		proto:   "tcp",
-		host:    "127.0.0.1",
-		port:    6389,
-		handler: NewDefaultHandler(),
+		proto:        "tcp",
+		host:         "127.0.0.1",
+		port:         6389,
+		maxBulkLen:   DefaultProtoMaxBulkLen,
+		maxArgs:      DefaultMaxArgs,
+		maxClients:   10000,
+		tcpKeepAlive: 300 * time.Second,
+		writeTimeout: 30 * time.Second,
+		outputLimits: defaultOutputLimits,
+		databases:    16,
+		logLevel:     defaultLogLevel,
+
+		slowlogSlowerThan: 10 * time.Millisecond,
+		slowlogMaxLen:     128,
 	}
 }
 
+func (c *Config) clone() *Config {
+	clone := *c
+	clone.binds = append([]bindAddr(nil), c.binds...)
+	clone.bindHosts = append([]string(nil), c.bindHosts...)
+	return &clone
+}
+
 func (c *Config) Port(p int) *Config {
 	c.port = p
 	return c
@@ -35,3 +107,224 @@ func (c *Config) Handler(h interface{}) *Config {
 	c.handler = h
 	return c
 }
+
+// ProtoMaxBulkLen limits the size of a single request argument, as redis'
+// proto-max-bulk-len.
+func (c *Config) ProtoMaxBulkLen(n int) *Config {
+	c.maxBulkLen = n
+	return c
+}
+
+// MaxArgs limits the number of arguments of a single request.
+func (c *Config) MaxArgs(n int) *Config {
+	c.maxArgs = n
+	return c
+}
+
+// TLS serves RESP over TLS with the given configuration, which must hold
+// the server certificate.
+func (c *Config) TLS(t *tls.Config) *Config {
+	c.tls = t
+	return c
+}
+
+// TLSAuthClients sets whether TLS clients must present a certificate
+// signed by t.ClientCAs, as redis' tls-auth-clients: "yes" requires one,
+// "optional" verifies it when given, and "no" does not ask for any.
+func (c *Config) TLSAuthClients(mode string) *Config {
+	c.authClients = mode
+	return c
+}
+
+// RequirePass sets the password of the default user, as redis'
+// requirepass. Clients must then AUTH before running other commands.
+func (c *Config) RequirePass(password string) *Config {
+	c.requirePass = password
+	return c
+}
+
+// Bind adds an address to listen on, "tcp" or "unix" as proto. The server
+// serves all of them with the same handler. Without Bind, it listens on
+// Proto, Host and Port only, over TLS when TLS is set.
+func (c *Config) Bind(proto, addr string) *Config {
+	c.binds = append(c.binds, bindAddr{proto: proto, addr: addr})
+	return c
+}
+
+// BindTLS adds an address to listen on over TLS, which must be configured
+// with TLS.
+func (c *Config) BindTLS(proto, addr string) *Config {
+	c.binds = append(c.binds, bindAddr{proto: proto, addr: addr, tls: true})
+	return c
+}
+
+// UnixSocketPerm sets the permissions of the unix sockets, as redis'
+// unixsocketperm.
+func (c *Config) UnixSocketPerm(perm os.FileMode) *Config {
+	c.unixSocketPerm = perm
+	return c
+}
+
+// listenAddrs returns the addresses to listen on. Without Bind, those of
+// redis.conf are used: port, then tls-port, on every bind address, and
+// unixsocket. Port 0 picks a free port, unless the server listens on a
+// TLS port or a unix socket, in which case it does not listen in plain
+// TCP, as redis.
+func (c *Config) listenAddrs() []bindAddr {
+	if len(c.binds) > 0 {
+		return c.binds
+	}
+	if c.proto == "unix" {
+		return []bindAddr{{proto: c.proto, addr: c.host, tls: c.tls != nil}}
+	}
+	hosts := c.bindHosts
+	if len(hosts) == 0 {
+		hosts = []string{c.host}
+	}
+	var binds []bindAddr
+	if c.port != 0 || (c.tlsPort == 0 && c.unixSocket == "") {
+		for _, host := range hosts {
+			binds = append(binds, bindAddr{proto: c.proto, addr: net.JoinHostPort(host, strconv.Itoa(c.port)), tls: c.tls != nil && c.tlsPort == 0})
+		}
+	}
+	if c.tlsPort != 0 {
+		for _, host := range hosts {
+			binds = append(binds, bindAddr{proto: "tcp", addr: net.JoinHostPort(host, strconv.Itoa(c.tlsPort)), tls: true})
+		}
+	}
+	if c.unixSocket != "" {
+		binds = append(binds, bindAddr{proto: "unix", addr: c.unixSocket})
+	}
+	return binds
+}
+
+// CommandTimeout sets how long a command may run before its context is
+// cancelled. Zero, the default, means no timeout.
+func (c *Config) CommandTimeout(d time.Duration) *Config {
+	c.commandTimeout = d
+	return c
+}
+
+// Timeout closes the connections of clients idle for d, as redis'
+// timeout. Zero, the default, keeps them open.
+func (c *Config) Timeout(d time.Duration) *Config {
+	c.timeout = d
+	return c
+}
+
+// TCPKeepAlive sends TCP keepalives to the clients every d, as redis'
+// tcp-keepalive. Zero disables them. It defaults to 300 seconds.
+func (c *Config) TCPKeepAlive(d time.Duration) *Config {
+	c.tcpKeepAlive = d
+	return c
+}
+
+// WriteTimeout closes the connections of clients not reading their
+// replies, once a write has been blocked for d. Zero disables it. It
+// defaults to 30 seconds.
+func (c *Config) WriteTimeout(d time.Duration) *Config {
+	c.writeTimeout = d
+	return c
+}
+
+// ClientOutputBufferLimit limits the pending output of the clients of
+// class, normal, pubsub or replica, as redis' client-output-buffer-limit:
+// clients are disconnected once it reaches hard bytes, or stays over soft
+// bytes for longer than softFor. Zero disables a limit. Subscribers are
+// limited to 32mb, or 8mb for a minute, by default.
+func (c *Config) ClientOutputBufferLimit(class string, hard, soft int64, softFor time.Duration) *Config {
+	for i, name := range outputClassNames {
+		if name == class {
+			c.outputLimits[i] = outputLimit{hard, soft, softFor}
+		}
+	}
+	return c
+}
+
+// MaxClients limits the number of connected clients, as redis'
+// maxclients.
+func (c *Config) MaxClients(n int) *Config {
+	c.maxClients = n
+	return c
+}
+
+// MaxMemory sets the memory limit in bytes, as redis' maxmemory: once the
+// heap of the process is over it, the commands which may use more memory,
+// like SET or RPUSH, are refused with an OOM error. Zero means no limit.
+func (c *Config) MaxMemory(bytes int64) *Config {
+	c.maxMemory = bytes
+	return c
+}
+
+// NotifyKeyspaceEvents selects the keyspace notifications published by
+// the handler, using the classes of redis' notify-keyspace-events.
+func (c *Config) NotifyKeyspaceEvents(classes string) *Config {
+	if flags, ok := parseKeyspaceEvents(classes); ok {
+		c.notifyKeyspaceEvents = formatKeyspaceEvents(flags)
+	}
+	return c
+}
+
+// Databases sets the number of databases, as redis' databases.
+func (c *Config) Databases(n int) *Config {
+	c.databases = n
+	return c
+}
+
+// Logger sets the logger of the server. Without one, nothing is logged
+// unless the DEBUG env is non empty.
+func (c *Config) Logger(l Logger) *Config {
+	c.logger = l
+	return c
+}
+
+// LogLevel sets the minimum level of the records logged, as redis'
+// loglevel. It defaults to notice, or debug when the DEBUG env is non
+// empty.
+func (c *Config) LogLevel(level LogLevel) *Config {
+	c.logLevel = level
+	return c
+}
+
+// MetricsAddr serves the metrics of the server in the Prometheus text
+// format over HTTP on addr, from Start.
+func (c *Config) MetricsAddr(addr string) *Config {
+	c.metricsAddr = addr
+	return c
+}
+
+// SlowlogLogSlowerThan logs the commands taking d or more in the slow
+// log, as redis' slowlog-log-slower-than. Zero logs every command and a
+// negative duration none. It defaults to 10ms.
+func (c *Config) SlowlogLogSlowerThan(d time.Duration) *Config {
+	c.slowlogSlowerThan = d
+	return c
+}
+
+// SlowlogMaxLen sets how many entries the slow log keeps, as redis'
+// slowlog-max-len. It defaults to 128.
+func (c *Config) SlowlogMaxLen(n int) *Config {
+	c.slowlogMaxLen = n
+	return c
+}
+
+// tlsConfig returns the TLS configuration of the listener, or nil when
+// TLS is off.
+func (c *Config) tlsConfig() (*tls.Config, error) {
+	if c.tls == nil {
+		return nil, nil
+	}
+	t := c.tls.Clone()
+	switch c.authClients {
+	case "":
+	case "yes":
+		t.ClientAuth = tls.RequireAndVerifyClientCert
+	case "optional":
+		t.ClientAuth = tls.VerifyClientCertIfGiven
+	case "no":
+		t.ClientAuth = tls.NoClientCert
+	default:
+		return nil, fmt.Errorf("invalid tls-auth-clients value %q", c.authClients)
+	}
+	return t, nil
+}
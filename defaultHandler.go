@@ -1,333 +1,424 @@
 package redis
 
 import (
-	"fmt"
-	"reflect"
+	"hash/fnv"
+	"sort"
 	"strconv"
-	"time"
+	"strings"
+	"sync"
+	"sync/atomic"
 )
 
 type (
-	HashValue      map[string][]byte
-	HashHash       map[string]HashValue
-	HashSub        map[string][]*ChannelWriter
-	HashBrStack    map[string]*Stack
-	HashTtl        map[string]time.Time
-	HashOrderedSet map[string]*OrderedSet
+	HashValue map[string][]byte
+	HashSub   map[string][]*ChannelWriter
 )
 
+// dbShards is the number of independently locked parts of a Database.
+// Commands only contend when their keys hash to the same shard.
+const dbShards = 64
+
+// shard holds the keys of a Database hashing to it.
+type shard struct {
+	sync.RWMutex
+	keys map[string]*object
+	// volatile holds the keys with an expiry, sampled by the active
+	// expire cycle.
+	volatile map[string]*object
+
+	// blocked queues the clients waiting for a push on a list.
+	blocked map[string][]*waiter
+}
+
+func newShard() *shard {
+	return &shard{
+		keys:     make(map[string]*object),
+		volatile: make(map[string]*object),
+		blocked:  make(map[string][]*waiter),
+	}
+}
+
+// flush empties the shard. The caller holds its write lock.
+func (s *shard) flush() {
+	s.keys = make(map[string]*object)
+	s.volatile = make(map[string]*object)
+}
+
 type Database struct {
-	values  HashValue
-	hvalues HashHash
-	brstack HashBrStack
-	ttl     HashTtl
+	shards [dbShards]*shard
 
-	orderedSet HashOrderedSet
+	// expired, if set, is called with the keys removed once expired,
+	// holding the lock of their shard.
+	expired func(key string)
+	// next is the shard the active expire cycle resumes from.
+	next int
 }
 
 func NewDatabase(parent *Database) *Database {
-	db := &Database{
-		values:  make(HashValue),
-		hvalues: make(HashHash),
-
-		brstack:    make(HashBrStack),
-		ttl:        make(HashTtl),
-		orderedSet: make(HashOrderedSet),
-	}
-
-	go func(db *Database) {
-		var lk chan bool
-		for {
-			now := time.Now()
-			lk <- true
-			for key, val := range db.ttl {
-				if now.Sub(val).Seconds() >= 0 {
-					if _, ok := db.values[key]; ok {
-						delete(db.values, key)
-					}
-					if _, ok := db.hvalues[key]; ok {
-						delete(db.hvalues, key)
-					}
-					if _, ok := db.brstack[key]; ok {
-						delete(db.brstack, key)
-					}
-					if _, ok := db.orderedSet[key]; ok {
-						delete(db.orderedSet, key)
-					}
-					delete(db.ttl, key)
+	db := &Database{}
+	for i := range db.shards {
+		db.shards[i] = newShard()
+	}
+	return db
+}
+
+func shardIndex(key string) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % dbShards)
+}
+
+// shard returns the part of the keyspace holding key.
+func (db *Database) shard(key string) *shard {
+	return db.shards[shardIndex(key)]
+}
+
+// lock takes the write lock of the shards holding keys and returns the
+// function releasing them. Shards are always locked in the same order,
+// so that commands on several keys cannot deadlock each other. Those of
+// keys which are expired are removed.
+func (db *Database) lock(keys ...string) (unlock func()) {
+	return db.lockShards(false, keys)
+}
+
+// rlock is lock for commands only reading keys. The expired keys they
+// found are removed once the read locks are released.
+func (db *Database) rlock(keys ...string) (unlock func()) {
+	return db.lockShards(true, keys)
+}
+
+func (db *Database) lockShards(read bool, keys []string) func() {
+	var locked []*shard
+	if len(keys) == 1 {
+		locked = []*shard{db.shard(keys[0])}
+	} else {
+		indexes := make([]int, 0, len(keys))
+		seen := make(map[int]bool, len(keys))
+		for _, key := range keys {
+			if i := shardIndex(key); !seen[i] {
+				seen[i] = true
+				indexes = append(indexes, i)
+			}
+		}
+		sort.Ints(indexes)
+		for _, i := range indexes {
+			locked = append(locked, db.shards[i])
+		}
+	}
+	for _, s := range locked {
+		if read {
+			s.RLock()
+		} else {
+			s.Lock()
+		}
+	}
+	if !read {
+		// Writers remove the expired keys they are about to touch.
+		now := mstime()
+		for _, key := range keys {
+			if db.shard(key).expireIfNeeded(key, now) && db.expired != nil {
+				db.expired(key)
+			}
+		}
+	}
+	return func() {
+		var expired []string
+		if read {
+			now := mstime()
+			for _, key := range keys {
+				if o, exists := db.shard(key).volatile[key]; exists && o.expired(now) {
+					expired = append(expired, key)
 				}
 			}
-			<-lk
-			time.Sleep(time.Second)
 		}
-	}(db)
+		for _, s := range locked {
+			if read {
+				s.RUnlock()
+			} else {
+				s.Unlock()
+			}
+		}
+		db.expireKeys(expired)
+	}
+}
 
-	return db
+// expireKeys removes those of keys which are expired, taking the write
+// lock of their shards.
+func (db *Database) expireKeys(keys []string) {
+	if len(keys) > 0 {
+		db.lock(keys...)()
+	}
 }
 
+// DefaultHandler is an in-memory redis keyspace. It is safe for concurrent
+// use: the database a command runs against is the one selected by the
+// client sending it, and only commands touching the same keys contend.
 type DefaultHandler struct {
-	*Database
-	CurrentDb int
-	dbs       map[int]*Database
-	sub       HashSub
+	// mu guards dbs.
+	mu  sync.RWMutex
+	dbs map[int]*Database
+
+	subMu sync.Mutex
+	sub   HashSub
+
+	// expireMu guards the active expire cycle, running while servers
+	// use the handler.
+	expireMu    sync.Mutex
+	expireUsers int
+	expireStop  chan struct{}
+
+	// databases and events hold databases and the notify-keyspace-events
+	// classes of the server configuration.
+	databases int32
+	events    int32
 }
 
-func (h *DefaultHandler) Rpush(key string, values ...[]byte) (int, error) {
-	h.Database = h.dbs[h.CurrentDb]
+var ErrDBIndex = newErrorCode("ERR", "DB index is out of range")
 
-	if _, exists := h.brstack[key]; !exists {
-		h.brstack[key] = NewStack(key)
+// configChanged applies databases and notify-keyspace-events.
+func (h *DefaultHandler) configChanged(name, value string) {
+	switch name {
+	case "databases":
+		n, _ := strconv.Atoi(value)
+		atomic.StoreInt32(&h.databases, int32(n))
+	case "notify-keyspace-events":
+		flags, _ := parseKeyspaceEvents(value)
+		atomic.StoreInt32(&h.events, int32(flags))
 	}
-	h.brstack[key].PushBackLite(values...)
-
-	return h.brstack[key].Len(), nil
 }
 
-func (h *DefaultHandler) Brpop(key string, keys ...string) (data [][]byte, err error) {
-	keys = append([]string{key}, keys...)
-	h.Database = h.dbs[h.CurrentDb]
-
-	if len(keys) == 0 {
-		return nil, ErrParseTimeout
+// notify publishes the keyspace notification of event on key, if its
+// class is selected by notify-keyspace-events.
+func (h *DefaultHandler) notify(r *Request, class int, event, key string) {
+	flags := int(atomic.LoadInt32(&h.events))
+	if flags&class == 0 {
+		return
 	}
-
-	timeout, err := strconv.Atoi(keys[len(keys)-1])
-	if err != nil {
-		return nil, ErrParseTimeout
+	db := strconv.Itoa(r.DB)
+	if flags&notifyKeyspace != 0 {
+		h.Publish("__keyspace@"+db+"__:"+key, []byte(event))
+	}
+	if flags&notifyKeyevent != 0 {
+		h.Publish("__keyevent@"+db+"__:"+event, []byte(key))
 	}
-	keys = keys[:len(keys)-1]
+}
 
-	var timeoutChan <-chan time.Time
-	if timeout > 0 {
-		timeoutChan = time.After(time.Duration(timeout) * time.Second)
-	} else {
-		timeoutChan = make(chan time.Time)
+// db returns the database selected by the client sending r.
+func (h *DefaultHandler) db(r *Request) *Database {
+	h.mu.RLock()
+	db, exists := h.dbs[r.DB]
+	h.mu.RUnlock()
+	if exists {
+		return db
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if db, exists = h.dbs[r.DB]; !exists {
+		db = h.newDatabase(r.DB)
+		h.dbs[r.DB] = db
 	}
+	return db
+}
 
-	finishedChan := make(chan struct{})
-	go func() {
-		defer close(finishedChan)
-		selectCases := []reflect.SelectCase{}
-		for _, k := range keys {
-			key := string(k)
-			if _, exists := h.brstack[key]; !exists {
-				h.brstack[key] = NewStack(k)
-			}
-			selectCases = append(selectCases, reflect.SelectCase{
-				Dir:  reflect.SelectRecv,
-				Chan: reflect.ValueOf(h.brstack[key].Chan),
-			})
-		}
-		_, recv, _ := reflect.Select(selectCases)
-		s, ok := recv.Interface().(*Stack)
-		if !ok {
-			err = fmt.Errorf("Impossible to retrieve data. Wrong type.")
-			return
-		}
-		data = [][]byte{[]byte(s.Key), s.PopBack()}
-	}()
+func (h *DefaultHandler) Rpush(r *Request, key string, values ...[]byte) (int, error) {
+	db := h.db(r)
+	defer db.lock(key)()
 
-	select {
-	case <-finishedChan:
-		return data, err
-	case <-timeoutChan:
-		return nil, nil
+	s := db.shard(key)
+	list, err := s.list(key, true)
+	if err != nil {
+		return 0, err
 	}
-	return nil, nil
+	list.PushBackLite(values...)
+	n := list.Len()
+	h.notify(r, notifyList, "rpush", key)
+	s.serveBlocked(key)
+
+	return n, nil
+}
+
+// Brpop pops the tail of the first non-empty list, blocking until one of
+// the keys is pushed to if they are all empty.
+func (h *DefaultHandler) Brpop(r *Request, key string, keys ...string) (interface{}, error) {
+	return h.bpop(r, false, append([]string{key}, keys...))
 }
 
-func (h *DefaultHandler) Lrange(key string, start, stop int) ([][]byte, error) {
-	h.Database = h.dbs[h.CurrentDb]
-	if _, exists := h.brstack[key]; !exists {
-		h.brstack[key] = NewStack(key)
+func (h *DefaultHandler) Lrange(r *Request, key string, start, stop int) ([][]byte, error) {
+	db := h.db(r)
+	defer db.rlock(key)()
+	s, err := db.shard(key).list(key, false)
+	if s == nil {
+		return nil, err
 	}
 
 	if start < 0 {
-		if start = h.brstack[key].Len() + start; start < 0 {
+		if start = s.Len() + start; start < 0 {
 			start = 0
 		}
 	}
 
 	if stop < 0 {
-		if stop = h.brstack[key].Len() + stop; stop < 0 {
+		if stop = s.Len() + stop; stop < 0 {
 			stop = 0
 		}
 	}
 
 	var ret [][]byte
 	for i := start; i <= stop; i++ {
-		if val := h.brstack[key].GetIndex(i); val != nil {
+		if val := s.GetIndex(i); val != nil {
 			ret = append(ret, val)
 		}
 	}
 	return ret, nil
 }
 
-func (h *DefaultHandler) Lindex(key string, index int) ([]byte, error) {
-	h.Database = h.dbs[h.CurrentDb]
-	if _, exists := h.brstack[key]; !exists {
-		h.brstack[key] = NewStack(key)
+func (h *DefaultHandler) Lindex(r *Request, key string, index int) ([]byte, error) {
+	db := h.db(r)
+	defer db.rlock(key)()
+	s, err := db.shard(key).list(key, false)
+	if s == nil {
+		return nil, err
 	}
-	return h.brstack[key].GetIndex(index), nil
+	return s.GetIndex(index), nil
 }
 
-func (h *DefaultHandler) Lpush(key string, value []byte, values ...[]byte) (int, error) {
+func (h *DefaultHandler) Lpush(r *Request, key string, value []byte, values ...[]byte) (int, error) {
 	values = append([][]byte{value}, values...)
-	h.Database = h.dbs[h.CurrentDb]
-	if _, exists := h.brstack[key]; !exists {
-		h.brstack[key] = NewStack(key)
+	db := h.db(r)
+	defer db.lock(key)()
+	s := db.shard(key)
+	list, err := s.list(key, true)
+	if err != nil {
+		return 0, err
 	}
 	for _, value := range values {
-		h.brstack[key].PushFront(value)
+		list.PushFront(value)
 	}
-	return h.brstack[key].Len(), nil
+	n := list.Len()
+	h.notify(r, notifyList, "lpush", key)
+	s.serveBlocked(key)
+	return n, nil
 }
 
-func (h *DefaultHandler) Blpop(key string, keys ...string) (data [][]byte, err error) {
-	keys = append([]string{key}, keys...)
-	h.Database = h.dbs[h.CurrentDb]
-
-	if len(keys) == 0 {
-		return nil, ErrParseTimeout
-	}
-
-	timeout, err := strconv.Atoi(keys[len(keys)-1])
-	if err != nil {
-		return nil, ErrParseTimeout
-	}
-	keys = keys[:len(keys)-1]
-
-	var timeoutChan <-chan time.Time
-	if timeout > 0 {
-		timeoutChan = time.After(time.Duration(timeout) * time.Second)
-	} else {
-		timeoutChan = make(chan time.Time)
-	}
-
-	finishedChan := make(chan struct{})
+// Blpop is Brpop popping the head of the lists.
+func (h *DefaultHandler) Blpop(r *Request, key string, keys ...string) (interface{}, error) {
+	return h.bpop(r, true, append([]string{key}, keys...))
+}
 
-	go func() {
-		defer close(finishedChan)
-		selectCases := []reflect.SelectCase{}
-		for _, k := range keys {
-			key := string(k)
-			if _, exists := h.brstack[key]; !exists {
-				h.brstack[key] = NewStack(k)
-			}
-			selectCases = append(selectCases, reflect.SelectCase{
-				Dir:  reflect.SelectRecv,
-				Chan: reflect.ValueOf(h.brstack[key].Chan),
-			})
-		}
-		_, recv, _ := reflect.Select(selectCases)
-		s, ok := recv.Interface().(*Stack)
-		if !ok {
-			err = fmt.Errorf("Impossible to retrieve data. Wrong type.")
-			return
-		}
-		data = [][]byte{[]byte(s.Key), s.PopFront()}
-	}()
+func (h *DefaultHandler) Hget(r *Request, key, subkey string) ([]byte, error) {
+	db := h.db(r)
+	defer db.rlock(key)()
 
-	select {
-	case <-finishedChan:
-		return data, err
-	case <-timeoutChan:
-		return nil, nil
-	}
-	return nil, nil
+	v, err := db.shard(key).hash(key, false)
+	return v[subkey], err
 }
 
-func (h *DefaultHandler) Hget(key, subkey string) ([]byte, error) {
-	h.Database = h.dbs[h.CurrentDb]
-	if h.hvalues == nil {
-		return nil, nil
+// Hset sets the field and value pairs in the hash at key, and returns the
+// number of fields added.
+func (h *DefaultHandler) Hset(r *Request, key, subkey string, value []byte, pairs ...[]byte) (int, error) {
+	if len(pairs)%2 != 0 {
+		return 0, errWrongArity("hset")
 	}
-
-	if v, exists := h.hvalues[key]; exists {
-		if v, exists := v[subkey]; exists {
-			return v, nil
+	pairs = append([][]byte{[]byte(subkey), value}, pairs...)
+	db := h.db(r)
+	defer db.lock(key)()
+	v, err := db.shard(key).hash(key, true)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for ; len(pairs) > 0; pairs = pairs[2:] {
+		subkey := string(pairs[0])
+		if _, exists := v[subkey]; !exists {
+			n++
 		}
+		v[subkey] = pairs[1]
 	}
-	return nil, nil
+	h.notify(r, notifyHash, "hset", key)
+	return n, nil
 }
 
-func (h *DefaultHandler) Hset(key, subkey string, value []byte) (int, error) {
-	ret := 0
+func (h *DefaultHandler) Hgetall(r *Request, key string) (HashValue, error) {
+	db := h.db(r)
+	defer db.rlock(key)()
 
-	h.Database = h.dbs[h.CurrentDb]
-	if h.hvalues == nil {
-		h.hvalues = make(HashHash)
+	v, err := db.shard(key).hash(key, false)
+	if v == nil {
+		return nil, err
 	}
-	if _, exists := h.hvalues[key]; !exists {
-		h.hvalues[key] = make(HashValue)
-		ret = 1
-	}
-
-	if _, exists := h.hvalues[key][subkey]; !exists {
-		ret = 1
+	// The reply is written once the lock is released.
+	ret := make(HashValue, len(v))
+	for subkey, value := range v {
+		ret[subkey] = value
 	}
-
-	h.hvalues[key][subkey] = value
-
 	return ret, nil
 }
 
-func (h *DefaultHandler) Hgetall(key string) (HashValue, error) {
-	h.Database = h.dbs[h.CurrentDb]
-	if h.hvalues == nil {
-		return nil, nil
-	}
-	return h.hvalues[key], nil
+func (h *DefaultHandler) Get(r *Request, key string) ([]byte, error) {
+	db := h.db(r)
+	defer db.rlock(key)()
+	return db.shard(key).str(key)
 }
 
-func (h *DefaultHandler) Get(key string) ([]byte, error) {
-	h.Database = h.dbs[h.CurrentDb]
-	if h.values == nil {
-		return nil, nil
-	}
-	return h.values[key], nil
-}
-func (h *DefaultHandler) Set(key string, args ...[]byte) error {
-	h.Database = h.dbs[h.CurrentDb]
-	h.values[key] = args[0]
-
-	if len(args) > 1 {
-
-		switch string(args[1]) {
-		case "ex":
-			expire, err := strconv.Atoi(string(args[2]))
+// Set stores a string at key, with the EX, PX, EXAT or PXAT expiry or,
+// with KEEPTTL, the one the key had. Any other expiry is cleared.
+func (h *DefaultHandler) Set(r *Request, key string, args ...[]byte) error {
+	var at int64
+	keepTTL := false
+	for i := 1; i < len(args); i++ {
+		option := strings.ToLower(string(args[i]))
+		switch option {
+		case "keepttl":
+			if at != 0 {
+				return ErrSyntax
+			}
+			keepTTL = true
+		case "ex", "px", "exat", "pxat":
+			if at != 0 || keepTTL || i+1 == len(args) {
+				return ErrSyntax
+			}
+			i++
+			n, err := strconv.ParseInt(string(args[i]), 10, 64)
 			if err != nil {
-				break
+				return ErrNotInteger
 			}
-			ttl := time.Duration(expire) * time.Second
-			if ttl >= 0 {
-				h.ttl[key] = time.Now().Add(ttl)
+			unit := int64(1)
+			if option[0] == 'e' {
+				unit = 1000
 			}
+			var ok bool
+			if at, ok = expireTime(n, unit, strings.HasSuffix(option, "at")); n <= 0 || !ok {
+				return errInvalidExpire(r.Name)
+			}
+		default:
+			return ErrSyntax
 		}
 	}
 
+	db := h.db(r)
+	defer db.lock(key)()
+	s := db.shard(key)
+	if o := s.lookup(key); keepTTL && o != nil {
+		at = o.expireAt
+	}
+	o := s.set(key, args[0])
+	if at != 0 {
+		s.expire(key, o, at)
+	}
+	h.notify(r, notifyString, "set", key)
+
 	return nil
 }
 
-func (h *DefaultHandler) Del(keys ...string) (int, error) {
-	h.Database = h.dbs[h.CurrentDb]
+func (h *DefaultHandler) Del(r *Request, keys ...string) (int, error) {
+	db := h.db(r)
+	defer db.lock(keys...)()
 	count := 0
 	for _, k := range keys {
-		if _, exists := h.values[k]; exists {
-			delete(h.values, k)
-			count++
-		}
-		if _, exists := h.hvalues[k]; exists {
-			delete(h.hvalues, k)
-			count++
-		}
-
-		if _, exists := h.brstack[k]; exists {
-			delete(h.brstack, k)
-			count++
-		}
-		if _, exists := h.orderedSet[k]; exists {
-			delete(h.orderedSet, k)
+		s := db.shard(k)
+		if s.lookup(k) != nil {
+			s.del(k)
+			h.notify(r, notifyGeneric, "del", k)
 			count++
 		}
 	}
@@ -338,17 +429,18 @@ func (h *DefaultHandler) Ping() (*StatusReply, error) {
 	return &StatusReply{Code: "PONG"}, nil
 }
 
-func (h *DefaultHandler) Subscribe(channels ...[]byte) (*MultiChannelWriter, error) {
+func (h *DefaultHandler) Subscribe(r *Request, channels ...[]byte) (*MultiChannelWriter, error) {
+	h.subMu.Lock()
+	defer h.subMu.Unlock()
 	ret := &MultiChannelWriter{Chans: make([]*ChannelWriter, 0, len(channels))}
 	for _, key := range channels {
-		Debugf("SUBSCRIBE on %s\n", key)
+		r.Logger().Log(LevelDebug, "Subscribed", Field{"channel", string(key)})
 		cw := &ChannelWriter{
 			FirstReply: []interface{}{
 				"subscribe",
 				key,
 				1,
 			},
-			Channel: make(chan []interface{}),
 		}
 		if h.sub[string(key)] == nil {
 			h.sub[string(key)] = []*ChannelWriter{cw}
@@ -361,39 +453,47 @@ func (h *DefaultHandler) Subscribe(channels ...[]byte) (*MultiChannelWriter, err
 }
 
 func (h *DefaultHandler) Publish(key string, value []byte) (int, error) {
-	//	Debugf("Publishing %s on %s\n", value, key)
+	h.subMu.Lock()
+	defer h.subMu.Unlock()
 	v, exists := h.sub[key]
 	if !exists {
 		return 0, nil
 	}
 	i := 0
+	subscribers := v[:0]
 	for _, c := range v {
-		select {
-		case <-c.clientChan:
-			delete(h.sub, key)
-		case c.Channel <- []interface{}{
-			"message",
-			key,
-			value,
-		}:
+		if c.closed() {
+			continue
+		}
+		subscribers = append(subscribers, c)
+		if c.Deliver("message", key, value) {
 			i++
-		default:
 		}
 	}
+	if len(subscribers) == 0 {
+		delete(h.sub, key)
+	} else {
+		h.sub[key] = subscribers
+	}
 	return i, nil
 }
 
-func (h *DefaultHandler) Select(key string) error {
+// Select switches the database of the client sending r.
+func (h *DefaultHandler) Select(r *Request, key string) error {
 	index, err := strconv.Atoi(key)
 	if err != nil {
 		return err
 	}
+	if n := atomic.LoadInt32(&h.databases); index < 0 || (n > 0 && index >= int(n)) {
+		return ErrDBIndex
+	}
+	h.mu.Lock()
 	if _, exists := h.dbs[index]; !exists {
-		fmt.Println("DB not exits, create ", index)
-		h.dbs[index] = NewDatabase(nil)
+		r.Logger().Log(LevelDebug, "Created database", Field{"index", index})
+		h.dbs[index] = h.newDatabase(index)
 	}
-	h.Database = h.dbs[index]
-	h.CurrentDb = index
+	h.mu.Unlock()
+	r.DB = index
 	return nil
 }
 
@@ -401,140 +501,186 @@ func (h *DefaultHandler) Monitor() (*MonitorReply, error) {
 	return &MonitorReply{}, nil
 }
 
-var lock = make(chan bool, 1)
-
-func (h *DefaultHandler) Incr(key string) (int, error) {
-	h.Database = h.dbs[h.CurrentDb]
-	lock <- true
+func (h *DefaultHandler) Incr(r *Request, key string) (int, error) {
+	db := h.db(r)
+	defer db.lock(key)()
+	s := db.shard(key)
+	o, err := s.get(key, typeString)
+	if err != nil {
+		return 0, err
+	}
+	if o == nil {
+		o = s.set(key, nil)
+	}
 
-	temp, _ := strconv.Atoi(string(h.values[key]))
+	temp, _ := strconv.Atoi(string(o.value.([]byte)))
 	temp = temp + 1
-	h.values[key] = []byte(strconv.Itoa(temp))
-
-	<-lock
+	o.value = []byte(strconv.Itoa(temp))
+	h.notify(r, notifyString, "incrby", key)
 
 	return temp, nil
 }
 
-func (h *DefaultHandler) Decr(key string) (int, error) {
-	h.Database = h.dbs[h.CurrentDb]
-	lock <- true
+func (h *DefaultHandler) Decr(r *Request, key string) (int, error) {
+	db := h.db(r)
+	defer db.lock(key)()
+	s := db.shard(key)
+	o, err := s.get(key, typeString)
+	if err != nil {
+		return 0, err
+	}
+	if o == nil {
+		o = s.set(key, nil)
+	}
 
-	temp, _ := strconv.Atoi(string(h.values[key]))
+	temp, _ := strconv.Atoi(string(o.value.([]byte)))
 	temp = temp - 1
-	h.values[key] = []byte(strconv.Itoa(temp))
-
-	<-lock
+	o.value = []byte(strconv.Itoa(temp))
+	h.notify(r, notifyString, "decrby", key)
 
 	return temp, nil
 }
 
-func (h *DefaultHandler) Expire(key, value string) (int, error) {
-	h.Database = h.dbs[h.CurrentDb]
-	i, err := strconv.Atoi(value)
-	if err != nil {
-		return 0, err
-	}
-	h.ttl[key] = time.Now().Add(time.Second * time.Duration(i))
-
-	return 1, nil
+func (h *DefaultHandler) Expire(r *Request, key, seconds string, options ...string) (int, error) {
+	return h.expire(r, key, seconds, 1000, false, options)
 }
 
-func (h *DefaultHandler) Exists(keys ...string) (int, error) {
-	h.Database = h.dbs[h.CurrentDb]
+func (h *DefaultHandler) Exists(r *Request, keys ...string) (int, error) {
+	db := h.db(r)
+	defer db.rlock(keys...)()
 	c := int(0)
 	for _, key := range keys {
-		if _, exists := h.values[key]; exists {
-			c++
-		}
-		if _, exists := h.hvalues[key]; exists {
-			c++
-		}
-		if _, exists := h.brstack[key]; exists {
-			c++
-		}
-		if _, exists := h.orderedSet[key]; exists {
+		if db.shard(key).lookup(key) != nil {
 			c++
 		}
 	}
 	return c, nil
 }
 
-func (h *DefaultHandler) Zadd(key string, score int, value []byte, values ...[]byte) (int, error) {
-	values = append([][]byte{value}, values...)
-
-	h.Database = h.dbs[h.CurrentDb]
+// Zadd adds the score and member pairs to the sorted set at key, and
+// returns the number of members added.
+func (h *DefaultHandler) Zadd(r *Request, key string, score int, value []byte, pairs ...[]byte) (int, error) {
+	if len(pairs)%2 != 0 {
+		return 0, ErrSyntax
+	}
+	scores := []int{score}
+	values := [][]byte{value}
+	for ; len(pairs) > 0; pairs = pairs[2:] {
+		score, err := strconv.Atoi(string(pairs[0]))
+		if err != nil {
+			return 0, ErrExpectInteger
+		}
+		scores = append(scores, score)
+		values = append(values, pairs[1])
+	}
 
-	if _, exists := h.orderedSet[key]; !exists {
-		h.orderedSet[key] = NewOrderedSet()
+	db := h.db(r)
+	defer db.lock(key)()
+	set, err := db.shard(key).zset(key, true)
+	if err != nil {
+		return 0, err
 	}
 
 	ctr := 0
-	for _, v := range values {
-		ctr = ctr + h.orderedSet[key].Add(score, v)
+	for i, v := range values {
+		ctr = ctr + set.Add(scores[i], v)
 	}
+	h.notify(r, notifyZset, "zadd", key)
 
 	return ctr, nil
 }
 
-func (h *DefaultHandler) Zrange(key string, min int, max int) ([][]byte, error) {
-	h.Database = h.dbs[h.CurrentDb]
+func (h *DefaultHandler) Zrange(r *Request, key string, min int, max int) ([][]byte, error) {
+	db := h.db(r)
+	defer db.rlock(key)()
 
-	if _, exists := h.orderedSet[key]; !exists {
+	set, err := db.shard(key).zset(key, false)
+	if set == nil {
+		if err != nil {
+			return nil, err
+		}
 		return [][]byte{}, nil
 	}
 
-	r := h.orderedSet[key].Range(min, max)
-
-	return r, nil
+	return set.Range(min, max), nil
 }
 
-func (h *DefaultHandler) Zrangebyscore(key string, min int, max int) ([][]byte, error) {
-	h.Database = h.dbs[h.CurrentDb]
+func (h *DefaultHandler) Zrangebyscore(r *Request, key string, min int, max int) ([][]byte, error) {
+	db := h.db(r)
+	defer db.rlock(key)()
 
-	if _, exists := h.orderedSet[key]; !exists {
+	set, err := db.shard(key).zset(key, false)
+	if set == nil {
+		if err != nil {
+			return nil, err
+		}
 		return [][]byte{}, nil
 	}
 
-	r := h.orderedSet[key].RangeByScore(min, max)
-
-	return r, nil
+	return set.RangeByScore(min, max), nil
 }
 
-func (h *DefaultHandler) Zrem(key string, value []byte, values ...[]byte) (int, error) {
+func (h *DefaultHandler) Zrem(r *Request, key string, value []byte, values ...[]byte) (int, error) {
 	values = append([][]byte{value}, values...)
 
-	h.Database = h.dbs[h.CurrentDb]
+	db := h.db(r)
+	defer db.lock(key)()
 
-	if _, exists := h.orderedSet[key]; !exists {
-		return 0, nil
+	s := db.shard(key)
+	set, err := s.zset(key, false)
+	if set == nil {
+		return 0, err
 	}
+	// An empty sorted set is removed, as redis does.
+	defer func() {
+		if len(set.elements) == 0 {
+			s.del(key)
+		}
+	}()
 
 	ctr := 0
 	for _, v := range values {
-		ctr += h.orderedSet[key].Rem(v)
+		ctr += set.Rem(v)
+	}
+	if ctr > 0 {
+		h.notify(r, notifyZset, "zrem", key)
 	}
 
 	return ctr, nil
 }
 
-func (h *DefaultHandler) Zremrangebyscore(key string, min int, max int) (int, error) {
-	h.Database = h.dbs[h.CurrentDb]
+func (h *DefaultHandler) Zremrangebyscore(r *Request, key string, min int, max int) (int, error) {
+	db := h.db(r)
+	defer db.lock(key)()
 
-	if _, exists := h.orderedSet[key]; !exists {
-		return 0, nil
+	s := db.shard(key)
+	set, err := s.zset(key, false)
+	if set == nil {
+		return 0, err
 	}
+	// An empty sorted set is removed, as redis does.
+	defer func() {
+		if len(set.elements) == 0 {
+			s.del(key)
+		}
+	}()
 
-	return h.orderedSet[key].RemRangeByScore(min, max), nil
+	n := set.RemRangeByScore(min, max)
+	if n > 0 {
+		h.notify(r, notifyZset, "zremrangebyscore", key)
+	}
+	return n, nil
 }
 
+// redisCommands marks the methods of DefaultHandler as taking the
+// arguments of the redis commands.
+func (h *DefaultHandler) redisCommands() {}
+
 func NewDefaultHandler() *DefaultHandler {
-	db := NewDatabase(nil)
 	ret := &DefaultHandler{
-		Database:  db,
-		CurrentDb: 0,
-		dbs:       map[int]*Database{0: db},
-		sub:       make(HashSub),
+		dbs: make(map[int]*Database),
+		sub: make(HashSub),
 	}
+	ret.dbs[0] = ret.newDatabase(0)
 	return ret
 }
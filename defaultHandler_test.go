@@ -0,0 +1,197 @@
+package redis
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestSelectPerClient(t *testing.T) {
+	srv, _ := startServer(t, DefaultConfig())
+
+	_, first := dial(t, srv, "SELECT 1", "SET key one", "GET key")
+	expectLine(t, first, "+OK")
+	expectLine(t, first, "+OK")
+	expectLine(t, first, "$3")
+	expectLine(t, first, "one")
+
+	// The database selected by the first client is not the one of others.
+	_, second := dial(t, srv, "GET key", "SET key zero", "SELECT 1", "GET key")
+	expectLine(t, second, "$-1")
+	expectLine(t, second, "+OK")
+	expectLine(t, second, "+OK")
+	expectLine(t, second, "$3")
+	expectLine(t, second, "one")
+}
+
+func TestBlockedClientDoesNotStall(t *testing.T) {
+	srv, _ := startServer(t, DefaultConfig())
+
+	_, blocked := dial(t, srv, "BRPOP list 0")
+	// Other clients are served while the first one is blocked.
+	_, r := dial(t, srv, "PING")
+	expectLine(t, r, "+PONG")
+
+	_, other := dial(t, srv, "SET key value", "GET key", "LPUSH list x")
+	expectLine(t, other, "+OK")
+	expectLine(t, other, "$5")
+	expectLine(t, other, "value")
+	expectLine(t, other, ":1")
+
+	expectLine(t, blocked, "*2")
+	expectLine(t, blocked, "$4")
+	expectLine(t, blocked, "list")
+	expectLine(t, blocked, "$1")
+	expectLine(t, blocked, "x")
+}
+
+func TestConcurrentIncr(t *testing.T) {
+	srv, err := NewServer(DefaultConfig().Port(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				srv.Apply(&Request{Name: "incr", Args: [][]byte{[]byte("counter")}})
+				srv.Apply(&Request{Name: "mset", Args: [][]byte{[]byte("a"), []byte("1"), []byte("b"), []byte("2")}})
+				srv.Apply(&Request{Name: "rename", Args: [][]byte{[]byte("b"), []byte("a")}})
+			}
+		}()
+	}
+	wg.Wait()
+
+	reply, err := srv.ApplyString(&Request{Name: "get", Args: [][]byte{[]byte("counter")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "$3\r\n800\r\n"; reply != expected {
+		t.Fatalf("Expected %q, got %q", expected, reply)
+	}
+}
+
+// BenchmarkApplyParallel runs SET and GET on distinct keys from every
+// goroutine. Run it with -cpu 1,2,4,8 to see it scale with GOMAXPROCS.
+func BenchmarkApplyParallel(b *testing.B) {
+	srv, err := NewServer(DefaultConfig().Port(0))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer srv.Close()
+
+	var id int64
+	var mu sync.Mutex
+	value := []byte("value")
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		mu.Lock()
+		id++
+		prefix := "key:" + strconv.FormatInt(id, 10) + ":"
+		mu.Unlock()
+		for i := 0; pb.Next(); i++ {
+			key := []byte(prefix + strconv.Itoa(i%1024))
+			srv.Apply(&Request{Name: "set", Args: [][]byte{key, value}})
+			srv.Apply(&Request{Name: "get", Args: [][]byte{key}})
+		}
+	})
+}
+
+func TestWrongType(t *testing.T) {
+	srv, _ := startServer(t, DefaultConfig())
+
+	_, r := dial(t, srv,
+		"SET key value",
+		"LPUSH key x",
+		"HSET key field x",
+		"ZADD key 1 x",
+		"HGET key field",
+		"LRANGE key 0 -1",
+		"BLPOP key 0",
+		"RPUSH list x",
+		"GET list",
+		"MGET key list",
+		"TYPE key",
+		"TYPE list",
+		"EXISTS key list nosuch",
+		"RENAME list key",
+		"TYPE key",
+		"DEL key list",
+	)
+	wrongType := "-WRONGTYPE Operation against a key holding the wrong kind of value"
+	expectReply(t, r, "OK")
+	for i := 0; i < 6; i++ {
+		expectLine(t, r, wrongType)
+	}
+	expectReply(t, r, int64(1))
+	expectLine(t, r, wrongType)
+	expectReply(t, r, []interface{}{"value", nil})
+	expectReply(t, r, "string")
+	expectReply(t, r, "list")
+	expectReply(t, r, int64(2))
+	expectReply(t, r, "OK")
+	expectReply(t, r, "list")
+	expectReply(t, r, int64(1))
+}
+
+func TestHsetPairs(t *testing.T) {
+	srv, _ := startServer(t, DefaultConfig())
+
+	_, r := dial(t, srv,
+		"HSET h f1 v1 f2 v2",
+		"HSET h f2 x f3 v3",
+		"HSET h f4 v4 f5",
+		"HLEN h",
+		"HGET h f2",
+	)
+	expectReply(t, r, int64(2))
+	expectReply(t, r, int64(1))
+	expectLine(t, r, "-ERR wrong number of arguments for 'hset' command")
+	expectReply(t, r, int64(3))
+	expectReply(t, r, "x")
+}
+
+func TestMsetArity(t *testing.T) {
+	srv, _ := startServer(t, DefaultConfig())
+
+	_, r := dial(t, srv, "MSET a 1 b", "MGET a b")
+	expectLine(t, r, "-ERR wrong number of arguments for 'mset' command")
+	expectReply(t, r, []interface{}{nil, nil})
+}
+
+func TestHmsetArity(t *testing.T) {
+	srv, _ := startServer(t, DefaultConfig())
+
+	_, r := dial(t, srv, "HMSET h f1 v1 f2", "EXISTS h")
+	expectLine(t, r, "-ERR wrong number of arguments for 'hmset' command")
+	expectReply(t, r, int64(0))
+
+	// HMSET checks its arguments even without the arity of the command table.
+	err := NewDefaultHandler().HMSet(&Request{}, []byte("h"), []byte("f"))
+	if err == nil || err.Error() != errWrongArity("hmset").Error() {
+		t.Fatalf("Expected a wrong number of arguments error, got %v", err)
+	}
+}
+
+func TestZaddPairs(t *testing.T) {
+	srv, _ := startServer(t, DefaultConfig())
+
+	_, r := dial(t, srv,
+		"ZADD z 2 b 1 a 3 c",
+		"ZADD z 4 d 5",
+		"ZADD z 4 d x e",
+		"ZCARD z",
+		"ZRANGE z 0 -1",
+		"ZSCORE z a",
+	)
+	expectReply(t, r, int64(3))
+	expectLine(t, r, "-ERR syntax error")
+	expectLine(t, r, "-ERROR Expected integer")
+	expectReply(t, r, int64(3))
+	expectReply(t, r, []interface{}{"a", "b", "c"})
+	expectReply(t, r, "1")
+}
@@ -3,6 +3,7 @@ package redis
 import (
 	"errors"
 	"io"
+	"strings"
 )
 
 var (
@@ -30,6 +31,16 @@ func (er *ErrorReply) WriteTo(w io.Writer) (int64, error) {
 	return int64(n), err
 }
 
+// Code returns the error code, the first word of the error, such as ERR.
+func (er *ErrorReply) Code() string {
+	return er.code
+}
+
+// Message returns the error text following the code.
+func (er *ErrorReply) Message() string {
+	return er.message
+}
+
 func (er *ErrorReply) Error() string {
 	return "-" + er.code + " " + er.message + "\r\n"
 }
@@ -37,3 +48,40 @@ func (er *ErrorReply) Error() string {
 func NewError(message string) *ErrorReply {
 	return &ErrorReply{code: "ERROR", message: message}
 }
+
+// newErrorCode builds an error reply carrying a redis error code other than
+// the generic one, such as ERR or NOPROTO.
+func newErrorCode(code, message string) *ErrorReply {
+	return &ErrorReply{code: code, message: message}
+}
+
+// errWrongArity is the reply to a command called with a number of
+// arguments its arity refuses.
+func errWrongArity(name string) *ErrorReply {
+	return newErrorCode("ERR", "wrong number of arguments for '"+name+"' command")
+}
+
+// errUnknownCommand is the reply to a command which is not registered. As
+// in redis, the name and the arguments quoted are cut at 128 bytes.
+func errUnknownCommand(name string, args [][]byte) *ErrorReply {
+	if len(name) > 128 {
+		name = name[:128]
+	}
+	var quoted []byte
+	for _, arg := range args {
+		if len(quoted) >= 128 {
+			break
+		}
+		if n := 128 - len(quoted); len(arg) > n {
+			arg = arg[:n]
+		}
+		quoted = append(append(append(quoted, '\''), arg...), '\'', ' ')
+	}
+	message := "unknown command '" + name + "', with args beginning with: " + string(quoted)
+	return newErrorCode("ERR", strings.Map(func(r rune) rune {
+		if r == '\r' || r == '\n' {
+			return ' '
+		}
+		return r
+	}, message))
+}
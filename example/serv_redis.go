@@ -4,7 +4,7 @@ import (
 	"fmt"
 	"log"
 
-	redis "github.com/r0123r/go-redis-server"
+	redis "github.com/platinasystems/go-redis-server"
 )
 
 type MyHandler struct {
@@ -22,13 +22,13 @@ func (h *MyHandler) Test() ([]byte, error) {
 }
 
 // Get override the DefaultHandler's method.
-func (h *MyHandler) Set(key string, args ...[]byte) error {
+func (h *MyHandler) Set(r *redis.Request, key string, args ...[]byte) error {
 	// However, we still can call the DefaultHandler GET method and use it.
-	err := h.DefaultHandler.Set(key, args...)
+	err := h.DefaultHandler.Set(r, key, args...)
 	if err != nil {
 		return err
 	}
-	notify := fmt.Sprint("__keyspace@", h.DefaultHandler.CurrentDb, "__:", key)
+	notify := fmt.Sprint("__keyspace@", r.DB, "__:", key)
 	log.Print(notify)
 	h.Publish(notify, []byte("set"))
 	return nil
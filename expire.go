@@ -0,0 +1,301 @@
+package redis
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Keys are expired as redis does: lazily, by the commands touching them,
+// and actively, by a cycle sampling the keys with an expiry.
+const (
+	// activeExpirePeriod is how often the active expire cycle runs.
+	activeExpirePeriod = 100 * time.Millisecond
+	// activeExpireBudget is the time a cycle may spend, a quarter of
+	// its period.
+	activeExpireBudget = activeExpirePeriod / 4
+	// activeExpireSample is the number of keys sampled at once in a shard.
+	activeExpireSample = 20
+	// activeExpireStale is the percentage of expired keys in a sample
+	// over which the shard is sampled again.
+	activeExpireStale = 10
+)
+
+// expireSample removes the expired keys among activeExpireSample keys of
+// the shard with an expiry, and returns their number. The caller holds
+// the write lock on the shard.
+func (s *shard) expireSample(now int64, expired func(key string)) int {
+	n, sampled := 0, 0
+	// Maps are iterated from a random key, which makes the sample.
+	for key, o := range s.volatile {
+		if sampled == activeExpireSample {
+			break
+		}
+		sampled++
+		if o.expired(now) {
+			s.del(key)
+			if expired != nil {
+				expired(key)
+			}
+			n++
+		}
+	}
+	return n
+}
+
+// activeExpire samples the shards of db for expired keys until deadline,
+// resuming from the shard where the previous call stopped. It tells
+// whether it went through all of them.
+func (db *Database) activeExpire(deadline time.Time) bool {
+	for i := 0; i < dbShards; i++ {
+		s := db.shards[db.next]
+		db.next = (db.next + 1) % dbShards
+		for {
+			if time.Now().After(deadline) {
+				return false
+			}
+			s.Lock()
+			n := s.expireSample(mstime(), db.expired)
+			s.Unlock()
+			if n <= activeExpireSample*activeExpireStale/100 {
+				break
+			}
+		}
+	}
+	return true
+}
+
+// expirer is implemented by handlers running an active expire cycle
+// while servers use them: from NewServer until Close or Shutdown.
+type expirer interface {
+	startExpire()
+	stopExpire()
+}
+
+// startExpire starts the active expire cycle, unless it already runs for
+// another server.
+func (h *DefaultHandler) startExpire() {
+	h.expireMu.Lock()
+	defer h.expireMu.Unlock()
+	h.expireUsers++
+	if h.expireUsers == 1 {
+		h.expireStop = make(chan struct{})
+		go h.activeExpireCycle(h.expireStop)
+	}
+}
+
+// stopExpire stops the active expire cycle once no server uses it.
+func (h *DefaultHandler) stopExpire() {
+	h.expireMu.Lock()
+	defer h.expireMu.Unlock()
+	h.expireUsers--
+	if h.expireUsers == 0 {
+		close(h.expireStop)
+		h.expireStop = nil
+	}
+}
+
+// activeExpireCycle runs the active expire cycle on every database until
+// stop is closed.
+func (h *DefaultHandler) activeExpireCycle(stop <-chan struct{}) {
+	ticker := time.NewTicker(activeExpirePeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+		deadline := time.Now().Add(activeExpireBudget)
+		h.mu.RLock()
+		dbs := make([]*Database, 0, len(h.dbs))
+		for _, db := range h.dbs {
+			dbs = append(dbs, db)
+		}
+		h.mu.RUnlock()
+		for _, db := range dbs {
+			if !db.activeExpire(deadline) {
+				break
+			}
+		}
+	}
+}
+
+// newDatabase creates the database index, publishing the expired event
+// of the keys it expires.
+func (h *DefaultHandler) newDatabase(index int) *Database {
+	db := NewDatabase(nil)
+	r := &Request{DB: index}
+	db.expired = func(key string) {
+		h.notify(r, notifyExpired, "expired", key)
+	}
+	return db
+}
+
+var (
+	ErrNotInteger    = newErrorCode("ERR", "value is not an integer or out of range")
+	errExpireNXAndXX = newErrorCode("ERR", "NX and XX, GT or LT options at the same time are not compatible")
+	errExpireGTAndLT = newErrorCode("ERR", "GT and LT options at the same time are not compatible")
+)
+
+// errInvalidExpire is the reply to a command given an expiry out of range.
+func errInvalidExpire(name string) *ErrorReply {
+	return newErrorCode("ERR", "invalid expire time in '"+name+"' command")
+}
+
+// The options of the EXPIRE commands.
+const (
+	expireNX = 1 << iota // only if the key has no expiry
+	expireXX             // only if the key has an expiry
+	expireGT             // only if the new expiry is later
+	expireLT             // only if the new expiry is sooner
+)
+
+func parseExpireOptions(options []string) (int, error) {
+	flags := 0
+	for _, option := range options {
+		switch strings.ToLower(option) {
+		case "nx":
+			flags |= expireNX
+		case "xx":
+			flags |= expireXX
+		case "gt":
+			flags |= expireGT
+		case "lt":
+			flags |= expireLT
+		default:
+			return 0, newErrorCode("ERR", "Unsupported option "+option)
+		}
+	}
+	if flags&expireNX != 0 && flags&(expireXX|expireGT|expireLT) != 0 {
+		return 0, errExpireNXAndXX
+	}
+	if flags&expireGT != 0 && flags&expireLT != 0 {
+		return 0, errExpireGTAndLT
+	}
+	return flags, nil
+}
+
+// expireTime converts when, a time in unit milliseconds, relative to the
+// current time unless absolute, to a unix time in milliseconds. It fails
+// if the result overflows.
+func expireTime(when, unit int64, absolute bool) (int64, bool) {
+	if when > math.MaxInt64/unit || when < math.MinInt64/unit {
+		return 0, false
+	}
+	when *= unit
+	if absolute {
+		return when, true
+	}
+	now := mstime()
+	if when > math.MaxInt64-now {
+		return 0, false
+	}
+	return when + now, true
+}
+
+// expire implements EXPIRE, PEXPIRE, EXPIREAT and PEXPIREAT. An expiry
+// in the past deletes the key.
+func (h *DefaultHandler) expire(r *Request, key, when string, unit int64, absolute bool, options []string) (int, error) {
+	n, err := strconv.ParseInt(when, 10, 64)
+	if err != nil {
+		return 0, ErrNotInteger
+	}
+	flags, err := parseExpireOptions(options)
+	if err != nil {
+		return 0, err
+	}
+	at, ok := expireTime(n, unit, absolute)
+	if !ok {
+		return 0, errInvalidExpire(r.Name)
+	}
+
+	db := h.db(r)
+	defer db.lock(key)()
+	s := db.shard(key)
+	o := s.lookup(key)
+	if o == nil {
+		return 0, nil
+	}
+	// A key without expiry has an infinite time to live.
+	switch {
+	case flags&expireNX != 0 && o.expireAt != 0,
+		flags&expireXX != 0 && o.expireAt == 0,
+		flags&expireGT != 0 && (o.expireAt == 0 || at <= o.expireAt),
+		flags&expireLT != 0 && o.expireAt != 0 && at >= o.expireAt:
+		return 0, nil
+	}
+	if at <= mstime() {
+		s.del(key)
+		h.notify(r, notifyGeneric, "del", key)
+		return 1, nil
+	}
+	s.expire(key, o, at)
+	h.notify(r, notifyGeneric, "expire", key)
+	return 1, nil
+}
+
+// ttl implements TTL, PTTL, EXPIRETIME and PEXPIRETIME: it returns the
+// time to live of key, or its unix expire time if absolute, in unit
+// milliseconds. It is -2 if there is no such key, -1 if it has no expiry.
+func (h *DefaultHandler) ttl(r *Request, key string, unit int64, absolute bool) (int, error) {
+	db := h.db(r)
+	defer db.rlock(key)()
+	o := db.shard(key).lookup(key)
+	if o == nil {
+		return -2, nil
+	}
+	if o.expireAt == 0 {
+		return -1, nil
+	}
+	// Rounded to the closest unit, as redis does.
+	if absolute {
+		return int((o.expireAt + unit/2) / unit), nil
+	}
+	// The key may have expired since lookup: its time to live is then 0,
+	// as -1 would mean it has no expiry.
+	ttl := o.expireAt - mstime()
+	if ttl < 0 {
+		ttl = 0
+	}
+	return int((ttl + unit/2) / unit), nil
+}
+
+func (h *DefaultHandler) Pexpire(r *Request, key, milliseconds string, options ...string) (int, error) {
+	return h.expire(r, key, milliseconds, 1, false, options)
+}
+
+func (h *DefaultHandler) Expireat(r *Request, key, timestamp string, options ...string) (int, error) {
+	return h.expire(r, key, timestamp, 1000, true, options)
+}
+
+func (h *DefaultHandler) Pexpireat(r *Request, key, timestamp string, options ...string) (int, error) {
+	return h.expire(r, key, timestamp, 1, true, options)
+}
+
+func (h *DefaultHandler) Pttl(r *Request, key string) (int, error) {
+	return h.ttl(r, key, 1, false)
+}
+
+func (h *DefaultHandler) Expiretime(r *Request, key string) (int, error) {
+	return h.ttl(r, key, 1000, true)
+}
+
+func (h *DefaultHandler) Pexpiretime(r *Request, key string) (int, error) {
+	return h.ttl(r, key, 1, true)
+}
+
+// Persist removes the expiry of key.
+func (h *DefaultHandler) Persist(r *Request, key string) (int, error) {
+	db := h.db(r)
+	defer db.lock(key)()
+	s := db.shard(key)
+	o := s.lookup(key)
+	if o == nil || o.expireAt == 0 {
+		return 0, nil
+	}
+	s.expire(key, o, 0)
+	h.notify(r, notifyGeneric, "persist", key)
+	return 1, nil
+}
@@ -0,0 +1,195 @@
+package redis
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// storedKeys counts the keys stored in db, including the expired ones
+// not yet removed.
+func storedKeys(db *Database) int {
+	n := 0
+	for _, s := range db.shards {
+		s.RLock()
+		n += len(s.keys)
+		s.RUnlock()
+	}
+	return n
+}
+
+func TestExpire(t *testing.T) {
+	h := NewDefaultHandler()
+	srv, _ := startServer(t, DefaultConfig().Handler(h).NotifyKeyspaceEvents("Ex"))
+
+	_, sub := dial(t, srv, "SUBSCRIBE __keyevent@0__:expired")
+	expectReply(t, sub, []interface{}{"subscribe", "__keyevent@0__:expired", int64(1)})
+
+	conn, r := dial(t, srv,
+		"SET string v EX 1",
+		"HSET hash f v",
+		"RPUSH list x",
+		"ZADD zset 1 x",
+		"SET keep v",
+		"EXPIRE hash 1",
+		"EXPIRE list 1",
+		"EXPIRE zset 1",
+		"TTL string",
+		"SET gone v",
+		"PEXPIRE gone 1",
+	)
+	for _, expected := range []interface{}{"OK", int64(1), int64(1), int64(1), "OK",
+		int64(1), int64(1), int64(1), int64(1), "OK", int64(1)} {
+		expectReply(t, r, expected)
+	}
+	time.Sleep(5 * time.Millisecond)
+	conn.Write([]byte("GET gone\r\nEXISTS gone\r\nTYPE gone\r\nKEYS g*\r\nSCAN 0 MATCH g*\r\nDBSIZE\r\n"))
+	for _, expected := range []interface{}{nil, int64(0), "none",
+		[]interface{}{}, []interface{}{"0", []interface{}{}}, int64(5)} {
+		expectReply(t, r, expected)
+	}
+	// Reading an expired key removes it.
+	db := h.db(&Request{})
+	s := db.shard("gone")
+	s.RLock()
+	_, stored := s.keys["gone"]
+	s.RUnlock()
+	if stored {
+		t.Fatal("Expected the expired key read to be removed")
+	}
+
+	// The active expire cycle removes the keys no command touches.
+	for deadline := time.Now().Add(3 * time.Second); storedKeys(db) > 1; {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the expired keys to be removed, %d keys left", storedKeys(db))
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	conn.Write([]byte("KEYS *\r\nSCAN 0\r\nDBSIZE\r\nTYPE list\r\nHGET hash f\r\nSELECT 1\r\nSET other v\r\nDBSIZE\r\n"))
+	for _, expected := range []interface{}{[]interface{}{"keep"}, []interface{}{"0", []interface{}{"keep"}},
+		int64(1), "none", nil, "OK", "OK", int64(1)} {
+		expectReply(t, r, expected)
+	}
+
+	expired := map[string]bool{}
+	for len(expired) < 5 {
+		message := readReply(t, sub).([]interface{})
+		expired[message[2].(string)] = true
+	}
+	for _, key := range []string{"string", "hash", "list", "zset", "gone"} {
+		if !expired[key] {
+			t.Fatalf("Expected an expired event for %s, got %v", key, expired)
+		}
+	}
+}
+
+func TestExpireCommands(t *testing.T) {
+	srv, _ := startServer(t, DefaultConfig())
+
+	_, r := dial(t, srv,
+		"SET k v",
+		"EXPIRE k 100 XX",
+		"EXPIRE k 100 NX",
+		"EXPIRE k 50 NX",
+		"EXPIRE k 200 GT",
+		"EXPIRE k 100 GT",
+		"EXPIRE k 100 LT",
+		"PTTL k",
+	)
+	for _, expected := range []interface{}{"OK", int64(0), int64(1), int64(0), int64(1), int64(0), int64(1)} {
+		expectReply(t, r, expected)
+	}
+	if pttl := readReply(t, r).(int64); pttl <= 99000 || pttl > 100000 {
+		t.Fatalf("Expected a PTTL of about 100000, got %d", pttl)
+	}
+
+	conn, r := dial(t, srv,
+		"SET k v",
+		"EXPIREAT k 4102444800",
+		"EXPIRETIME k",
+		"PEXPIREAT k 4102444800123",
+		"PEXPIRETIME k",
+		"RENAME k k2",
+		"PEXPIRETIME k2",
+		"PERSIST k2",
+		"PERSIST k2",
+		"TTL k2",
+		"EXPIRETIME k2",
+		"EXPIRETIME nosuch",
+		"EXPIRE k2 100 LT",
+		"SET k2 v",
+		"TTL k2",
+		"SET k2 v EX 100",
+		"SET k2 w KEEPTTL",
+		"TTL k2",
+		"SETEX k3 100 v",
+		"GET k3",
+		"TTL k3",
+		"PEXPIREAT k3 4102444800600",
+		"EXPIRETIME k3",
+		"PEXPIREAT k3 4102444800400",
+		"EXPIRETIME k3",
+	)
+	for _, expected := range []interface{}{"OK", int64(1), int64(4102444800), int64(1), int64(4102444800123),
+		"OK", int64(4102444800123), int64(1), int64(0), int64(-1), int64(-1), int64(-2), int64(1),
+		"OK", int64(-1), "OK", "OK", int64(100), "OK", "v", int64(100),
+		int64(1), int64(4102444801), int64(1), int64(4102444800)} {
+		expectReply(t, r, expected)
+	}
+
+	conn.Write([]byte("SET k2 v PX 100 EX 1\r\nSET k2 v EX 0\r\nEXPIRE k2 1 NX XX\r\nEXPIRE k2 1 GT LT\r\n" +
+		"EXPIRE k2 1 FOO\r\nEXPIRE k2 x\r\nPEXPIRE k2 9223372036854775807\r\n"))
+	expectLine(t, r, "-ERR syntax error")
+	expectLine(t, r, "-ERR invalid expire time in 'set' command")
+	expectLine(t, r, "-ERR NX and XX, GT or LT options at the same time are not compatible")
+	expectLine(t, r, "-ERR GT and LT options at the same time are not compatible")
+	expectLine(t, r, "-ERR Unsupported option FOO")
+	expectLine(t, r, "-ERR value is not an integer or out of range")
+	expectLine(t, r, "-ERR invalid expire time in 'pexpire' command")
+
+	// Expiries in the past delete the key.
+	conn.Write([]byte("EXPIRE k2 -1\r\nEXPIREAT k3 1\r\nEXISTS k2 k3\r\n"))
+	expectReply(t, r, int64(1))
+	expectReply(t, r, int64(1))
+	expectReply(t, r, int64(0))
+}
+
+// expireRunning tells whether the active expire cycle of h runs.
+func expireRunning(h *DefaultHandler) bool {
+	h.expireMu.Lock()
+	defer h.expireMu.Unlock()
+	return h.expireStop != nil
+}
+
+func TestExpireCycleLifetime(t *testing.T) {
+	if DefaultConfig().handler != nil {
+		t.Fatal("Expected DefaultConfig not to create a handler")
+	}
+	h := NewDefaultHandler()
+	if expireRunning(h) {
+		t.Fatal("Expected the expire cycle not to run before a server uses the handler")
+	}
+
+	first, err := NewServer(DefaultConfig().Port(0).Handler(h))
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := NewServer(DefaultConfig().Port(0).Handler(h))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !expireRunning(h) {
+		t.Fatal("Expected the expire cycle to run along with the servers")
+	}
+	first.Close()
+	first.Close()
+	if !expireRunning(h) {
+		t.Fatal("Expected the expire cycle to run while a server uses the handler")
+	}
+	if err := second.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if expireRunning(h) {
+		t.Fatal("Expected the expire cycle to stop with the last server")
+	}
+}
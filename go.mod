@@ -1 +1,3 @@
 module github.com/platinasystems/go-redis-server
+
+go 1.21
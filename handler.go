@@ -1,47 +1,142 @@
 package redis
 
 import (
+	"fmt"
 	"reflect"
 	"strings"
+	"time"
 )
 
 type HandlerFn func(r *Request) (ReplyWriter, error)
 
+// Middleware wraps the handler of a command, running code before and after
+// it, or replying instead of it.
+type Middleware func(next HandlerFn) HandlerFn
+
 func (srv *Server) RegisterFct(key string, f interface{}) error {
 	v := reflect.ValueOf(f)
 	handlerFn, err := srv.createHandlerFn(f, &v)
 	if err != nil {
 		return err
 	}
-	srv.Register(key, handlerFn)
+	srv.register(key, handlerFn, handlerArity(f, &v))
 	return nil
 }
 
+// Register serves the command name with fn. Its arguments are not
+// checked, fn being free to take any number of them.
 func (srv *Server) Register(name string, fn HandlerFn) {
+	srv.register(name, fn, -1)
+}
+
+// register serves the command name with fn, checking that its arguments
+// suit arity. Zero keeps the arity of commandTable.
+func (srv *Server) register(name string, fn HandlerFn, arity int) {
 	if srv.methods == nil {
 		srv.methods = make(map[string]HandlerFn)
+		srv.chains = make(map[string]HandlerFn)
 	}
 	if fn != nil {
-		Debugf("REGISTER: %s", strings.ToLower(name))
+		srv.log(LevelDebug, "Registered command", Field{"command", strings.ToLower(name)})
 		srv.methods[strings.ToLower(name)] = fn
+		srv.chains[strings.ToLower(name)] = srv.chain(fn)
+		srv.addCommandStats(strings.ToLower(name))
+		srv.addCommandSpec(strings.ToLower(name), arity)
 	}
 }
 
-func (srv *Server) Apply(r *Request) (ReplyWriter, error) {
-	srv.Lock()
-	defer srv.Unlock()
+// Use adds middleware around every command, including those registered
+// before. Middleware runs in the order it was added, the first being the
+// outermost, and before the ACL checks. Like Register, Use is meant to be
+// called before the server starts serving.
+func (srv *Server) Use(middleware ...Middleware) {
+	srv.middleware = append(srv.middleware, middleware...)
+	for name, fn := range srv.methods {
+		srv.chains[name] = srv.chain(fn)
+	}
+}
+
+// chain wraps fn in the middleware of the server.
+func (srv *Server) chain(fn HandlerFn) HandlerFn {
+	fn = srv.feedMonitors(fn)
+	fn = srv.enforceACL(fn)
+	for i := len(srv.middleware) - 1; i >= 0; i-- {
+		fn = srv.middleware[i](fn)
+	}
+	return fn
+}
+
+// enforceACL replies to the clients which may not run the command.
+func (srv *Server) enforceACL(next HandlerFn) HandlerFn {
+	return func(r *Request) (ReplyWriter, error) {
+		if reply := srv.checkAccess(r); reply != nil {
+			return reply, nil
+		}
+		return next(r)
+	}
+}
+
+// feedMonitors sends the commands of the clients to those running MONITOR.
+func (srv *Server) feedMonitors(next HandlerFn) HandlerFn {
+	return func(r *Request) (ReplyWriter, error) {
+		if monitors := srv.monitors(); len(r.Host) > 0 && len(monitors) > 0 {
+			monitorString := fmt.Sprintf("%.6f [%d %s] \"%s\" ",
+				float64(time.Now().UTC().UnixNano())/1e9,
+				r.DB,
+				r.Host,
+				r.Name,
+			)
+
+			if len(r.Args) > 0 {
+				for i, a := range r.Args {
+					monitorString += fmt.Sprint(" ", i, ":")
+					if len(a) > 50 {
+						monitorString += fmt.Sprint("size ", len(a))
+					} else {
+						monitorString += `"` + string(a) + `"`
+					}
+				}
+			}
 
+			for _, m := range monitors {
+				if !m.feed(monitorString) {
+					srv.removeMonitor(m)
+				}
+			}
+
+			srv.log(LevelDebug, monitorString, Field{"monitors", len(monitors)})
+		}
+		return next(r)
+	}
+}
+
+// Apply runs the command r. Commands from different clients run
+// concurrently: handlers synchronize the state they share themselves.
+func (srv *Server) Apply(r *Request) (ReplyWriter, error) {
 	if srv == nil || srv.methods == nil {
-		Debugf("The method map is uninitialized")
+		srv.log(LevelDebug, "The method map is uninitialized")
 		return ErrMethodNotSupported, nil
 	}
-	srv.methods["select"](&Request{Args: r.Numdb})
-	fn, exists := srv.methods[strings.ToLower(r.Name)]
+	fn, exists := srv.chains[strings.ToLower(r.Name)]
 	if !exists {
-		println(r.Name, " method not exists")
-		return ErrMethodNotSupported, nil
+		srv.log(LevelDebug, "Unknown command", Field{"command", r.Name})
+		return errUnknownCommand(r.Name, r.Args), nil
+	}
+	spec := srv.lookupCommandSpec(r.Name, r.Args)
+	if spec != nil && !spec.arityMatches(len(r.Args)+1) {
+		srv.rejectCommand(r)
+		return errWrongArity(spec.fullName()), nil
+	}
+	if spec != nil && spec.denyOOM && srv.overMaxMemory() {
+		srv.rejectCommand(r)
+		return ErrOOM, nil
 	}
-	return fn(r)
+	start := time.Now()
+	reply, err := fn(r)
+	d := time.Since(start)
+	srv.recordCommand(r, d, reply, err)
+	srv.recordSlowlog(r, d)
+	return reply, err
 }
 
 func (srv *Server) ApplyString(r *Request) (string, error) {
@@ -1,6 +1,7 @@
 package redis
 
 import (
+	"bytes"
 	"strings"
 	"testing"
 )
@@ -37,3 +38,150 @@ func TestCustomHandler(t *testing.T) {
 		t.Fatalf("Eexpected reply %q, got: %q", expected, reply)
 	}
 }
+
+func TestHello(t *testing.T) {
+	srv, err := NewServer(DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	for _, v := range []struct {
+		args     [][]byte
+		expected string
+	}{
+		{[][]byte{[]byte("4")}, "-NOPROTO unsupported protocol version\r\n"},
+		{[][]byte{[]byte("x")}, "-ERR Protocol version is not an integer or out of range\r\n"},
+		{[][]byte{[]byte("3"), []byte("setname")}, "-ERR syntax error\r\n"},
+	} {
+		reply, err := srv.ApplyString(&Request{Name: "hello", Args: v.args})
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if reply != v.expected {
+			t.Fatalf("Expected reply %q, got: %q", v.expected, reply)
+		}
+	}
+
+	r := &Request{Name: "hello", Args: [][]byte{[]byte("3")}}
+	reply, err := srv.Apply(r)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if r.Proto != RESP3 {
+		t.Fatalf("Expected protocol to switch to RESP3, got %d", r.Proto)
+	}
+	var b bytes.Buffer
+	if _, err := reply.WriteTo(NewProtocolWriter(&b, r.Proto)); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(b.String(), "%7\r\n$6\r\nserver\r\n") {
+		t.Fatalf("Expected a RESP3 map, got: %q", b.String())
+	}
+}
+
+func TestCreateReplyMap(t *testing.T) {
+	srv := &Server{}
+	reply, err := srv.createReply(&Request{}, map[string][]byte{"k": []byte("v")})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	for proto, expected := range map[int]string{
+		RESP2: "*2\r\n$1\r\nk\r\n$1\r\nv\r\n",
+		RESP3: "%1\r\n$1\r\nk\r\n$1\r\nv\r\n",
+	} {
+		var b bytes.Buffer
+		if _, err := reply.WriteTo(NewProtocolWriter(&b, proto)); err != nil {
+			t.Fatal(err)
+		}
+		if b.String() != expected {
+			t.Fatalf("RESP%d: expected %q, got %q", proto, expected, b.String())
+		}
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	srv, err := NewServer(DefaultConfig().Port(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	srv.RegisterFct("answer", func() (int, error) { return 42, nil })
+
+	var calls []string
+	trace := func(name string) Middleware {
+		return func(next HandlerFn) HandlerFn {
+			return func(r *Request) (ReplyWriter, error) {
+				calls = append(calls, name+" "+r.Name)
+				return next(r)
+			}
+		}
+	}
+	srv.Use(trace("first"), trace("second"))
+	srv.Use(func(next HandlerFn) HandlerFn {
+		return func(r *Request) (ReplyWriter, error) {
+			if r.Name == "flushall" {
+				return NewError("disabled"), nil
+			}
+			return next(r)
+		}
+	})
+
+	for _, v := range []struct {
+		name     string
+		expected string
+	}{
+		{"answer", ":42\r\n"},
+		{"ping", "+PONG\r\n"},
+		{"flushall", "-ERROR disabled\r\n"},
+	} {
+		reply, err := srv.ApplyString(&Request{Name: v.name})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reply != v.expected {
+			t.Fatalf("%s: expected %q, got %q", v.name, v.expected, reply)
+		}
+	}
+	expected := []string{
+		"first answer", "second answer",
+		"first ping", "second ping",
+		"first flushall", "second flushall",
+	}
+	if strings.Join(calls, ",") != strings.Join(expected, ",") {
+		t.Fatalf("Expected %v, got %v", expected, calls)
+	}
+
+	// Commands registered after Use are wrapped too.
+	calls = nil
+	srv.Register("late", func(r *Request) (ReplyWriter, error) {
+		return &StatusReply{Code: "OK"}, nil
+	})
+	srv.Apply(&Request{Name: "late"})
+	if len(calls) != 2 {
+		t.Fatalf("Expected the late command to be wrapped, got %v", calls)
+	}
+}
+
+func TestArity(t *testing.T) {
+	srv, _ := startServer(t, DefaultConfig())
+	if err := srv.RegisterFct("pair", func(a, b string) (string, error) { return a + b, nil }); err != nil {
+		t.Fatal(err)
+	}
+
+	_, r := dial(t, srv, "SET a", "HMSET h f", "GET a b", "CONFIG GET", "PAIR x", "PAIR x y", "FOO bar baz", "HSET h f v")
+	expectLine(t, r, "-ERR wrong number of arguments for 'set' command")
+	expectLine(t, r, "-ERR wrong number of arguments for 'hmset' command")
+	expectLine(t, r, "-ERR wrong number of arguments for 'get' command")
+	expectLine(t, r, "-ERR wrong number of arguments for 'config|get' command")
+	expectLine(t, r, "-ERR wrong number of arguments for 'pair' command")
+	expectReply(t, r, "xy")
+	expectLine(t, r, "-ERR unknown command 'foo', with args beginning with: 'bar' 'baz' ")
+	expectReply(t, r, int64(1))
+
+	long := strings.Repeat("x", 100)
+	reply := errUnknownCommand("foo", [][]byte{[]byte(long), []byte(long), []byte("more")}).Message()
+	if expected := "unknown command 'foo', with args beginning with: '" + long + "' '" + long[:25] + "' "; reply != expected {
+		t.Fatalf("Expected %q, got %q", expected, reply)
+	}
+}
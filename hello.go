@@ -0,0 +1,89 @@
+package redis
+
+import (
+	"strconv"
+	"strings"
+)
+
+// serverVersion is the redis version announced to clients.
+const serverVersion = "7.0.0"
+
+var (
+	ErrProtoNotInteger = newErrorCode("ERR", "Protocol version is not an integer or out of range")
+	ErrNoProto         = newErrorCode("NOPROTO", "unsupported protocol version")
+	ErrSyntax          = newErrorCode("ERR", "syntax error")
+	ErrHelloNoAuth     = newErrorCode("NOAUTH", "HELLO must be called with the client already authenticated, otherwise the HELLO <proto> AUTH <user> <pass> option can be used to authenticate the client and select the RESP protocol version at the same time")
+)
+
+// hello implements HELLO [protover [AUTH username password] [SETNAME clientname]].
+// It switches the protocol of the connection and describes the server.
+func (srv *Server) hello(r *Request) (ReplyWriter, error) {
+	proto := r.Proto
+	if proto == 0 {
+		proto = RESP2
+	}
+	if len(r.Args) > 0 {
+		v, err := strconv.Atoi(string(r.Args[0]))
+		if err != nil {
+			return ErrProtoNotInteger, nil
+		}
+		if v != RESP2 && v != RESP3 {
+			return ErrNoProto, nil
+		}
+		proto = v
+	}
+
+	var name, user, password string
+	var setName, auth bool
+	for i := 1; i < len(r.Args); i++ {
+		switch strings.ToLower(string(r.Args[i])) {
+		case "auth":
+			if i+2 >= len(r.Args) {
+				return ErrSyntax, nil
+			}
+			user, password = string(r.Args[i+1]), string(r.Args[i+2])
+			auth = true
+			i += 2
+		case "setname":
+			if i+1 >= len(r.Args) {
+				return ErrSyntax, nil
+			}
+			i++
+			if !validClientName(string(r.Args[i])) {
+				return ErrInvalidClientName, nil
+			}
+			name = string(r.Args[i])
+			setName = true
+		default:
+			return ErrSyntax, nil
+		}
+	}
+
+	if auth {
+		if err := srv.authenticate(r, user, password); err != nil {
+			return err, nil
+		}
+	} else if r.Client != nil {
+		if _, ok := r.Client.authUser(); !ok {
+			return ErrHelloNoAuth, nil
+		}
+	}
+
+	var id int64
+	if r.Client != nil {
+		id = r.Client.ID()
+		if setName {
+			r.Client.setName(name)
+		}
+	}
+	r.Proto = proto
+	return NewMapReply(
+		"server", "redis",
+		"version", serverVersion,
+		"proto", proto,
+		"id", id,
+		"mode", "standalone",
+		"role", "master",
+		"modules", []interface{}{},
+	), nil
+}
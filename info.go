@@ -0,0 +1,135 @@
+package redis
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"runtime/metrics"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// infoSections are the sections of INFO, in order. INFO without argument
+// replies those included by default.
+var infoSections = []struct {
+	name      string
+	byDefault bool
+	write     func(srv *Server, b *bytes.Buffer)
+}{
+	{"server", true, (*Server).infoServer},
+	{"clients", true, (*Server).infoClients},
+	{"memory", true, (*Server).infoMemory},
+	{"stats", true, (*Server).infoStats},
+	{"commandstats", false, (*Server).infoCommandStats},
+	{"keyspace", true, (*Server).infoKeyspace},
+}
+
+// info implements INFO [section ...]. The sections are the default ones,
+// those named, or all of them with "all" or "everything".
+func (srv *Server) info(r *Request) (ReplyWriter, error) {
+	selected := make(map[string]bool)
+	all, byDefault := false, len(r.Args) == 0
+	for _, arg := range r.Args {
+		switch section := strings.ToLower(string(arg)); section {
+		case "all", "everything":
+			all = true
+		case "default":
+			byDefault = true
+		default:
+			selected[section] = true
+		}
+	}
+	var b bytes.Buffer
+	for _, section := range infoSections {
+		if !all && !selected[section.name] && !(byDefault && section.byDefault) {
+			continue
+		}
+		if b.Len() > 0 {
+			b.WriteString("\r\n")
+		}
+		b.WriteString("# " + strings.ToUpper(section.name[:1]) + section.name[1:] + "\r\n")
+		section.write(srv, &b)
+	}
+	return &BulkReply{value: b.Bytes()}, nil
+}
+
+func infoField(b *bytes.Buffer, name string, value interface{}) {
+	fmt.Fprintf(b, "%s:%v\r\n", name, value)
+}
+
+func (srv *Server) infoServer(b *bytes.Buffer) {
+	uptime := time.Since(srv.started)
+	infoField(b, "redis_version", serverVersion)
+	infoField(b, "redis_mode", "standalone")
+	infoField(b, "os", runtime.GOOS+" "+runtime.GOARCH)
+	infoField(b, "arch_bits", strconv.IntSize)
+	infoField(b, "go_version", runtime.Version())
+	infoField(b, "process_id", os.Getpid())
+	if _, port, err := net.SplitHostPort(srv.Addr); err == nil {
+		infoField(b, "tcp_port", port)
+	}
+	infoField(b, "uptime_in_seconds", int64(uptime/time.Second))
+	infoField(b, "uptime_in_days", int64(uptime/(24*time.Hour)))
+}
+
+func (srv *Server) infoClients(b *bytes.Buffer) {
+	connected, blocked, pubsub := srv.clientCounts()
+	infoField(b, "connected_clients", connected)
+	infoField(b, "maxclients", srv.conf().maxClients)
+	infoField(b, "blocked_clients", blocked)
+	infoField(b, "pubsub_clients", pubsub)
+}
+
+func (srv *Server) infoMemory(b *bytes.Buffer) {
+	s := new(runtime.MemStats)
+	runtime.ReadMemStats(s)
+	infoField(b, "used_memory", s.Sys)
+	infoField(b, "used_memory_heap", s.HeapAlloc)
+	infoField(b, "maxmemory", srv.conf().maxMemory)
+}
+
+var ErrOOM = newErrorCode("OOM", "command not allowed when used memory > 'maxmemory'")
+
+// overMaxMemory tells whether the heap is over maxmemory.
+func (srv *Server) overMaxMemory() bool {
+	limit := srv.conf().maxMemory
+	if limit == 0 {
+		return false
+	}
+	sample := []metrics.Sample{{Name: "/memory/classes/heap/objects:bytes"}}
+	metrics.Read(sample)
+	return int64(sample[0].Value.Uint64()) > limit
+}
+
+func (srv *Server) infoStats(b *bytes.Buffer) {
+	infoField(b, "total_connections_received", atomic.LoadInt64(&srv.stats.connections))
+	infoField(b, "total_commands_processed", atomic.LoadInt64(&srv.stats.commands))
+	infoField(b, "rejected_connections", atomic.LoadInt64(&srv.stats.rejected))
+	infoField(b, "client_output_buffer_limit_disconnections", atomic.LoadInt64(&srv.stats.outputLimitDisconnections))
+}
+
+func (srv *Server) infoCommandStats(b *bytes.Buffer) {
+	for _, name := range srv.commandNames() {
+		s := srv.commandStats[name]
+		calls, rejected := atomic.LoadInt64(&s.calls), atomic.LoadInt64(&s.rejected)
+		if calls == 0 && rejected == 0 {
+			continue
+		}
+		usec, perCall := atomic.LoadInt64(&s.usec), 0.0
+		if calls > 0 {
+			perCall = float64(usec) / float64(calls)
+		}
+		fmt.Fprintf(b, "cmdstat_%s:calls=%d,usec=%d,usec_per_call=%.2f,rejected_calls=%d,failed_calls=%d\r\n",
+			name, calls, usec, perCall, rejected, atomic.LoadInt64(&s.failed))
+	}
+}
+
+func (srv *Server) infoKeyspace(b *bytes.Buffer) {
+	for _, db := range srv.keyspaceStats() {
+		fmt.Fprintf(b, "db%d:keys=%d,expires=%d,avg_ttl=0\r\n", db.db, db.keys, db.expires)
+	}
+}
@@ -6,7 +6,7 @@ import (
 	"bytes"
 	"fmt"
 	"regexp"
-	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -69,102 +69,130 @@ func patternRE(k string) *regexp.Regexp {
 	return regexp.MustCompile(re.String())
 }
 
-func (h *DefaultHandler) MGet(keys ...string) ([][]byte, error) {
-	h.Database = h.dbs[h.CurrentDb]
-	if h.values == nil {
-		return nil, nil
+// matchKeys returns the keys of db matching re, removing those which are
+// expired.
+func (db *Database) matchKeys(re *regexp.Regexp) []string {
+	var res, expired []string
+	now := mstime()
+	for _, s := range db.shards {
+		s.RLock()
+		for key, o := range s.keys {
+			if !re.MatchString(key) {
+				continue
+			}
+			if o.expired(now) {
+				expired = append(expired, key)
+			} else {
+				res = append(res, key)
+			}
+		}
+		s.RUnlock()
+	}
+	db.expireKeys(expired)
+	return res
+}
+
+// flush empties db.
+func (db *Database) flush() {
+	for _, s := range db.shards {
+		s.Lock()
+		s.flush()
+		s.Unlock()
+	}
+}
+
+// expires counts the keys with a time to live.
+func (db *Database) expires() int {
+	n := 0
+	now := mstime()
+	for _, s := range db.shards {
+		s.RLock()
+		for _, o := range s.volatile {
+			if !o.expired(now) {
+				n++
+			}
+		}
+		s.RUnlock()
 	}
+	return n
+}
+
+// size counts the keys of db which are not expired.
+func (db *Database) size() int {
+	size := 0
+	now := mstime()
+	for _, s := range db.shards {
+		s.RLock()
+		size += len(s.keys)
+		for _, o := range s.volatile {
+			if o.expired(now) {
+				size--
+			}
+		}
+		s.RUnlock()
+	}
+	return size
+}
+
+func (h *DefaultHandler) MGet(r *Request, keys ...string) ([][]byte, error) {
+	db := h.db(r)
+	defer db.rlock(keys...)()
 	rez := make([][]byte, len(keys))
 	for i, key := range keys {
-		rez[i] = h.values[key]
+		// MGET replies nil for the keys holding something else.
+		rez[i], _ = db.shard(key).str(key)
 	}
 	return rez, nil
 }
 
-func (h *DefaultHandler) MSet(args ...[]byte) error {
-	h.Database = h.dbs[h.CurrentDb]
-	if len(args)%2 != 0 {
-		return fmt.Errorf("not values")
+func (h *DefaultHandler) MSet(r *Request, args ...[]byte) error {
+	if len(args)%2 != 0 || len(args) < 2 {
+		return errWrongArity("mset")
+	}
+	keys := make([]string, 0, len(args)/2)
+	for i := 0; i < len(args); i += 2 {
+		keys = append(keys, string(args[i]))
 	}
+	db := h.db(r)
+	defer db.lock(keys...)()
 	for len(args) > 0 {
-		key, value := args[0], args[1]
+		key, value := string(args[0]), args[1]
 		args = args[2:]
 
-		h.values[string(key)] = value
+		db.shard(key).set(key, value)
+		h.notify(r, notifyString, "set", key)
 	}
 
 	return nil
 }
-func (h *DefaultHandler) Keys(pattern string) ([][]byte, error) {
-	h.Database = h.dbs[h.CurrentDb]
+func (h *DefaultHandler) Keys(r *Request, pattern string) ([][]byte, error) {
 	res := make([][]byte, 0)
 	re := patternRE(pattern)
 	if re == nil {
 		return nil, fmt.Errorf("pattern - invalid format")
 	} else {
-		for key, _ := range h.values {
-			if !re.MatchString(key) {
-				continue
-			}
+		for _, key := range h.db(r).matchKeys(re) {
 			res = append(res, []byte(key))
 		}
-		for key, _ := range h.hvalues {
-			if !re.MatchString(key) {
-				continue
-			}
-			res = append(res, []byte(key))
-		}
-		for key, _ := range h.brstack {
-			if !re.MatchString(key) {
-				continue
-			}
-			res = append(res, []byte(key))
-		}
-		for key, _ := range h.orderedSet {
-			if !re.MatchString(key) {
-				continue
-			}
-			res = append(res, []byte(key))
-		}
-
 	}
 
 	return res, nil
 }
 func (h *DefaultHandler) FlushAll() error {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
 	for _, db := range h.dbs {
-		db.values = make(HashValue)
-		db.hvalues = make(HashHash)
-		db.brstack = make(HashBrStack)
-		db.orderedSet = make(HashOrderedSet)
-		db.ttl = make(HashTtl)
+		db.flush()
 	}
 	return nil
 }
-func (h *DefaultHandler) FlushDB() error {
-	h.Database = h.dbs[h.CurrentDb]
-	h.values = make(HashValue)
-	h.hvalues = make(HashHash)
-	h.brstack = make(HashBrStack)
+func (h *DefaultHandler) FlushDB(r *Request) error {
+	h.db(r).flush()
 	return nil
 }
 
-func (h *DefaultHandler) Ttl(key string) (int, error) {
-	h.Database = h.dbs[h.CurrentDb]
-	if ok, _ := h.Exists(key); ok != 1 {
-		// No such key
-		return -2, nil
-
-	}
-
-	v, ok := h.ttl[key]
-	if !ok {
-		// no expire value
-		return -1, nil
-
-	}
-	return int(v.Sub(time.Now()).Seconds()), nil
-
+func (h *DefaultHandler) Ttl(r *Request, key string) (int, error) {
+	return h.ttl(r, key, 1000, false)
 }
 func (h *DefaultHandler) Time() ([][]byte, error) {
 	now := time.Now().UTC()
@@ -174,39 +202,26 @@ func (h *DefaultHandler) Time() ([][]byte, error) {
 	}
 	return ret, nil
 }
-func (h *DefaultHandler) Info(key ...string) ([]byte, error) {
-	var b = bytes.NewBuffer(make([]byte, 0))
-	fmt.Fprint(b, "redis_version:gopex", "\r\n")
-	s := new(runtime.MemStats)
-	runtime.ReadMemStats(s)
 
-	fmt.Fprint(b, "used_memory:", s.Sys, "\r\n")
-	fmt.Fprint(b, "os:", runtime.GOOS, "\r\n")
-	return b.Bytes(), nil
-}
-func (h *DefaultHandler) DbSize() (int, error) {
-	size := 0
-	for _, db := range h.dbs {
-		size += len(db.values)
-		size += len(db.hvalues)
-		size += len(db.brstack)
-		size += len(db.orderedSet)
+// keyspaceStats reports the size of the non-empty databases.
+func (h *DefaultHandler) keyspaceStats() []dbStats {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	var stats []dbStats
+	for index, db := range h.dbs {
+		if keys := db.size(); keys > 0 {
+			stats = append(stats, dbStats{db: index, keys: keys, expires: db.expires()})
+		}
 	}
-	return size, nil
+	sort.Slice(stats, func(i, j int) bool { return stats[i].db < stats[j].db })
+	return stats
 }
-func (h *DefaultHandler) Config(key, arg string) ([][]byte, error) {
-
-	if strings.ToLower(key) == "get" && strings.ToLower(arg) == "databases" {
-		return [][]byte{[]byte(arg), []byte("16")}, nil
-	} else {
-		println("Config ", key, " ", arg)
-	}
-	return nil, nil
 
+// DbSize counts the keys of the database selected by the client.
+func (h *DefaultHandler) DbSize(r *Request) (int, error) {
+	return h.db(r).size(), nil
 }
-func (h *DefaultHandler) Scan(args ...string) ([]interface{}, error) {
-	h.Database = h.dbs[h.CurrentDb]
-
+func (h *DefaultHandler) Scan(r *Request, args ...string) ([]interface{}, error) {
 	if len(args) < 1 {
 		return nil, fmt.Errorf("args < 1")
 
@@ -250,94 +265,93 @@ func (h *DefaultHandler) Scan(args ...string) ([]interface{}, error) {
 	res := []interface{}{}
 	re := patternRE(match)
 	if re != nil {
-		for key, _ := range h.values {
-			if !re.MatchString(key) {
-				continue
-			}
-			res = append(res, key)
-		}
-		for key, _ := range h.hvalues {
-			if !re.MatchString(key) {
-				continue
-			}
-			res = append(res, key)
-		}
-		for key, _ := range h.brstack {
-			if !re.MatchString(key) {
-				continue
-			}
-			res = append(res, key)
-		}
-		for key, _ := range h.orderedSet {
-			if !re.MatchString(key) {
-				continue
-			}
+		for _, key := range h.db(r).matchKeys(re) {
 			res = append(res, key)
 		}
-
 	}
 	ret := []interface{}{"0", res}
 	return ret, nil
 }
-func (h *DefaultHandler) Type(key string) (interface{}, error) {
-	h.Database = h.dbs[h.CurrentDb]
-
-	if _, ok := h.values[key]; ok {
-		return "string", nil
-	}
-	if _, ok := h.hvalues[key]; ok {
-		return "hash", nil
-
-	}
-	if _, ok := h.brstack[key]; ok {
-		return "list", nil
-
-	}
-	if _, ok := h.orderedSet[key]; ok {
-		return "zset", nil
+func (h *DefaultHandler) Type(r *Request, key string) (interface{}, error) {
+	db := h.db(r)
+	defer db.rlock(key)()
+	if o := db.shard(key).lookup(key); o != nil {
+		return typeNames[o.kind], nil
 	}
 	return "none", nil
 }
-func (h *DefaultHandler) Hlen(key string) (interface{}, error) {
-	h.Database = h.dbs[h.CurrentDb]
-	if v, ok := h.hvalues[key]; ok {
-		return len(v), nil
+func (h *DefaultHandler) Hlen(r *Request, key string) (interface{}, error) {
+	db := h.db(r)
+	defer db.rlock(key)()
+	v, err := db.shard(key).hash(key, false)
+	if err != nil {
+		return nil, err
 	}
-	return 0, nil
+	return len(v), nil
 }
-func (h *DefaultHandler) Llen(key string) (interface{}, error) {
-	h.Database = h.dbs[h.CurrentDb]
-	if v, ok := h.brstack[key]; ok {
-		return v.Len(), nil
+func (h *DefaultHandler) Llen(r *Request, key string) (interface{}, error) {
+	db := h.db(r)
+	defer db.rlock(key)()
+	v, err := db.shard(key).list(key, false)
+	if v == nil {
+		if err != nil {
+			return nil, err
+		}
+		return 0, nil
 	}
-	return 0, nil
+	return v.Len(), nil
 }
-func (h *DefaultHandler) Lset(key string, ind int, value []byte) (interface{}, error) {
-	h.Database = h.dbs[h.CurrentDb]
-	if v, ok := h.brstack[key]; ok {
+func (h *DefaultHandler) Lset(r *Request, key string, ind int, value []byte) (interface{}, error) {
+	db := h.db(r)
+	defer db.lock(key)()
+	v, err := db.shard(key).list(key, false)
+	if err != nil {
+		return nil, err
+	}
+	if v != nil {
 		v.SetIndex(ind, value)
+		h.notify(r, notifyList, "lset", key)
 		return "OK", nil
 	}
 	return nil, nil
 }
-func (h *DefaultHandler) Lrem(key string, count int, value []byte) (interface{}, error) {
-	h.Database = h.dbs[h.CurrentDb]
-	if v, ok := h.brstack[key]; ok {
+func (h *DefaultHandler) Lrem(r *Request, key string, count int, value []byte) (interface{}, error) {
+	db := h.db(r)
+	defer db.lock(key)()
+	s := db.shard(key)
+	v, err := s.list(key, false)
+	if err != nil {
+		return nil, err
+	}
+	if v != nil {
 		rez := v.FilterRem(value, count)
+		if rez > 0 {
+			h.notify(r, notifyList, "lrem", key)
+		}
+		if v.Len() == 0 {
+			s.del(key)
+		}
 		return rez, nil
 	}
 	return nil, nil
 }
-func (h *DefaultHandler) Zcard(key string) (int, error) {
-	h.Database = h.dbs[h.CurrentDb]
-	if v, ok := h.orderedSet[key]; ok {
-		return len(v.elements), nil
+func (h *DefaultHandler) Zcard(r *Request, key string) (int, error) {
+	db := h.db(r)
+	defer db.rlock(key)()
+	v, err := db.shard(key).zset(key, false)
+	if v == nil {
+		return 0, err
 	}
-	return 0, nil
+	return len(v.elements), nil
 }
-func (h *DefaultHandler) Zscore(key, val string) (interface{}, error) {
-	h.Database = h.dbs[h.CurrentDb]
-	if v, ok := h.orderedSet[key]; ok {
+func (h *DefaultHandler) Zscore(r *Request, key, val string) (interface{}, error) {
+	db := h.db(r)
+	defer db.rlock(key)()
+	v, err := db.shard(key).zset(key, false)
+	if err != nil {
+		return nil, err
+	}
+	if v != nil {
 		res := v.Score(val)
 		switch r := res.(type) {
 		case int:
@@ -348,47 +362,47 @@ func (h *DefaultHandler) Zscore(key, val string) (interface{}, error) {
 	}
 	return nil, nil
 }
-func (h *DefaultHandler) Rename(key, newKey string) (interface{}, error) {
-	h.Database = h.dbs[h.CurrentDb]
-	if val, exists := h.values[key]; exists {
-		h.values[newKey] = val
-		delete(h.values, key)
-		return "OK", nil
-	} else if val, exists := h.hvalues[key]; exists {
-		h.hvalues[newKey] = val
-		delete(h.hvalues, key)
-		return "OK", nil
-	} else if val, exists := h.brstack[key]; exists {
-		h.brstack[newKey] = val
-		delete(h.brstack, key)
-		return "OK", nil
-	} else if val, exists := h.orderedSet[key]; exists {
-		h.orderedSet[newKey] = val
-		delete(h.orderedSet, key)
-		return "OK", nil
+func (h *DefaultHandler) Rename(r *Request, key, newKey string) (interface{}, error) {
+	db := h.db(r)
+	defer db.lock(key, newKey)()
+	s, ns := db.shard(key), db.shard(newKey)
+	o := s.lookup(key)
+	if o == nil {
+		return nil, fmt.Errorf("key not found")
 	}
-
-	return nil, fmt.Errorf("key not found")
-
+	// The object replaces whatever newKey held, of any type, and keeps
+	// its expiry.
+	s.del(key)
+	ns.put(newKey, o)
+	if list, ok := o.value.(*Stack); ok {
+		list.Key = newKey
+		ns.serveBlocked(newKey)
+	}
+	h.notify(r, notifyGeneric, "rename_from", key)
+	h.notify(r, notifyGeneric, "rename_to", newKey)
+	return "OK", nil
 }
-func (h *DefaultHandler) HMSet(args ...[]byte) error {
-	h.Database = h.dbs[h.CurrentDb]
-	if len(args) > 2 && (len(args)-1)%2 != 0 {
-		return fmt.Errorf("not values")
+func (h *DefaultHandler) HMSet(r *Request, args ...[]byte) error {
+	if (len(args)-1)%2 != 0 || len(args) < 3 {
+		return errWrongArity("hmset")
 	}
 	key := string(args[0])
 	args = args[1:]
+	db := h.db(r)
+	defer db.lock(key)()
+	v, err := db.shard(key).hash(key, true)
+	if err != nil {
+		return err
+	}
 	for len(args) > 0 {
 		subkey, value := args[0], args[1]
 		args = args[2:]
-		if _, err := h.Hset(key, string(subkey), value); err != nil {
-			return err
-		}
-
+		v[string(subkey)] = value
 	}
+	h.notify(r, notifyHash, "hset", key)
 
 	return nil
 }
-func (h *DefaultHandler) Setex(key string, ex []byte, arg []byte) error {
-	return h.Set(key, ex, arg)
+func (h *DefaultHandler) Setex(r *Request, key string, ex []byte, arg []byte) error {
+	return h.Set(r, key, arg, []byte("ex"), ex)
 }
@@ -0,0 +1,161 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LogLevel is the severity of a log record, using the levels of redis'
+// loglevel.
+type LogLevel int
+
+const (
+	LevelDebug LogLevel = iota
+	LevelVerbose
+	LevelNotice
+	LevelWarning
+	// LevelNothing disables logging when used as the level of the server.
+	LevelNothing
+)
+
+var logLevelNames = []string{"debug", "verbose", "notice", "warning", "nothing"}
+
+func (l LogLevel) String() string {
+	if l < LevelDebug || l > LevelNothing {
+		return fmt.Sprintf("LogLevel(%d)", int(l))
+	}
+	return logLevelNames[l]
+}
+
+// ParseLogLevel parses a loglevel of redis.conf: debug, verbose, notice,
+// warning or nothing.
+func ParseLogLevel(s string) (LogLevel, error) {
+	for i, name := range logLevelNames {
+		if strings.EqualFold(s, name) {
+			return LogLevel(i), nil
+		}
+	}
+	return LevelNotice, fmt.Errorf("argument(s) must be one of the following: %s", strings.Join(logLevelNames, ", "))
+}
+
+// Field is a key and value attached to a log record.
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// Logger receives the log records of the server. Records below the
+// loglevel of the server are filtered out before reaching it.
+type Logger interface {
+	Log(level LogLevel, msg string, fields ...Field)
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Log(LogLevel, string, ...Field) {}
+
+// Stderr is where the records are written when the DEBUG env is non
+// empty and the server has no logger.
+var Stderr = io.Writer(os.Stderr)
+
+// stderrLogger writes the records to Stderr.
+type stderrLogger struct {
+	mu sync.Mutex
+}
+
+func (l *stderrLogger) Log(level LogLevel, msg string, fields ...Field) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "[%d] %s [%s] %s", os.Getpid(), time.Now().Format("02 Jan 2006 15:04:05.000"), level, msg)
+	for _, f := range fields {
+		fmt.Fprintf(&b, " %s=%v", f.Key, f.Value)
+	}
+	b.WriteByte('\n')
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	fmt.Fprint(Stderr, b.String())
+}
+
+// slogLogger adapts a *slog.Logger.
+type slogLogger struct {
+	l *slog.Logger
+}
+
+// NewSlogLogger returns a Logger writing to l. Debug maps to slog's debug,
+// verbose to a level between debug and info, notice to info and warning
+// to warn.
+func NewSlogLogger(l *slog.Logger) Logger {
+	return slogLogger{l}
+}
+
+func (s slogLogger) Log(level LogLevel, msg string, fields ...Field) {
+	var slevel slog.Level
+	switch level {
+	case LevelDebug:
+		slevel = slog.LevelDebug
+	case LevelVerbose:
+		slevel = slog.LevelDebug + 2
+	case LevelNotice:
+		slevel = slog.LevelInfo
+	default:
+		slevel = slog.LevelWarn
+	}
+	attrs := make([]slog.Attr, 0, len(fields))
+	for _, f := range fields {
+		attrs = append(attrs, slog.Any(f.Key, f.Value))
+	}
+	s.l.LogAttrs(context.Background(), slevel, msg, attrs...)
+}
+
+// defaultLogger is the logger of the servers configured without one. It
+// discards the records, unless the DEBUG env is non empty.
+var defaultLogger Logger = nopLogger{}
+
+// defaultLogLevel is the loglevel of DefaultConfig.
+var defaultLogLevel = LevelNotice
+
+func init() {
+	if os.Getenv("DEBUG") != "" {
+		defaultLogger = &stderrLogger{}
+		defaultLogLevel = LevelDebug
+	}
+}
+
+// logs tells whether the records of level are logged, for callers to
+// skip building those which are not.
+func (srv *Server) logs(level LogLevel) bool {
+	return srv != nil && level >= srv.conf().logLevel
+}
+
+// log sends a record to the logger of the server, if level is enabled.
+func (srv *Server) log(level LogLevel, msg string, fields ...Field) {
+	if !srv.logs(level) {
+		return
+	}
+	c := srv.conf()
+	logger := c.logger
+	if logger == nil {
+		logger = defaultLogger
+	}
+	logger.Log(level, msg, fields...)
+}
+
+// clientLogger adds the fields of a connection to the records.
+type clientLogger struct {
+	srv    *Server
+	client *Client
+}
+
+func (l clientLogger) Log(level LogLevel, msg string, fields ...Field) {
+	c := l.client
+	l.srv.log(level, msg, append([]Field{
+		{"client", c.ID()},
+		{"addr", c.Addr()},
+		{"db", c.DB()},
+	}, fields...)...)
+}
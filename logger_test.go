@@ -0,0 +1,111 @@
+package redis
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type logRecord struct {
+	level  LogLevel
+	msg    string
+	fields []Field
+}
+
+// recordingLogger keeps the records it receives.
+type recordingLogger struct {
+	mu      sync.Mutex
+	records []logRecord
+}
+
+func (l *recordingLogger) Log(level LogLevel, msg string, fields ...Field) {
+	l.mu.Lock()
+	l.records = append(l.records, logRecord{level, msg, fields})
+	l.mu.Unlock()
+}
+
+// wait waits for a record with msg, and returns it.
+func (l *recordingLogger) wait(t *testing.T, msg string) logRecord {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		l.mu.Lock()
+		for _, r := range l.records {
+			if r.msg == msg {
+				l.mu.Unlock()
+				return r
+			}
+		}
+		l.mu.Unlock()
+	}
+	t.Fatalf("Expected a record %q", msg)
+	return logRecord{}
+}
+
+func (l *recordingLogger) count(msg string) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	n := 0
+	for _, r := range l.records {
+		if r.msg == msg {
+			n++
+		}
+	}
+	return n
+}
+
+func TestParseLogLevel(t *testing.T) {
+	for _, name := range []string{"debug", "verbose", "notice", "warning", "nothing"} {
+		level, err := ParseLogLevel(strings.ToUpper(name))
+		if err != nil || level.String() != name {
+			t.Fatalf("%s: got %v, %v", name, level, err)
+		}
+	}
+	if _, err := ParseLogLevel("info"); err == nil {
+		t.Fatal("Expected info to be rejected")
+	}
+}
+
+func TestLogger(t *testing.T) {
+	logger := &recordingLogger{}
+	srv, _ := startServer(t, DefaultConfig().Logger(logger).LogLevel(LevelVerbose))
+
+	_, r := dial(t, srv, "NOPE", "CONFIG SET loglevel debug", "SELECT 2", "NOPE")
+	expectLine(t, r, "-ERR unknown command 'nope', with args beginning with: ")
+	expectLine(t, r, "+OK")
+	expectLine(t, r, "+OK")
+	expectLine(t, r, "-ERR unknown command 'nope', with args beginning with: ")
+
+	accepted := logger.wait(t, "Accepted client")
+	expected := []Field{{"client", int64(1)}, {"addr", accepted.fields[1].Value}, {"db", 0}}
+	if accepted.level != LevelVerbose || len(accepted.fields) != 3 || accepted.fields[0] != expected[0] || accepted.fields[2] != expected[2] {
+		t.Fatalf("Unexpected record %+v", accepted)
+	}
+	created := logger.wait(t, "Created database")
+	if created.level != LevelDebug || created.fields[3] != (Field{"index", 2}) {
+		t.Fatalf("Unexpected record %+v", created)
+	}
+	if n := logger.count("Unknown command"); n != 1 {
+		t.Fatalf("Expected the unknown command to be logged once at debug level, got %d", n)
+	}
+
+	_, r = dial(t, srv, "CONFIG SET loglevel nothing", "QUIT")
+	expectLine(t, r, "+OK")
+	expectLine(t, r, "+OK")
+	time.Sleep(50 * time.Millisecond)
+	if n := logger.count("Client connection closed"); n != 0 {
+		t.Fatalf("Expected nothing logged, got %d records", n)
+	}
+}
+
+func TestSlogLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewSlogLogger(slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	logger.Log(LevelNotice, "hello", Field{"client", 1})
+	logger.Log(LevelWarning, "careful")
+	out := buf.String()
+	if !strings.Contains(out, "level=INFO msg=hello client=1") || !strings.Contains(out, "level=WARN msg=careful") {
+		t.Fatalf("Unexpected output %q", out)
+	}
+}
@@ -0,0 +1,84 @@
+package redis
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+)
+
+// MetricsHandler serves the statistics of the server in the Prometheus
+// text format: the calls, errors and latencies of the commands, the
+// connections, the connected and blocked clients and the size of the
+// databases. Config.MetricsAddr serves it on a listener of its own.
+func (srv *Server) MetricsHandler() http.Handler {
+	return http.HandlerFunc(srv.serveMetrics)
+}
+
+// MetricsAddr returns the address the metrics are served on, or an empty
+// string.
+func (srv *Server) MetricsAddr() string {
+	if srv.metricsListener == nil {
+		return ""
+	}
+	return srv.metricsListener.Addr().String()
+}
+
+func (srv *Server) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	b := bufio.NewWriter(w)
+	defer b.Flush()
+
+	metric := func(name, kind, help string) {
+		fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	}
+	names := srv.commandNames()
+
+	metric("redis_commands_total", "counter", "Calls of the command.")
+	for _, name := range names {
+		fmt.Fprintf(b, "redis_commands_total{cmd=%q} %d\n", name, atomic.LoadInt64(&srv.commandStats[name].calls))
+	}
+	metric("redis_command_errors_total", "counter", "Calls of the command replying an error.")
+	for _, name := range names {
+		fmt.Fprintf(b, "redis_command_errors_total{cmd=%q} %d\n", name, atomic.LoadInt64(&srv.commandStats[name].failed))
+	}
+	metric("redis_command_duration_seconds", "histogram", "Latency of the command.")
+	for _, name := range names {
+		s := srv.commandStats[name]
+		var count int64
+		for i, bound := range latencyBuckets {
+			count += atomic.LoadInt64(&s.buckets[i])
+			fmt.Fprintf(b, "redis_command_duration_seconds_bucket{cmd=%q,le=%q} %d\n",
+				name, strconv.FormatFloat(float64(bound)/1e6, 'g', -1, 64), count)
+		}
+		count += atomic.LoadInt64(&s.buckets[len(latencyBuckets)])
+		fmt.Fprintf(b, "redis_command_duration_seconds_bucket{cmd=%q,le=\"+Inf\"} %d\n", name, count)
+		fmt.Fprintf(b, "redis_command_duration_seconds_sum{cmd=%q} %g\n", name, float64(atomic.LoadInt64(&s.usec))/1e6)
+		fmt.Fprintf(b, "redis_command_duration_seconds_count{cmd=%q} %d\n", name, count)
+	}
+
+	connected, blocked, pubsub := srv.clientCounts()
+	metric("redis_connections_received_total", "counter", "Connections accepted.")
+	fmt.Fprintf(b, "redis_connections_received_total %d\n", atomic.LoadInt64(&srv.stats.connections))
+	metric("redis_rejected_connections_total", "counter", "Connections rejected.")
+	fmt.Fprintf(b, "redis_rejected_connections_total %d\n", atomic.LoadInt64(&srv.stats.rejected))
+	metric("redis_client_output_buffer_limit_disconnections_total", "counter", "Clients disconnected for exceeding their output buffer limit.")
+	fmt.Fprintf(b, "redis_client_output_buffer_limit_disconnections_total %d\n", atomic.LoadInt64(&srv.stats.outputLimitDisconnections))
+	metric("redis_connected_clients", "gauge", "Connected clients.")
+	fmt.Fprintf(b, "redis_connected_clients %d\n", connected)
+	metric("redis_blocked_clients", "gauge", "Clients blocked in a command.")
+	fmt.Fprintf(b, "redis_blocked_clients %d\n", blocked)
+	metric("redis_pubsub_clients", "gauge", "Clients subscribed to channels.")
+	fmt.Fprintf(b, "redis_pubsub_clients %d\n", pubsub)
+
+	keyspace := srv.keyspaceStats()
+	metric("redis_db_keys", "gauge", "Keys in the database.")
+	for _, db := range keyspace {
+		fmt.Fprintf(b, "redis_db_keys{db=\"db%d\"} %d\n", db.db, db.keys)
+	}
+	metric("redis_db_keys_expiring", "gauge", "Keys with a time to live in the database.")
+	for _, db := range keyspace {
+		fmt.Fprintf(b, "redis_db_keys_expiring{db=\"db%d\"} %d\n", db.db, db.expires)
+	}
+}
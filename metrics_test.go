@@ -0,0 +1,87 @@
+package redis
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestInfo(t *testing.T) {
+	srv, _ := startServer(t, DefaultConfig())
+
+	_, r := dial(t, srv, "SET a 1", "GET a", "INCR", "CLIENT ID", "SELECT 1", "SET b 2", "INFO", "INFO commandstats keyspace")
+	expectLine(t, r, "+OK")
+	expectLine(t, r, "$1")
+	expectLine(t, r, "1")
+	expectLine(t, r, "-ERR wrong number of arguments for 'incr' command")
+	expectLine(t, r, ":1")
+	expectLine(t, r, "+OK")
+	expectLine(t, r, "+OK")
+	info := readReply(t, r).(string)
+	for _, section := range []string{"# Server\r\n", "# Clients\r\n", "# Memory\r\n", "# Stats\r\n", "# Keyspace\r\n"} {
+		if !strings.Contains(info, section) {
+			t.Fatalf("Expected %q in %q", section, info)
+		}
+	}
+	if strings.Contains(info, "# Commandstats") || !strings.Contains(info, "connected_clients:1\r\n") {
+		t.Fatalf("Unexpected INFO %q", info)
+	}
+
+	info = readReply(t, r).(string)
+	for _, line := range []string{
+		"# Commandstats\r\n",
+		"cmdstat_set:calls=2,",
+		"cmdstat_client|id:calls=1,",
+		"cmdstat_incr:calls=0,usec=0,usec_per_call=0.00,rejected_calls=1,failed_calls=0\r\n",
+		"# Keyspace\r\ndb0:keys=1,expires=0,avg_ttl=0\r\ndb1:keys=1,expires=0,avg_ttl=0\r\n",
+	} {
+		if !strings.Contains(info, line) {
+			t.Fatalf("Expected %q in %q", line, info)
+		}
+	}
+	if strings.Contains(info, "# Server") {
+		t.Fatalf("Unexpected section in %q", info)
+	}
+
+	conn, r := dial(t, srv, "CONFIG RESETSTAT")
+	expectLine(t, r, "+OK")
+	conn.Write([]byte("INFO commandstats\r\n"))
+	info = readReply(t, r).(string)
+	if !strings.HasPrefix(info, "# Commandstats\r\ncmdstat_config|resetstat:calls=1,") || strings.Count(info, "cmdstat_") != 1 {
+		t.Fatalf("Expected the statistics to be reset, got %q", info)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	srv, _ := startServer(t, DefaultConfig().MetricsAddr("127.0.0.1:0"))
+	_, r := dial(t, srv, "SET a 1", "BRPOP list 0.01")
+	expectLine(t, r, "+OK")
+	expectLine(t, r, "*-1")
+
+	resp, err := http.Get("http://" + srv.MetricsAddr() + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"# TYPE redis_commands_total counter\n",
+		"redis_commands_total{cmd=\"set\"} 1\n",
+		"redis_command_errors_total{cmd=\"set\"} 0\n",
+		"redis_command_duration_seconds_bucket{cmd=\"brpop\",le=\"0.001\"} 0\n",
+		"redis_command_duration_seconds_bucket{cmd=\"brpop\",le=\"+Inf\"} 1\n",
+		"redis_command_duration_seconds_count{cmd=\"brpop\"} 1\n",
+		"redis_connections_received_total 1\n",
+		"redis_connected_clients 1\n",
+		"redis_blocked_clients 0\n",
+		"redis_db_keys{db=\"db0\"} 1\n",
+	} {
+		if !strings.Contains(string(body), line) {
+			t.Fatalf("Expected %q in %s", line, body)
+		}
+	}
+}
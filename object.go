@@ -0,0 +1,173 @@
+package redis
+
+import (
+	"time"
+)
+
+// The types of the values stored in a Database, as TYPE names them.
+const (
+	typeString = iota
+	typeHash
+	typeList
+	typeZset
+)
+
+var typeNames = []string{"string", "hash", "list", "zset"}
+
+var ErrWrongType = newErrorCode("WRONGTYPE", "Operation against a key holding the wrong kind of value")
+
+// object is the value of a key: a []byte, a HashValue, a *Stack or an
+// *OrderedSet, depending on its kind.
+type object struct {
+	kind  int
+	value interface{}
+
+	// expireAt is the unix time in milliseconds when the key expires,
+	// zero if it does not.
+	expireAt int64
+}
+
+// mstime returns the current unix time in milliseconds.
+func mstime() int64 {
+	return time.Now().UnixNano() / int64(time.Millisecond)
+}
+
+// expired tells whether o is expired at now, in milliseconds.
+func (o *object) expired(now int64) bool {
+	return o.expireAt != 0 && o.expireAt <= now
+}
+
+// lookup returns the object at key, nil if there is none or if it is
+// expired. Readers hold no write lock: Database.rlock removes the expired
+// keys they read once it releases the shard. The caller holds a lock on
+// the shard.
+func (s *shard) lookup(key string) *object {
+	o, exists := s.keys[key]
+	if !exists || o.expired(mstime()) {
+		return nil
+	}
+	return o
+}
+
+// get returns the object at key, nil if there is none. It fails with
+// ErrWrongType if the key holds another kind of value. The caller holds a
+// lock on the shard.
+func (s *shard) get(key string, kind int) (*object, error) {
+	o := s.lookup(key)
+	if o == nil {
+		return nil, nil
+	}
+	if o.kind != kind {
+		return nil, ErrWrongType
+	}
+	return o, nil
+}
+
+// create returns the object of kind at key, storing the value returned by
+// empty if there is none. The caller holds the write lock on the shard.
+func (s *shard) create(key string, kind int, empty func() interface{}) (*object, error) {
+	o, err := s.get(key, kind)
+	if err != nil || o != nil {
+		return o, err
+	}
+	o = &object{kind: kind, value: empty()}
+	s.put(key, o)
+	return o, nil
+}
+
+// str returns the string at key, nil if there is none.
+func (s *shard) str(key string) ([]byte, error) {
+	o, err := s.get(key, typeString)
+	if o == nil {
+		return nil, err
+	}
+	return o.value.([]byte), nil
+}
+
+// hash returns the hash at key. If there is none, it returns nil unless
+// create is set, in which case it stores an empty one.
+func (s *shard) hash(key string, create bool) (HashValue, error) {
+	var o *object
+	var err error
+	if create {
+		o, err = s.create(key, typeHash, func() interface{} { return make(HashValue) })
+	} else {
+		o, err = s.get(key, typeHash)
+	}
+	if o == nil {
+		return nil, err
+	}
+	return o.value.(HashValue), nil
+}
+
+// list is hash for lists.
+func (s *shard) list(key string, create bool) (*Stack, error) {
+	var o *object
+	var err error
+	if create {
+		o, err = s.create(key, typeList, func() interface{} { return NewStack(key) })
+	} else {
+		o, err = s.get(key, typeList)
+	}
+	if o == nil {
+		return nil, err
+	}
+	return o.value.(*Stack), nil
+}
+
+// zset is hash for sorted sets.
+func (s *shard) zset(key string, create bool) (*OrderedSet, error) {
+	var o *object
+	var err error
+	if create {
+		o, err = s.create(key, typeZset, func() interface{} { return NewOrderedSet() })
+	} else {
+		o, err = s.get(key, typeZset)
+	}
+	if o == nil {
+		return nil, err
+	}
+	return o.value.(*OrderedSet), nil
+}
+
+// set stores value as the string at key, replacing whatever the key held
+// along with its expiry. The caller holds the write lock on the shard.
+func (s *shard) set(key string, value []byte) *object {
+	o := &object{kind: typeString, value: value}
+	s.put(key, o)
+	return o
+}
+
+// put stores o at key, replacing whatever the key held. The caller holds
+// the write lock on the shard.
+func (s *shard) put(key string, o *object) {
+	s.keys[key] = o
+	if o.expireAt != 0 {
+		s.volatile[key] = o
+	} else {
+		delete(s.volatile, key)
+	}
+}
+
+// del removes key. The caller holds the write lock on the shard.
+func (s *shard) del(key string) {
+	delete(s.keys, key)
+	delete(s.volatile, key)
+}
+
+// expire sets when o, stored at key, expires: at, in milliseconds, or
+// never if at is zero. The caller holds the write lock on the shard.
+func (s *shard) expire(key string, o *object, at int64) {
+	o.expireAt = at
+	s.put(key, o)
+}
+
+// expireIfNeeded removes key if it is expired and tells whether it did.
+// The caller holds the write lock on the shard.
+func (s *shard) expireIfNeeded(key string, now int64) bool {
+	if o, exists := s.volatile[key]; exists && o.expired(now) {
+		s.del(key)
+		return true
+	}
+	return false
+}
@@ -0,0 +1,247 @@
+package redis
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Client classes of client-output-buffer-limit.
+const (
+	classNormal = iota
+	classReplica
+	classPubSub
+)
+
+var outputClassNames = []string{"normal", "replica", "pubsub"}
+
+// outputLimit is a class of client-output-buffer-limit: clients are
+// disconnected once their pending output reaches hard bytes, or stays
+// over soft bytes for longer than softFor. Zero disables a limit.
+type outputLimit struct {
+	hard, soft int64
+	softFor    time.Duration
+}
+
+var defaultOutputLimits = [...]outputLimit{
+	classNormal:  {},
+	classReplica: {256 << 20, 64 << 20, 60 * time.Second},
+	classPubSub:  {32 << 20, 8 << 20, 60 * time.Second},
+}
+
+// exceeded tells whether pending bytes are over the limit at now.
+// overSoft records when the soft limit was first exceeded.
+func (l outputLimit) exceeded(pending int64, overSoft *time.Time, now time.Time) bool {
+	if l.hard > 0 && pending >= l.hard {
+		return true
+	}
+	if l.soft == 0 || pending < l.soft {
+		*overSoft = time.Time{}
+		return false
+	}
+	if overSoft.IsZero() {
+		*overSoft = now
+	}
+	return now.Sub(*overSoft) > l.softFor
+}
+
+// parseOutputLimits parses the classes of client-output-buffer-limit,
+// "<class> <hard> <soft> <seconds>" repeated, into limits. Replica may be
+// spelled slave.
+func parseOutputLimits(limits []outputLimit, v string) error {
+	args := strings.Fields(v)
+	if len(args) == 0 || len(args)%4 != 0 {
+		return errors.New("Wrong number of arguments in buffer limit configuration.")
+	}
+	parsed := append([]outputLimit(nil), limits...)
+	for i := 0; i < len(args); i += 4 {
+		class := -1
+		for c, name := range outputClassNames {
+			if strings.EqualFold(args[i], name) {
+				class = c
+			}
+		}
+		if strings.EqualFold(args[i], "slave") {
+			class = classReplica
+		}
+		if class < 0 {
+			return errors.New("Invalid client class specified in buffer limit configuration.")
+		}
+		hard, err := parseMemory(args[i+1])
+		if err != nil {
+			return errors.New("Error in hard, soft or soft_seconds setting in buffer limit configuration.")
+		}
+		soft, err := parseMemory(args[i+2])
+		if err != nil {
+			return errors.New("Error in hard, soft or soft_seconds setting in buffer limit configuration.")
+		}
+		seconds, err := strconv.Atoi(args[i+3])
+		if err != nil || seconds < 0 {
+			return errors.New("Error in hard, soft or soft_seconds setting in buffer limit configuration.")
+		}
+		parsed[class] = outputLimit{hard, soft, time.Duration(seconds) * time.Second}
+	}
+	copy(limits, parsed)
+	return nil
+}
+
+func formatOutputLimits(limits []outputLimit) string {
+	var fields []string
+	for class, l := range limits {
+		fields = append(fields, outputClassNames[class],
+			strconv.FormatInt(l.hard, 10), strconv.FormatInt(l.soft, 10),
+			strconv.Itoa(int(l.softFor/time.Second)))
+	}
+	return strings.Join(fields, " ")
+}
+
+// queuedReply is a reply waiting in an outputQueue, with its size.
+type queuedReply struct {
+	reply ReplyWriter
+	size  int
+}
+
+// outputQueue holds the pub/sub messages or MONITOR lines waiting to be
+// written to a client. Queuing never waits for the client: the size of
+// the queue counts in its output buffer, and the client is disconnected
+// once over the limit of its class. The zero value is an empty queue.
+type outputQueue struct {
+	mu     sync.Mutex
+	client *Client
+	items  []queuedReply
+	ready  chan struct{}
+}
+
+// bind accounts the queue in the output buffer of client.
+func (q *outputQueue) bind(client *Client) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.client = client
+	for _, item := range q.items {
+		client.reserveOutput(item.size)
+	}
+}
+
+// readyChan receives once replies were queued.
+func (q *outputQueue) readyChan() <-chan struct{} {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.ready == nil {
+		q.ready = make(chan struct{}, 1)
+	}
+	return q.ready
+}
+
+// push queues reply, of about size bytes. It returns false if the client
+// was disconnected for exceeding its output buffer limit.
+func (q *outputQueue) push(reply ReplyWriter, size int) bool {
+	q.mu.Lock()
+	client := q.client
+	if client != nil && !client.reserveOutput(size) {
+		q.mu.Unlock()
+		return false
+	}
+	q.items = append(q.items, queuedReply{reply, size})
+	if q.ready == nil {
+		q.ready = make(chan struct{}, 1)
+	}
+	ready := q.ready
+	q.mu.Unlock()
+	select {
+	case ready <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// writeTo writes the queued replies to w, each with a single Write so
+// that concurrent queues never interleave, and flushes them.
+func (q *outputQueue) writeTo(w io.Writer) (int64, error) {
+	q.mu.Lock()
+	items, client := q.items, q.client
+	q.items = nil
+	q.mu.Unlock()
+	var n int64
+	for _, item := range items {
+		var b bytes.Buffer
+		if _, err := item.reply.WriteTo(NewProtocolWriter(&b, protocolOf(w))); err != nil {
+			return n, err
+		}
+		wrote, err := w.Write(b.Bytes())
+		n += int64(wrote)
+		client.releaseOutput(item.size)
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, flush(w)
+}
+
+// messageSize estimates the size of a pub/sub message.
+func messageSize(values []interface{}) int {
+	size := 16
+	for _, v := range values {
+		switch v := v.(type) {
+		case string:
+			size += len(v) + 16
+		case []byte:
+			size += len(v) + 16
+		default:
+			size += 16
+		}
+	}
+	return size
+}
+
+// outputClass returns the client-output-buffer-limit class of c.
+func (c *Client) outputClass() int {
+	if c.Flags()&ClientPubSub != 0 {
+		return classPubSub
+	}
+	return classNormal
+}
+
+// reserveOutput adds n bytes to the pending output of c. It returns
+// false, disconnecting c, once c is over the limit of its class.
+func (c *Client) reserveOutput(n int) bool {
+	if c.killed() {
+		return false
+	}
+	limit := c.srv.conf().outputLimits[c.outputClass()]
+	c.mu.Lock()
+	c.pendingOutput += int64(n)
+	over := limit.exceeded(c.pendingOutput, &c.overSoftLimit, time.Now())
+	c.mu.Unlock()
+	if over {
+		c.srv.outputLimitReached(c)
+		return false
+	}
+	return true
+}
+
+// releaseOutput removes n bytes written from the pending output of c.
+func (c *Client) releaseOutput(n int) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	c.pendingOutput -= int64(n)
+	c.mu.Unlock()
+}
+
+// outputLimitReached disconnects c, over its output buffer limit.
+func (srv *Server) outputLimitReached(c *Client) {
+	if !atomic.CompareAndSwapInt32(&c.closing, 0, 1) {
+		return
+	}
+	atomic.AddInt64(&srv.stats.outputLimitDisconnections, 1)
+	clientLogger{srv, c}.Log(LevelWarning, "Client closed for overcoming of output buffer limits",
+		Field{"class", outputClassNames[c.outputClass()]})
+	c.conn.Close()
+	c.disconnect()
+}
@@ -0,0 +1,79 @@
+package redis
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOutputLimitExceeded(t *testing.T) {
+	now := time.Now()
+	limit := outputLimit{hard: 100, soft: 50, softFor: time.Second}
+	var overSoft time.Time
+	for _, step := range []struct {
+		pending  int64
+		at       time.Duration
+		exceeded bool
+	}{
+		{10, 0, false},
+		{60, 0, false},
+		{60, 500 * time.Millisecond, false},
+		{40, 700 * time.Millisecond, false},
+		{60, 1200 * time.Millisecond, false},
+		{60, 2300 * time.Millisecond, true},
+		{100, 0, true},
+	} {
+		if exceeded := limit.exceeded(step.pending, &overSoft, now.Add(step.at)); exceeded != step.exceeded {
+			t.Fatalf("%d bytes at %v: expected %v", step.pending, step.at, step.exceeded)
+		}
+	}
+}
+
+func TestClientOutputBufferLimit(t *testing.T) {
+	srv, _ := startServer(t, DefaultConfig())
+
+	conn, r := dial(t, srv, "CONFIG SET client-output-buffer-limit \"pubsub 1mb 512kb 10\"", "CONFIG GET client-output-buffer-limit")
+	expectReply(t, r, "OK")
+	expectReply(t, r, []interface{}{"client-output-buffer-limit", "normal 0 0 0 replica 268435456 67108864 60 pubsub 1048576 524288 10"})
+
+	subscriber, err := net.Dial("tcp", srv.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer subscriber.Close()
+	subscriber.(*net.TCPConn).SetReadBuffer(4096)
+	subscriber.Write([]byte("SUBSCRIBE ch\r\n"))
+	waitSubscribed := time.Now().Add(5 * time.Second)
+	for {
+		conn.Write([]byte("PUBLISH ch hello\r\n"))
+		if n := readReply(t, r); n == int64(1) {
+			break
+		} else if time.Now().After(waitSubscribed) {
+			t.Fatal("Expected the client to subscribe")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The subscriber reads nothing until it is disconnected.
+	value := strings.Repeat("x", 100*1000)
+	for i := 0; ; i++ {
+		fmt.Fprintf(conn, "*3\r\n$7\r\nPUBLISH\r\n$2\r\nch\r\n$%d\r\n%s\r\n", len(value), value)
+		if n := readReply(t, r); n == int64(0) {
+			break
+		} else if i == 1000 {
+			t.Fatal("Expected the subscriber to be disconnected")
+		}
+	}
+	for deadline := time.Now().Add(5 * time.Second); len(srv.Clients()) != 1; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the subscriber to be closed")
+		}
+	}
+
+	conn.Write([]byte("INFO stats\r\n"))
+	if info := readReply(t, r).(string); !strings.Contains(info, "client_output_buffer_limit_disconnections:1\r\n") {
+		t.Fatalf("Expected a disconnection in %q", info)
+	}
+}
@@ -4,111 +4,506 @@ import (
 	"bufio"
 	"fmt"
 	"io"
-	"io/ioutil"
+	"math"
+	"math/big"
+	"strconv"
 	"strings"
 )
 
+const (
+	// DefaultProtoMaxBulkLen is the default size limit of a single argument,
+	// as redis' proto-max-bulk-len.
+	DefaultProtoMaxBulkLen = 512 * 1024 * 1024
+	// DefaultMaxArgs is the default limit of arguments in a single request.
+	DefaultMaxArgs = 1024 * 1024
+
+	// maxInlineLen bounds inline requests and protocol header lines.
+	maxInlineLen = 64 * 1024
+	// bulkChunk is how much of a large argument is allocated before its
+	// bytes actually arrive, so lying about a size costs the client, not us.
+	bulkChunk = 64 * 1024
+	// argsPrealloc caps the arguments slice allocated from a request header.
+	argsPrealloc = 1024
+)
+
+var (
+	errInvalidMultibulkLen = protocolError("invalid multibulk length")
+	errInvalidBulkLen      = protocolError("invalid bulk length")
+	errTooBigInline        = protocolError("too big inline request")
+	errTooBigBulkCount     = protocolError("too big bulk count string")
+	errExpectedCRLF        = protocolError("expected CRLF after bulk data")
+	errUnbalancedQuotes    = protocolError("unbalanced quotes in request")
+)
+
+func protocolError(message string) *ErrorReply {
+	return newErrorCode("ERR", "Protocol error: "+message)
+}
+
+// requestReader parses requests from a client connection. Lines are read
+// straight from the bufio buffer, and the scratch space for lines longer
+// than it is kept across requests.
+type requestReader struct {
+	r          *bufio.Reader
+	maxBulkLen int
+	maxArgs    int
+	line       []byte
+}
+
+func newRequestReader(r *bufio.Reader, maxBulkLen, maxArgs int) *requestReader {
+	if maxBulkLen <= 0 {
+		maxBulkLen = DefaultProtoMaxBulkLen
+	}
+	if maxArgs <= 0 {
+		maxArgs = DefaultMaxArgs
+	}
+	return &requestReader{r: r, maxBulkLen: maxBulkLen, maxArgs: maxArgs}
+}
+
 func parseRequest(r *bufio.Reader) (*Request, error) {
+	return newRequestReader(r, DefaultProtoMaxBulkLen, DefaultMaxArgs).readRequest()
+}
+
+// readRequest reads the next request. It returns io.EOF if the client went
+// away between two requests, and an *ErrorReply for protocol violations,
+// meant to be sent to the client before closing the connection.
+func (p *requestReader) readRequest() (*Request, error) {
 	// first line of redis request should be:
 	// *<number of arguments>CRLF
-	line, err := r.ReadString('\n')
-	if err != nil {
-		return nil, err
-	}
-	// note that this line also protects us from negative integers
 	var argsCount int
-
-	// Multiline request:
-	if line[0] == '*' {
-		if _, err := fmt.Sscanf(line, "*%d\r\n", &argsCount); err != nil {
-			return nil, malformed("*<numberOfArguments>", line)
-		}
-		// All next lines are pairs of:
-		//$<number of bytes of argument 1> CR LF
-		//<argument data> CR LF
-		// first argument is a command name, so just convert
-		firstArg, err := readArgument(r)
+	for {
+		line, err := p.readLine(errTooBigInline)
 		if err != nil {
 			return nil, err
 		}
-
-		args := make([][]byte, argsCount-1)
-		for i := 0; i < argsCount-1; i += 1 {
-			if args[i], err = readArgument(r); err != nil {
-				return nil, err
+		if len(line) > 0 && line[0] == '*' {
+			var ok bool
+			argsCount, ok = parseInt(line[1:])
+			if !ok || argsCount > p.maxArgs {
+				return nil, errInvalidMultibulkLen
 			}
+			if argsCount <= 0 {
+				// Empty multibulks are ignored, as redis does.
+				continue
+			}
+			break
 		}
 
+		// Inline request:
+		fields, err := splitArgs(line)
+		if err != nil {
+			return nil, err
+		}
+		if len(fields) == 0 {
+			// Blank lines are ignored, as redis does.
+			continue
+		}
+		var args [][]byte
+		if len(fields) > 1 {
+			args = fields[1:]
+		}
 		return &Request{
-			Name: strings.ToLower(string(firstArg)),
+			Name: strings.ToLower(string(fields[0])),
 			Args: args,
 		}, nil
 	}
 
-	// Inline request:
-	fields := strings.Split(strings.Trim(line, "\r\n"), " ")
+	// Multiline request:
+	// All next lines are pairs of:
+	//$<number of bytes of argument 1> CR LF
+	//<argument data> CR LF
+	// first argument is a command name, so just convert
+	firstArg, err := p.readArgument()
+	if err != nil {
+		return nil, err
+	}
 
 	var args [][]byte
-	if len(fields) > 1 {
-		for _, arg := range fields[1:] {
-			args = append(args, []byte(arg))
+	if argsCount > 1 {
+		n := argsCount - 1
+		if n > argsPrealloc {
+			n = argsPrealloc
+		}
+		args = make([][]byte, 0, n)
+	}
+	for i := 1; i < argsCount; i++ {
+		arg, err := p.readArgument()
+		if err != nil {
+			return nil, err
 		}
+		args = append(args, arg)
 	}
+
 	return &Request{
-		Name: strings.ToLower(string(fields[0])),
+		Name: strings.ToLower(string(firstArg)),
 		Args: args,
 	}, nil
-
 }
 
-func readArgument(r *bufio.Reader) ([]byte, error) {
-
-	line, err := r.ReadString('\n')
+// readArgument reads a $<size>CRLF<data>CRLF bulk string. Its data is
+// always a fresh slice, as handlers are free to keep arguments around.
+func (p *requestReader) readArgument() ([]byte, error) {
+	line, err := p.readLine(errTooBigBulkCount)
 	if err != nil {
-		return nil, malformed("$<argumentLength>", line)
+		return nil, unexpectedEOF(err)
 	}
-	var argSize int
-	if _, err := fmt.Sscanf(line, "$%d\r\n", &argSize); err != nil {
-		return nil, malformed("$<argumentSize>", line)
+	if len(line) == 0 || line[0] != '$' {
+		got := "\\n"
+		if len(line) > 0 {
+			got = string(line[:1])
+		}
+		return nil, protocolError("expected '$', got '" + got + "'")
 	}
+	size, ok := parseInt(line[1:])
+	if !ok || size < 0 || size > p.maxBulkLen {
+		return nil, errInvalidBulkLen
+	}
+	return p.readBulk(size)
+}
+
+// readBulk reads size bytes of bulk data and their trailing CRLF.
+func (p *requestReader) readBulk(size int) ([]byte, error) {
+	n := size
+	if n > bulkChunk {
+		n = bulkChunk
+	}
+	data := make([]byte, 0, n)
+	for len(data) < size {
+		n := size - len(data)
+		if n > bulkChunk {
+			n = bulkChunk
+		}
+		if cap(data)-len(data) < n {
+			c := 2 * cap(data)
+			if c > size {
+				c = size
+			}
+			grown := make([]byte, len(data), c)
+			copy(grown, data)
+			data = grown
+		}
+		if _, err := io.ReadFull(p.r, data[len(data):len(data)+n]); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		data = data[:len(data)+n]
+	}
+
+	// Now check for trailing CRLF
+	for _, c := range []byte("\r\n") {
+		b, err := p.r.ReadByte()
+		if err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		if b != c {
+			return nil, errExpectedCRLF
+		}
+	}
+	return data, nil
+}
 
-	// I think int is safe here as the max length of request
-	// should be less then max int value?
-	data, err := ioutil.ReadAll(io.LimitReader(r, int64(argSize)))
+// readLine returns the next line, without its line ending. The returned
+// slice is only valid until the next read. Lines longer than maxInlineLen
+// fail with tooBig.
+func (p *requestReader) readLine(tooBig error) ([]byte, error) {
+	line, err := p.r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		p.line = append(p.line[:0], line...)
+		for err == bufio.ErrBufferFull {
+			if len(p.line) > maxInlineLen {
+				return nil, tooBig
+			}
+			line, err = p.r.ReadSlice('\n')
+			p.line = append(p.line, line...)
+		}
+		line = p.line
+	}
 	if err != nil {
+		if err == io.EOF && len(line) > 0 {
+			return nil, io.ErrUnexpectedEOF
+		}
 		return nil, err
 	}
+	if len(line) > maxInlineLen {
+		return nil, tooBig
+	}
+	line = line[:len(line)-1]
+	if len(line) > 0 && line[len(line)-1] == '\r' {
+		line = line[:len(line)-1]
+	}
+	return line, nil
+}
 
-	if len(data) != argSize {
-		return nil, malformedLength(argSize, len(data))
+// splitArgs splits an inline request into arguments the way redis-cli and
+// redis' sdssplitargs do: arguments are separated by any amount of white
+// space, may be "double quoted", with C-like and \xHH escapes, or 'single
+// quoted', where only \' is an escape. A closing quote must be followed by
+// white space or the end of the line.
+func splitArgs(line []byte) ([][]byte, error) {
+	var args [][]byte
+	i := 0
+	for {
+		for i < len(line) && isSpace(line[i]) {
+			i++
+		}
+		if i == len(line) {
+			return args, nil
+		}
+
+		var arg []byte
+		inq, insq := false, false
+		for done := false; !done; {
+			switch {
+			case inq:
+				if i == len(line) {
+					return nil, errUnbalancedQuotes
+				}
+				c := line[i]
+				switch {
+				case c == '\\' && i+3 < len(line) && line[i+1] == 'x' &&
+					isHexDigit(line[i+2]) && isHexDigit(line[i+3]):
+					arg = append(arg, hexDigit(line[i+2])<<4|hexDigit(line[i+3]))
+					i += 3
+				case c == '\\' && i+1 < len(line):
+					i++
+					switch line[i] {
+					case 'n':
+						c = '\n'
+					case 'r':
+						c = '\r'
+					case 't':
+						c = '\t'
+					case 'b':
+						c = '\b'
+					case 'a':
+						c = '\a'
+					default:
+						c = line[i]
+					}
+					arg = append(arg, c)
+				case c == '"':
+					// closing quote must be followed by a space or
+					// nothing at all.
+					if i+1 < len(line) && !isSpace(line[i+1]) {
+						return nil, errUnbalancedQuotes
+					}
+					done = true
+				default:
+					arg = append(arg, c)
+				}
+			case insq:
+				if i == len(line) {
+					return nil, errUnbalancedQuotes
+				}
+				c := line[i]
+				switch {
+				case c == '\\' && i+1 < len(line) && line[i+1] == '\'':
+					i++
+					arg = append(arg, '\'')
+				case c == '\'':
+					if i+1 < len(line) && !isSpace(line[i+1]) {
+						return nil, errUnbalancedQuotes
+					}
+					done = true
+				default:
+					arg = append(arg, c)
+				}
+			default:
+				if i == len(line) {
+					done = true
+					break
+				}
+				switch c := line[i]; {
+				case isSpace(c):
+					done = true
+				case c == '"':
+					inq = true
+				case c == '\'':
+					insq = true
+				default:
+					arg = append(arg, c)
+				}
+			}
+			if i < len(line) {
+				i++
+			}
+		}
+		if arg == nil {
+			arg = []byte{}
+		}
+		args = append(args, arg)
 	}
+}
 
-	// Now check for trailing CR
-	if b, err := r.ReadByte(); err != nil || b != '\r' {
-		return nil, malformedMissingCRLF()
+func isSpace(c byte) bool {
+	switch c {
+	case ' ', '\t', '\n', '\r', '\v', '\f':
+		return true
 	}
+	return false
+}
 
-	// And LF
-	if b, err := r.ReadByte(); err != nil || b != '\n' {
-		return nil, malformedMissingCRLF()
+func isHexDigit(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+func hexDigit(c byte) byte {
+	switch {
+	case c >= 'a':
+		return c - 'a' + 10
+	case c >= 'A':
+		return c - 'A' + 10
 	}
+	return c - '0'
+}
 
-	return data, nil
+// parseInt parses a decimal integer without allocating. It only accepts
+// what redis would send: an optional minus sign followed by digits.
+func parseInt(b []byte) (int, bool) {
+	neg := false
+	if len(b) > 0 && b[0] == '-' {
+		neg, b = true, b[1:]
+	}
+	if len(b) == 0 || len(b) > 18 {
+		return 0, false
+	}
+	n := 0
+	for _, c := range b {
+		if c < '0' || c > '9' {
+			return 0, false
+		}
+		n = n*10 + int(c-'0')
+	}
+	if neg {
+		n = -n
+	}
+	return n, true
 }
 
-func malformed(expected string, got string) error {
-	Debugf("Malformed request: %q does not match %q\n", got, expected)
-	return fmt.Errorf("Malformed request: %q does not match %q\r\n",
-		got, expected)
+// ReplyReader decodes the RESP2 and RESP3 values sent by a redis server.
+type ReplyReader struct {
+	p *requestReader
 }
 
-func malformedLength(expected int, got int) error {
-	return fmt.Errorf(
-		"Malformed request: argument length %d does not match %d\r\n",
-		got, expected)
+func NewReplyReader(r *bufio.Reader) *ReplyReader {
+	return &ReplyReader{p: newRequestReader(r, DefaultProtoMaxBulkLen, math.MaxInt32)}
 }
 
-func malformedMissingCRLF() error {
-	return fmt.Errorf("Malformed request: line should end with %q\r\n",
-		"\r\n")
+// ReadReply reads the next value. Simple strings are returned as string,
+// errors as *ErrorReply, integers as int64, bulk and verbatim strings as
+// []byte, arrays, sets and pushes as []interface{}, maps as
+// map[string]interface{}, doubles as float64, booleans as bool, big numbers
+// as *big.Int and nulls as nil. Attributes are skipped.
+func (rr *ReplyReader) ReadReply() (interface{}, error) {
+	p := rr.p
+	line, err := p.readLine(errTooBigInline)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, protocolError("empty reply line")
+	}
+	body := line[1:]
+	switch line[0] {
+	case '+':
+		return string(body), nil
+	case '-':
+		code, message := string(body), ""
+		if i := strings.IndexByte(code, ' '); i >= 0 {
+			code, message = code[:i], code[i+1:]
+		}
+		return newErrorCode(code, message), nil
+	case ':':
+		// Unlike request lengths, integer replies span the whole int64 range.
+		n, err := strconv.ParseInt(string(body), 10, 64)
+		if err != nil {
+			return nil, protocolError("invalid integer " + strconv.Quote(string(body)))
+		}
+		return n, nil
+	case '_':
+		return nil, nil
+	case '#':
+		switch string(body) {
+		case "t":
+			return true, nil
+		case "f":
+			return false, nil
+		}
+		return nil, protocolError("invalid boolean " + strconv.Quote(string(body)))
+	case ',':
+		f, err := strconv.ParseFloat(string(body), 64)
+		if err != nil {
+			return nil, protocolError("invalid double " + strconv.Quote(string(body)))
+		}
+		return f, nil
+	case '(':
+		n, ok := new(big.Int).SetString(string(body), 10)
+		if !ok {
+			return nil, protocolError("invalid big number " + strconv.Quote(string(body)))
+		}
+		return n, nil
+	case '$', '=':
+		size, ok := parseInt(body)
+		if !ok || size < -1 || size > p.maxBulkLen {
+			return nil, errInvalidBulkLen
+		}
+		if size == -1 {
+			return nil, nil
+		}
+		data, err := p.readBulk(size)
+		if err != nil {
+			return nil, err
+		}
+		if line[0] == '=' && len(data) >= 4 {
+			// Drop the format prefix, such as "txt:".
+			data = data[4:]
+		}
+		return data, nil
+	case '*', '~', '>', '%', '|':
+		count, ok := parseInt(body)
+		if !ok || count < -1 || count > p.maxArgs {
+			return nil, errInvalidMultibulkLen
+		}
+		if count == -1 {
+			return nil, nil
+		}
+		if line[0] == '%' || line[0] == '|' {
+			count *= 2
+		}
+		n := count
+		if n > argsPrealloc {
+			n = argsPrealloc
+		}
+		values := make([]interface{}, 0, n)
+		for i := 0; i < count; i++ {
+			v, err := rr.ReadReply()
+			if err != nil {
+				return nil, unexpectedEOF(err)
+			}
+			values = append(values, v)
+		}
+		switch line[0] {
+		case '|':
+			// Attributes only decorate the reply that follows.
+			return rr.ReadReply()
+		case '%':
+			m := make(map[string]interface{}, len(values)/2)
+			for i := 0; i < len(values); i += 2 {
+				key, ok := values[i].([]byte)
+				if !ok {
+					key = []byte(fmt.Sprint(values[i]))
+				}
+				m[string(key)] = values[i+1]
+			}
+			return m, nil
+		}
+		return values, nil
+	}
+	return nil, protocolError("unexpected reply type '" + string(line[:1]) + "'")
+}
+
+// unexpectedEOF reports a client going away in the middle of a request.
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
 }
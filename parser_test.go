@@ -3,8 +3,10 @@ package redis
 import (
 	"bufio"
 	"bytes"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"strconv"
 	"strings"
 	"testing"
 )
@@ -44,6 +46,39 @@ func TestParseBadRequests(t *testing.T) {
 	}
 }
 
+func TestParseLimits(t *testing.T) {
+	requests := []struct {
+		s        string
+		expected string
+	}{
+		{"*3\r\n$3\r\nget\r\n$1\r\nx\r\n$1\r\ny\r\n", "-ERR Protocol error: invalid multibulk length\r\n"},
+		{"*2\r\n$3\r\nget\r\n$11\r\nhello world\r\n", "-ERR Protocol error: invalid bulk length\r\n"},
+		{"*1\r\n$-1\r\n", "-ERR Protocol error: invalid bulk length\r\n"},
+		{"*1\r\n:3\r\nget\r\n", "-ERR Protocol error: expected '$', got ':'\r\n"},
+		{"*1\r\n$3\r\ngetxx", "-ERR Protocol error: expected CRLF after bulk data\r\n"},
+		{strings.Repeat("a", maxInlineLen+1) + "\r\n", "-ERR Protocol error: too big inline request\r\n"},
+	}
+	for _, v := range requests {
+		reader := newRequestReader(bufio.NewReader(strings.NewReader(v.s)), 10, 2)
+		_, err := reader.readRequest()
+		perr, ok := err.(*ErrorReply)
+		if !ok {
+			t.Fatalf("Expected protocol error for request %q, got %v", v.s, err)
+		}
+		reply, _ := ReplyToString(perr)
+		if reply != v.expected {
+			t.Fatalf("Expected %q for request %q, got %q", v.expected, v.s, reply)
+		}
+	}
+
+	// A client announcing a huge argument it never sends must not
+	// make us allocate it.
+	reader := newRequestReader(bufio.NewReader(strings.NewReader("*1\r\n$500000000\r\nx")), 0, 0)
+	if _, err := reader.readRequest(); err != io.ErrUnexpectedEOF {
+		t.Fatalf("Expected unexpected EOF, got %v", err)
+	}
+}
+
 func TestSucess(t *testing.T) {
 	expected := []struct {
 		r Request
@@ -53,27 +88,102 @@ func TestSucess(t *testing.T) {
 		{Request{Name: "get"}, "*1\r\n$3\r\ngEt\r\n"},
 		{Request{Name: "get", Args: b("x")}, "*2\r\n$3\r\ngEt\r\n$1\r\nx\r\n"},
 		{Request{Name: "set", Args: b("mykey", "myvalue")}, "*3\r\n$3\r\nSET\r\n$5\r\nmykey\r\n$7\r\nmyvalue\r\n"},
+		// Empty multibulks are skipped.
+		{Request{Name: "ping"}, "*0\r\n*-1\r\n*1\r\n$4\r\nping\r\n"},
 	}
 
 	for _, p := range expected {
 		request, err := parseRequest(bufio.NewReader(strings.NewReader(p.s)))
 		if err != nil {
-			t.Fatalf("Un xxpected eror %s when parsting", err, p.s)
+			t.Fatalf("Un xxpected eror %s when parsting %q", err, p.s)
 		}
 		if request.Name != p.r.Name {
-			t.Fatalf("Expected command %s, got %s", err, p.r.Name, request.Name)
+			t.Fatalf("Expected command %s, got %s", p.r.Name, request.Name)
 		}
 		if len(request.Args) != len(p.r.Args) {
-			t.Fatalf("Args length mismatch %s, got %s", err, p.r.Args, request.Args)
+			t.Fatalf("Args length mismatch %s, got %s", p.r.Args, request.Args)
 		}
 		for i := 0; i < len(request.Args); i += 1 {
 			if !bytes.Equal(request.Args[i], p.r.Args[i]) {
-				t.Fatalf("Expected args %s, got %s", err, p.r.Args, request.Args)
+				t.Fatalf("Expected args %s, got %s", p.r.Args, request.Args)
 			}
 		}
 	}
 }
 
+func TestParseLongArgument(t *testing.T) {
+	arg := strings.Repeat("x", 3*bulkChunk+5)
+	request, err := parseRequest(r("*2\r\n$3\r\nset\r\n$" + strconv.Itoa(len(arg)) + "\r\n" + arg + "\r\n"))
+	if err != nil {
+		t.Fatalf("Unexpected error %s when parsing", err)
+	}
+	if string(request.Args[0]) != arg {
+		t.Fatalf("Argument of %d bytes mangled into %d bytes", len(arg), len(request.Args[0]))
+	}
+}
+
+func TestParseInline(t *testing.T) {
+	expected := []struct {
+		s    string
+		name string
+		args [][]byte
+	}{
+		{"PING\r\n", "ping", nil},
+		{"set k \"hello world\"\r\n", "set", b("k", "hello world")},
+		{"  set \t k   v  \n", "set", b("k", "v")},
+		{"set k \"\\x41\\x4a\\n\\\"\"\r\n", "set", b("k", "AJ\n\"")},
+		{"set k 'it\\'s \\n'\r\n", "set", b("k", "it's \\n")},
+		{"set k \"\"\r\n", "set", b("k", "")},
+		{"set k a\"b c\"\r\n", "set", b("k", "ab c")},
+		{"\r\n\r\nget k\r\n", "get", b("k")},
+	}
+	for _, p := range expected {
+		request, err := parseRequest(r(p.s))
+		if err != nil {
+			t.Fatalf("Unexpected error %s when parsing %q", err, p.s)
+		}
+		if request.Name != p.name {
+			t.Fatalf("Expected command %s, got %s", p.name, request.Name)
+		}
+		if len(request.Args) != len(p.args) {
+			t.Fatalf("Expected args %q, got %q for %q", p.args, request.Args, p.s)
+		}
+		for i := range request.Args {
+			if !bytes.Equal(request.Args[i], p.args[i]) {
+				t.Fatalf("Expected args %q, got %q for %q", p.args, request.Args, p.s)
+			}
+		}
+	}
+
+	for _, v := range []string{"set k \"v\r\n", "set k 'v\r\n", "set k \"v\"x\r\n", "set k 'v'x\r\n"} {
+		_, err := parseRequest(r(v))
+		if err != errUnbalancedQuotes {
+			t.Fatalf("Expected unbalanced quotes for %q, got %v", v, err)
+		}
+	}
+}
+
+func TestReadReply(t *testing.T) {
+	rr := NewReplyReader(r("+OK\r\n-ERR oops\r\n:-42\r\n$-1\r\n$0\r\n\r\n*2\r\n$1\r\na\r\n_\r\n" +
+		"%1\r\n$1\r\nk\r\n#t\r\n,1.5\r\n(12345678901234567890\r\n=6\r\ntxt:hi\r\n|1\r\n+ttl\r\n:3\r\n:7\r\n"))
+	expected := []string{
+		"OK", "-ERR oops\r\n", "-42", "<nil>", "[]", "[[97] <nil>]",
+		"map[k:true]", "1.5", "12345678901234567890", "[104 105]", "7",
+	}
+	for _, e := range expected {
+		v, err := rr.ReadReply()
+		if err != nil {
+			t.Fatalf("Unexpected error %s", err)
+		}
+		if got := fmt.Sprint(v); got != e {
+			t.Fatalf("Expected %s, got %s", e, got)
+		}
+	}
+	if _, err := rr.ReadReply(); err != io.EOF {
+		t.Fatalf("Expected EOF, got %v", err)
+	}
+}
+
 func TestPipielines(t *testing.T) {
 	chain := strings.Repeat("*2\r\n$3\r\ngEt\r\n$1\r\nx\r\n", 10)
 	reader := bufio.NewReader(strings.NewReader(chain))
@@ -3,13 +3,81 @@ package redis
 import (
 	"bytes"
 	"errors"
+	"fmt"
 	"io"
-	"reflect"
+	"math"
+	"math/big"
+	"sort"
 	"strconv"
+	"sync"
 )
 
 type ReplyWriter io.WriterTo
 
+// Protocol versions a client can negotiate with HELLO.
+const (
+	RESP2 = 2
+	RESP3 = 3
+)
+
+// protocolWriter tags an io.Writer with the protocol version negotiated by
+// the client, so replies can pick their encoding while being written.
+type protocolWriter struct {
+	io.Writer
+	proto int
+}
+
+// NewProtocolWriter returns a writer that makes replies written to it use the
+// encoding of the given protocol version.
+func NewProtocolWriter(w io.Writer, proto int) io.Writer {
+	if pw, ok := w.(*protocolWriter); ok {
+		w = pw.Writer
+	}
+	return &protocolWriter{Writer: w, proto: proto}
+}
+
+// flush pushes out what was buffered by w, if it buffers at all. Streaming
+// replies call it after every message, as the connection only flushes on
+// its own once the reply is complete.
+func flush(w io.Writer) error {
+	if pw, ok := w.(*protocolWriter); ok {
+		w = pw.Writer
+	}
+	if f, ok := w.(interface {
+		Flush() error
+	}); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+// syncWriter serializes writes from the goroutines of a MultiChannelWriter.
+type syncWriter struct {
+	sync.Mutex
+	w io.Writer
+}
+
+func (s *syncWriter) Write(p []byte) (int, error) {
+	s.Lock()
+	defer s.Unlock()
+	return s.w.Write(p)
+}
+
+func (s *syncWriter) Flush() error {
+	s.Lock()
+	defer s.Unlock()
+	return flush(s.w)
+}
+
+// protocolOf returns the protocol version replies written to w should use.
+// Anything not wrapped by NewProtocolWriter speaks RESP2.
+func protocolOf(w io.Writer) int {
+	if pw, ok := w.(*protocolWriter); ok && pw.proto == RESP3 {
+		return RESP3
+	}
+	return RESP2
+}
+
 type StatusReply struct {
 	Code string
 }
@@ -39,10 +107,11 @@ type BulkReply struct {
 func writeBytes(value interface{}, w io.Writer) (int64, error) {
 	//it's a NullBulkReply
 	if value == nil {
-		n, err := w.Write([]byte("$-1\r\n"))
-		return int64(n), err
+		return writeNull(w)
 	}
 	switch v := value.(type) {
+	case ReplyWriter:
+		return v.WriteTo(w)
 	case []interface{}:
 		if len(v) == 0 {
 			n, err := w.Write([]byte("*0\r\n"))
@@ -53,8 +122,7 @@ func writeBytes(value interface{}, w io.Writer) (int64, error) {
 
 	case string:
 		if len(v) == 0 {
-			n, err := w.Write([]byte("$-1\r\n"))
-			return int64(n), err
+			return writeNull(w)
 		}
 		wrote, err := w.Write([]byte("$" + strconv.Itoa(len(v)) + "\r\n"))
 		if err != nil {
@@ -68,8 +136,7 @@ func writeBytes(value interface{}, w io.Writer) (int64, error) {
 		return int64(wrote + wroteBytes + wroteCrLf), err
 	case []byte:
 		if len(v) == 0 {
-			n, err := w.Write([]byte("$-1\r\n"))
-			return int64(n), err
+			return writeNull(w)
 		}
 		wrote, err := w.Write([]byte("$" + strconv.Itoa(len(v)) + "\r\n"))
 		if err != nil {
@@ -87,10 +154,17 @@ func writeBytes(value interface{}, w io.Writer) (int64, error) {
 			return int64(wrote), err
 		}
 		return int64(wrote), err
+
+	case int64:
+		n, err := w.Write([]byte(":" + strconv.FormatInt(v, 10) + "\r\n"))
+		return int64(n), err
+	case bool:
+		return (&BooleanReply{value: v}).WriteTo(w)
+	case float64:
+		return (&DoubleReply{value: v}).WriteTo(w)
 	}
 
-	Debugf("Invalid type sent to writeBytes: %v", reflect.TypeOf(value).Name())
-	return 0, errors.New("Invalid type sent to writeBytes")
+	return 0, fmt.Errorf("Invalid type sent to writeBytes: %T", value)
 }
 
 func (r *BulkReply) WriteTo(w io.Writer) (int64, error) {
@@ -98,22 +172,36 @@ func (r *BulkReply) WriteTo(w io.Writer) (int64, error) {
 }
 
 type MonitorReply struct {
-	c <-chan string
+	queue outputQueue
+	done  <-chan struct{}
+}
+
+// feed queues a line for the monitor. It returns false once the monitor
+// is gone.
+func (r *MonitorReply) feed(line string) bool {
+	select {
+	case <-r.done:
+		return false
+	default:
+	}
+	return r.queue.push(&StatusReply{Code: line}, len(line)+3)
 }
 
 func (r *MonitorReply) WriteTo(w io.Writer) (int64, error) {
-	statusReply := &StatusReply{}
 	totalBytes := int64(0)
-	for line := range r.c {
-		statusReply.Code = line
-		if n, err := statusReply.WriteTo(w); err != nil {
-			totalBytes += n
-			return int64(totalBytes), err
-		} else {
-			totalBytes += n
+	ready := r.queue.readyChan()
+	for {
+		select {
+		case <-r.done:
+			return totalBytes, nil
+		case <-ready:
+		}
+		n, err := r.queue.writeTo(w)
+		totalBytes += n
+		if err != nil {
+			return totalBytes, err
 		}
 	}
-	return totalBytes, nil
 }
 
 //for nil reply in multi bulk just set []byte as nil
@@ -121,10 +209,17 @@ type MultiBulkReply struct {
 	values []interface{}
 }
 
+// MultiBulkFromMap flattens m into key/value pairs, sorted by key.
 func MultiBulkFromMap(m map[string]interface{}) *MultiBulkReply {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
 	values := make([]interface{}, len(m)*2)
 	i := 0
-	for key, val := range m {
+	for _, key := range keys {
+		val := m[key]
 		values[i] = []byte(key)
 		switch v := val.(type) {
 		case string:
@@ -143,7 +238,13 @@ func writeMultiBytes(values []interface{}, w io.Writer) (int64, error) {
 	if values == nil {
 		return 0, errors.New("Nil in multi bulk replies are not ok")
 	}
-	wrote, err := w.Write([]byte("*" + strconv.Itoa(len(values)) + "\r\n"))
+	return writeAggregate('*', len(values), values, w)
+}
+
+// writeAggregate writes an aggregate header announcing count elements,
+// followed by every value in values.
+func writeAggregate(kind byte, count int, values []interface{}, w io.Writer) (int64, error) {
+	wrote, err := w.Write([]byte(string(kind) + strconv.Itoa(count) + "\r\n"))
 	if err != nil {
 		return int64(wrote), err
 	}
@@ -178,15 +279,17 @@ type MultiChannelWriter struct {
 
 func (c *MultiChannelWriter) WriteTo(w io.Writer) (n int64, err error) {
 	chans := make(chan struct{}, len(c.Chans))
+	sw := &syncWriter{w: w}
+	pw := NewProtocolWriter(sw, protocolOf(w))
 	for _, elem := range c.Chans {
 		go func(elem io.WriterTo) {
 			defer func() { chans <- struct{}{} }()
-			if n2, err2 := elem.WriteTo(w); err2 != nil {
-				n += n2
+			n2, err2 := elem.WriteTo(pw)
+			sw.Lock()
+			defer sw.Unlock()
+			n += n2
+			if err2 != nil {
 				err = err2
-				return
-			} else {
-				n += n2
 			}
 		}(elem)
 	}
@@ -196,27 +299,77 @@ func (c *MultiChannelWriter) WriteTo(w io.Writer) (n int64, err error) {
 	return n, err
 }
 
+// ChannelWriter streams the messages of a subscription. Handlers deliver
+// them with Deliver, which never waits for the subscriber, or send them
+// to Channel, which does.
 type ChannelWriter struct {
 	FirstReply []interface{}
 	Channel    chan []interface{}
 	clientChan chan struct{}
+	done       <-chan struct{}
+	queue      outputQueue
+}
+
+// Deliver queues a message for the subscriber, without waiting for it to
+// be written. It returns false if the subscriber is gone, or was
+// disconnected for exceeding its output buffer limit.
+func (c *ChannelWriter) Deliver(values ...interface{}) bool {
+	if c.closed() {
+		return false
+	}
+	return c.queue.push(&PushReply{values: values}, messageSize(values))
+}
+
+// closed tells whether the subscriber is gone.
+func (c *ChannelWriter) closed() bool {
+	select {
+	case <-c.clientChan:
+		return true
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// writeMessage writes a whole pub/sub message with a single Write, so
+// messages of concurrent channels never interleave, and flushes it.
+func writeMessage(values []interface{}, w io.Writer) (int64, error) {
+	var b bytes.Buffer
+	if _, err := (&PushReply{values: values}).WriteTo(NewProtocolWriter(&b, protocolOf(w))); err != nil {
+		return 0, err
+	}
+	n, err := w.Write(b.Bytes())
+	if err != nil {
+		return int64(n), err
+	}
+	return int64(n), flush(w)
 }
 
 func (c *ChannelWriter) WriteTo(w io.Writer) (int64, error) {
-	totalBytes, err := writeMultiBytes(c.FirstReply, w)
+	totalBytes, err := writeMessage(c.FirstReply, w)
 	if err != nil {
 		return totalBytes, err
 	}
 
+	ready := c.queue.readyChan()
 	for {
 		select {
 		case <-c.clientChan:
 			return totalBytes, err
+		case <-c.done:
+			return totalBytes, err
+		case <-ready:
+			wroteBytes, err := c.queue.writeTo(w)
+			totalBytes += wroteBytes
+			if err != nil {
+				return totalBytes, err
+			}
 		case reply := <-c.Channel:
 			if reply == nil {
 				return totalBytes, nil
 			} else {
-				wroteBytes, err := writeMultiBytes(reply, w)
+				wroteBytes, err := writeMessage(reply, w)
 				// FIXME: obvious overflow here,
 				// Just ignore? Who cares?
 				totalBytes += wroteBytes
@@ -226,5 +379,189 @@ func (c *ChannelWriter) WriteTo(w io.Writer) (int64, error) {
 			}
 		}
 	}
-	return totalBytes, nil
+}
+
+// writeNull writes a null in the encoding of the client: the RESP3 null
+// type, or a null bulk string for RESP2 clients.
+func writeNull(w io.Writer) (int64, error) {
+	if protocolOf(w) == RESP3 {
+		n, err := w.Write([]byte("_\r\n"))
+		return int64(n), err
+	}
+	n, err := w.Write([]byte("$-1\r\n"))
+	return int64(n), err
+}
+
+// writeBulkString writes v as a bulk string, even when it is empty.
+func writeBulkString(v []byte, w io.Writer) (int64, error) {
+	n, err := w.Write([]byte("$" + strconv.Itoa(len(v)) + "\r\n" + string(v) + "\r\n"))
+	return int64(n), err
+}
+
+// NullReply is the RESP3 null. RESP2 clients receive a null bulk string.
+type NullReply struct{}
+
+func (r *NullReply) WriteTo(w io.Writer) (int64, error) {
+	return writeNull(w)
+}
+
+// NullArrayReply is the null array replied by commands such as BLPOP when
+// they time out. RESP3 clients receive the null.
+type NullArrayReply struct{}
+
+func NewNullArrayReply() *NullArrayReply {
+	return &NullArrayReply{}
+}
+
+func (r *NullArrayReply) WriteTo(w io.Writer) (int64, error) {
+	if protocolOf(w) == RESP3 {
+		return writeNull(w)
+	}
+	n, err := w.Write([]byte("*-1\r\n"))
+	return int64(n), err
+}
+
+// BooleanReply is the RESP3 boolean. RESP2 clients receive 1 or 0.
+type BooleanReply struct {
+	value bool
+}
+
+func NewBooleanReply(value bool) *BooleanReply {
+	return &BooleanReply{value: value}
+}
+
+func (r *BooleanReply) WriteTo(w io.Writer) (int64, error) {
+	var s string
+	switch {
+	case protocolOf(w) == RESP2 && r.value:
+		s = ":1\r\n"
+	case protocolOf(w) == RESP2:
+		s = ":0\r\n"
+	case r.value:
+		s = "#t\r\n"
+	default:
+		s = "#f\r\n"
+	}
+	n, err := w.Write([]byte(s))
+	return int64(n), err
+}
+
+// DoubleReply is the RESP3 double. RESP2 clients receive a bulk string.
+type DoubleReply struct {
+	value float64
+}
+
+func NewDoubleReply(value float64) *DoubleReply {
+	return &DoubleReply{value: value}
+}
+
+func (r *DoubleReply) WriteTo(w io.Writer) (int64, error) {
+	var s string
+	switch {
+	case math.IsInf(r.value, 1):
+		s = "inf"
+	case math.IsInf(r.value, -1):
+		s = "-inf"
+	case math.IsNaN(r.value):
+		s = "nan"
+	default:
+		s = strconv.FormatFloat(r.value, 'g', -1, 64)
+	}
+	if protocolOf(w) == RESP2 {
+		return writeBulkString([]byte(s), w)
+	}
+	n, err := w.Write([]byte("," + s + "\r\n"))
+	return int64(n), err
+}
+
+// BigNumberReply is the RESP3 big number. RESP2 clients receive a bulk string.
+type BigNumberReply struct {
+	value *big.Int
+}
+
+func NewBigNumberReply(value *big.Int) *BigNumberReply {
+	return &BigNumberReply{value: value}
+}
+
+func (r *BigNumberReply) WriteTo(w io.Writer) (int64, error) {
+	s := r.value.String()
+	if protocolOf(w) == RESP2 {
+		return writeBulkString([]byte(s), w)
+	}
+	n, err := w.Write([]byte("(" + s + "\r\n"))
+	return int64(n), err
+}
+
+// VerbatimReply is the RESP3 verbatim string, format being a three letters
+// hint such as "txt" or "mkd". RESP2 clients receive a bulk string.
+type VerbatimReply struct {
+	format string
+	value  []byte
+}
+
+func NewVerbatimReply(format string, value []byte) *VerbatimReply {
+	return &VerbatimReply{format: format, value: value}
+}
+
+func (r *VerbatimReply) WriteTo(w io.Writer) (int64, error) {
+	if protocolOf(w) == RESP2 {
+		return writeBulkString(r.value, w)
+	}
+	n, err := w.Write([]byte("=" + strconv.Itoa(len(r.value)+4) + "\r\n" +
+		r.format + ":" + string(r.value) + "\r\n"))
+	return int64(n), err
+}
+
+// MapReply is the RESP3 map, values holding keys and values alternately.
+// RESP2 clients receive a flat multi bulk.
+type MapReply struct {
+	values []interface{}
+}
+
+func NewMapReply(values ...interface{}) *MapReply {
+	return &MapReply{values: values}
+}
+
+func MapFromMap(m map[string]interface{}) *MapReply {
+	return &MapReply{values: MultiBulkFromMap(m).values}
+}
+
+func (r *MapReply) WriteTo(w io.Writer) (int64, error) {
+	if protocolOf(w) == RESP2 {
+		return writeAggregate('*', len(r.values), r.values, w)
+	}
+	return writeAggregate('%', len(r.values)/2, r.values, w)
+}
+
+// SetReply is the RESP3 set. RESP2 clients receive a multi bulk.
+type SetReply struct {
+	values []interface{}
+}
+
+func NewSetReply(values ...interface{}) *SetReply {
+	return &SetReply{values: values}
+}
+
+func (r *SetReply) WriteTo(w io.Writer) (int64, error) {
+	if protocolOf(w) == RESP2 {
+		return writeAggregate('*', len(r.values), r.values, w)
+	}
+	return writeAggregate('~', len(r.values), r.values, w)
+}
+
+// PushReply is the RESP3 out of band push, used for pub/sub messages.
+// RESP2 clients receive a multi bulk.
+type PushReply struct {
+	values []interface{}
+}
+
+func NewPushReply(values ...interface{}) *PushReply {
+	return &PushReply{values: values}
+}
+
+func (r *PushReply) WriteTo(w io.Writer) (int64, error) {
+	if protocolOf(w) == RESP2 {
+		return writeAggregate('*', len(r.values), r.values, w)
+	}
+	return writeAggregate('>', len(r.values), r.values, w)
 }
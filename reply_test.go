@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"errors"
 	"io"
+	"math"
+	"math/big"
 	"testing"
 )
 
@@ -38,6 +40,43 @@ func TestWriteStatus(t *testing.T) {
 	}
 }
 
+func TestWriteResp3(t *testing.T) {
+	replies := []struct {
+		reply ReplyWriter
+		resp2 string
+		resp3 string
+	}{
+		{&NullReply{}, "$-1\r\n", "_\r\n"},
+		{&BulkReply{}, "$-1\r\n", "_\r\n"},
+		{NewBooleanReply(true), ":1\r\n", "#t\r\n"},
+		{NewBooleanReply(false), ":0\r\n", "#f\r\n"},
+		{NewDoubleReply(1.5), "$3\r\n1.5\r\n", ",1.5\r\n"},
+		{NewDoubleReply(0.1), "$3\r\n0.1\r\n", ",0.1\r\n"},
+		{NewDoubleReply(math.Inf(-1)), "$4\r\n-inf\r\n", ",-inf\r\n"},
+		{NewBigNumberReply(big.NewInt(1234)), "$4\r\n1234\r\n", "(1234\r\n"},
+		{NewVerbatimReply("txt", []byte("hi")), "$2\r\nhi\r\n", "=6\r\ntxt:hi\r\n"},
+		{NewMapReply("a", 1), "*2\r\n$1\r\na\r\n:1\r\n", "%1\r\n$1\r\na\r\n:1\r\n"},
+		{NewSetReply([]byte("a")), "*1\r\n$1\r\na\r\n", "~1\r\n$1\r\na\r\n"},
+		{NewPushReply("message", nil), "*2\r\n$7\r\nmessage\r\n$-1\r\n", ">2\r\n$7\r\nmessage\r\n_\r\n"},
+		{NewMapReply("m", NewMapReply("d", NewDoubleReply(2))), "*2\r\n$1\r\nm\r\n*2\r\n$1\r\nd\r\n$1\r\n2\r\n", "%1\r\n$1\r\nm\r\n%1\r\n$1\r\nd\r\n,2\r\n"},
+	}
+	for _, p := range replies {
+		for proto, expected := range map[int]string{RESP2: p.resp2, RESP3: p.resp3} {
+			var b bytes.Buffer
+			n, err := p.reply.WriteTo(NewProtocolWriter(&b, proto))
+			if err != nil {
+				t.Fatalf("Oops, unexpected %s", err)
+			}
+			if b.String() != expected {
+				t.Fatalf("RESP%d: expected %q, got %q instead", proto, expected, b.String())
+			}
+			if n != int64(len(expected)) {
+				t.Fatalf("Expected to write %d bytes, wrote %d instead", len(expected), n)
+			}
+		}
+	}
+}
+
 func TestWriteBytes(t *testing.T) {
 	// Note: we test only failure here. Success is already tested.
 	if _, err := writeBytes([]byte("Hello World!"), NewFailWriter(1)); err == nil {
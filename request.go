@@ -1,15 +1,72 @@
 package redis
 
 import (
+	"context"
+	"crypto/tls"
+	"io"
 	"strconv"
 )
 
 type Request struct {
-	Name       string
-	Args       [][]byte
-	Numdb      [][]byte
-	Host       string
+	Name string
+	Args [][]byte
+	// DB is the database selected by the client. A handler switching
+	// the database of the connection, like SELECT, sets it.
+	DB int
+	// Numdb is DB in decimal, for handlers predating DB.
+	Numdb [][]byte
+	Host  string
+	// ClientChan is closed once the client disconnected. Context
+	// supersedes it.
 	ClientChan chan struct{}
+	// Proto is the protocol version spoken by the client, RESP2 unless
+	// negotiated otherwise with HELLO. A handler switching the protocol
+	// of the connection sets it.
+	Proto int
+	// TLS describes the TLS connection the request came from, if any.
+	// With client authentication, the verified client certificate is
+	// TLS.PeerCertificates[0].
+	TLS *tls.ConnectionState
+	// Client is the connection the request came from. It is nil for
+	// requests applied directly to the server.
+	Client *Client
+
+	ctx    context.Context
+	logger Logger
+}
+
+// Context returns the context of the request. It is cancelled when the
+// client disconnects, when the server shuts down or when the command
+// timeout expires. It is never nil.
+func (r *Request) Context() context.Context {
+	if r.ctx == nil {
+		return context.Background()
+	}
+	return r.ctx
+}
+
+// SetContext sets the context of the request, for instance in a
+// middleware adding values or a deadline to it.
+func (r *Request) SetContext(ctx context.Context) {
+	r.ctx = ctx
+}
+
+// Logger returns the logger of the server, adding the client id, address
+// and database to the records. It is never nil.
+func (r *Request) Logger() Logger {
+	if r.logger == nil {
+		return nopLogger{}
+	}
+	return r.logger
+}
+
+// ClientCertSubject returns the subject of the certificate the client
+// authenticated with, or an empty string.
+func (r *Request) ClientCertSubject() string {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return ""
+	}
+	return r.TLS.PeerCertificates[0].Subject.String()
 }
 
 func (r *Request) HasArgument(index int) bool {
@@ -81,3 +138,23 @@ func (r *Request) GetMap(index int) (map[string][]byte, ReplyWriter) {
 	}
 	return values, nil
 }
+
+// WriteTo encodes the request the way clients send it, a multi bulk of
+// bulk strings, so a Request can be sent to a redis server.
+func (r *Request) WriteTo(w io.Writer) (int64, error) {
+	wrote, err := w.Write([]byte("*" + strconv.Itoa(len(r.Args)+1) + "\r\n"))
+	if err != nil {
+		return int64(wrote), err
+	}
+	total := int64(wrote)
+	n, err := writeBulkString([]byte(r.Name), w)
+	total += n
+	for _, arg := range r.Args {
+		if err != nil {
+			break
+		}
+		n, err = writeBulkString(arg, w)
+		total += n
+	}
+	return total, err
+}
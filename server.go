@@ -6,66 +6,180 @@ package redis
 
 import (
 	"bufio"
+	"context"
+	"crypto/tls"
 	"fmt"
+	"io"
 	"time"
-	// "io"
 	// "io/ioutil"
 	"net"
+	"net/http"
+	"os"
 	"reflect"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 )
 
 type Server struct {
-	sync.Mutex
 	Proto string // default, "tcp"
 	Addr  string // default,
 	// if Proto == unix then "/tmp/redis.sock" else ":6389"
-	MonitorChans []chan string
-	methods      map[string]HandlerFn
-	listener     net.Listener
+	methods map[string]HandlerFn
+	// chains holds the methods wrapped in middleware.
+	chains     map[string]HandlerFn
+	middleware []Middleware
+	listeners  []net.Listener
+	handler    interface{}
+	maxBulkLen int
+	maxArgs    int
+
+	// monitorReplies holds the []*MonitorReply of the MONITOR clients. It
+	// is replaced rather than modified, so commands can read it without
+	// locking.
+	monitorReplies atomic.Value
+
+	// mu guards the tracking of listeners and clients, and the updates
+	// of monitorReplies.
+	mu         sync.Mutex
+	serving    map[net.Listener]struct{}
+	inShutdown int32
+	ctx        context.Context
+	cancel     context.CancelFunc
+
+	clients      map[int64]*Client
+	lastClientID int64
+
+	users *aclUsers
+
+	// liveConfig holds the *Config of the running server. CONFIG SET
+	// replaces it, under configMu, rather than modifying it.
+	liveConfig atomic.Value
+	configMu   sync.Mutex
+
+	started time.Time
+	stats   serverStats
+	// commandStats holds the statistics of every registered command and
+	// subcommand. Like the methods, it is only modified by Register.
+	commandStats map[string]*commandStats
+	slowlog      slowlog
+	// commandSpecs describes the registered commands for COMMAND.
+	commandSpecs map[string]*commandSpec
+
+	metricsListener net.Listener
+	metricsServer   *http.Server
+
+	// stopExpire, if set, stops the active expire cycle the handler runs
+	// for the server. stopOnce makes Close and Shutdown call it once.
+	stopExpire func()
+	stopOnce   sync.Once
 }
 
-func (srv *Server) listen() error {
-	addr := srv.Addr
-	if srv.Proto == "" {
-		srv.Proto = "tcp"
+// listen opens the listeners of the server, the first one giving Proto
+// and Addr.
+func (srv *Server) listen(binds []bindAddr, tlsConfig *tls.Config, perm os.FileMode) error {
+	for _, bind := range binds {
+		l, err := listen(bind.proto, bind.addr)
+		if err != nil {
+			srv.Close()
+			return err
+		}
+		if bind.proto == "unix" && perm != 0 {
+			if err := os.Chmod(bind.addr, perm); err != nil {
+				l.Close()
+				srv.Close()
+				return err
+			}
+		}
+		if len(srv.listeners) == 0 {
+			srv.Proto = l.Addr().Network()
+			// if port was 0 and proto is tcp, the listener would use a random port
+			srv.Addr = l.Addr().String()
+		}
+		if bind.tls {
+			l = tls.NewListener(l, tlsConfig)
+		}
+		srv.listeners = append(srv.listeners, l)
+	}
+	return nil
+}
+
+func listen(proto, addr string) (net.Listener, error) {
+	if proto == "" {
+		proto = "tcp"
 	}
 	if addr == "" {
-		if srv.Proto == "unix" {
+		if proto == "unix" {
 			addr = "/tmp/redis.sock"
 		} else {
 			addr = ":6389"
 		}
 	}
 	for i := 0; ; i++ {
-		l, e := net.Listen(srv.Proto, addr)
+		l, e := net.Listen(proto, addr)
 		if e == nil {
-			srv.listener = l
-			break
+			return l, nil
 		} else if i < 30 {
 			// retry for devices that are still in ipv6
 			// duplicate address detection
 			time.Sleep(100 * time.Millisecond)
 		} else {
-			return e
+			return nil, e
 		}
 	}
+}
 
-	// if port was 0 and proto is tcp, the listener would use a random port
-	srv.Addr = srv.listener.Addr().String()
-	return nil
+// Listeners returns the listeners opened by NewServer.
+func (srv *Server) Listeners() []net.Listener {
+	return srv.listeners
 }
 
+// Start serves all the listeners of the server, and the metrics if
+// configured, until one of them fails or the server is shut down.
 func (srv *Server) Start() error {
-	return srv.Serve(srv.listener)
+	if srv.metricsServer != nil {
+		go srv.metricsServer.Serve(srv.metricsListener)
+	}
+	if len(srv.listeners) == 1 {
+		return srv.Serve(srv.listeners[0])
+	}
+	errs := make(chan error, len(srv.listeners))
+	for _, l := range srv.listeners {
+		go func(l net.Listener) {
+			errs <- srv.Serve(l)
+		}(l)
+	}
+	err := <-errs
+	srv.Close()
+	for i := 1; i < len(srv.listeners); i++ {
+		<-errs
+	}
+	return err
 }
 
-// Close shuts down the network port/socket
+// Close shuts down the network ports/sockets
 func (srv *Server) Close() error {
-	if srv.listener == nil {
-		return nil
+	var err error
+	if srv.metricsServer != nil {
+		err = srv.metricsServer.Close()
+	}
+	for _, l := range srv.listeners {
+		if cerr := l.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
 	}
-	return srv.listener.Close()
+	srv.stopHandler()
+	return err
+}
+
+// stopHandler stops the background work the handler does for the server.
+func (srv *Server) stopHandler() {
+	srv.stopOnce.Do(func() {
+		if srv.stopExpire != nil {
+			srv.stopExpire()
+		}
+	})
 }
 
 // Serve accepts incoming connections on the Listener l, creating a
@@ -73,10 +187,17 @@ func (srv *Server) Close() error {
 // then call srv.Handler to reply to them.
 func (srv *Server) Serve(l net.Listener) error {
 	defer l.Close()
-	srv.MonitorChans = []chan string{}
+	if !srv.trackListener(l, true) {
+		return ErrServerClosed
+	}
+	defer srv.trackListener(l, false)
 	for {
 		rw, err := l.Accept()
 		if err != nil {
+			if srv.shuttingDown() {
+				return ErrServerClosed
+			}
+			srv.log(LevelWarning, "Accepting connections failed", Field{"listener", l.Addr().String()}, Field{"error", err})
 			return err
 		}
 		go srv.ServeClient(rw)
@@ -87,30 +208,19 @@ func (srv *Server) Serve(l net.Listener) error {
 // It reads commands using the redis protocol, passes them to `handler`,
 // and returns the result.
 func (srv *Server) ServeClient(conn net.Conn) (err error) {
+	// Replies are buffered, and only flushed once every pipelined
+	// request already received has been answered. Every write must
+	// complete within the write timeout.
+	writer := bufio.NewWriter(deadlineWriter{srv, conn})
 	defer func() {
-		if err != nil {
-			fmt.Fprintf(conn, "-%s\n", err)
+		if perr, ok := err.(*ErrorReply); ok {
+			perr.WriteTo(writer)
 		}
+		writer.Flush()
 		conn.Close()
 	}()
 
-	clientChan := make(chan struct{})
-
-	// Read on `conn` in order to detect client disconnect
-	/*
-		go func() {
-			// Close chan in order to trigger eventual selects
-			defer close(clientChan)
-			defer Debugf("Client disconnected")
-			// FIXME: move conn within the request.
-			if false {
-				io.Copy(ioutil.Discard, conn)
-			}
-		}()
-	*/
-
 	var clientAddr string
-
 	switch co := conn.(type) {
 	case *net.UnixConn:
 		f, err := conn.(*net.UnixConn).File()
@@ -118,55 +228,263 @@ func (srv *Server) ServeClient(conn net.Conn) (err error) {
 			return err
 		}
 		clientAddr = f.Name()
+		f.Close()
 	default:
 		clientAddr = co.RemoteAddr().String()
 	}
 
-	reader := bufio.NewReader(conn)
-	Numbd := [][]byte{[]byte("0")}
-	for {
-		request, err := parseRequest(reader)
-		if err != nil {
+	client := newClient(srv, srv.baseContext(), atomic.AddInt64(&srv.lastClientID, 1), conn, clientAddr)
+	defer client.disconnect()
+	if err := srv.trackClient(client, true); err != nil {
+		if err == errMaxClients {
+			srv.log(LevelVerbose, "Rejected client", Field{"addr", clientAddr}, Field{"error", errMaxClients.Message()})
+			return errMaxClients
+		}
+		return nil
+	}
+	if srv.users == nil || srv.users.noAuth() {
+		client.setUser("default")
+	}
+	defer srv.trackClient(client, false)
+
+	logger := clientLogger{srv, client}
+	logger.Log(LevelVerbose, "Accepted client")
+	defer func() {
+		if err != nil && err != io.EOF {
+			logger.Log(LevelVerbose, "Client connection closed", Field{"error", err})
+		} else {
+			logger.Log(LevelVerbose, "Client connection closed")
+		}
+	}()
+
+	setKeepAlive(conn, srv.conf().tcpKeepAlive)
+	var tlsState *tls.ConnectionState
+	if co, ok := conn.(*tls.Conn); ok {
+		if err := co.Handshake(); err != nil {
 			return err
 		}
-		if request.Name == "select" {
-			Numbd = request.Args
+		state := co.ConnectionState()
+		tlsState = &state
+	}
+
+	// Requests are read ahead by another goroutine, so that a client
+	// disconnecting while its command runs cancels the command.
+	requests := make(chan readResult)
+	stop := make(chan struct{})
+	defer close(stop)
+	go srv.readRequests(client, newRequestReader(bufio.NewReader(conn), srv.maxBulkLen, srv.maxArgs), requests, stop)
+
+	db, numdb := 0, [][]byte{[]byte("0")}
+	proto := RESP2
+	more := false
+	for !srv.shuttingDown() && !client.killed() {
+		if !more {
+			client.setState(connIdle)
+		}
+		next, ok := srv.nextRequest(client, requests)
+		if !ok {
+			logger.Log(LevelVerbose, "Closing idle client")
+			return nil
 		}
+		client.setState(connActive)
+		if next.err != nil {
+			if srv.shuttingDown() || client.killed() {
+				return nil
+			}
+			return next.err
+		}
+		request := next.request
+		more = next.more
+		client.interact(request.Name)
 		if request.Name == "quit" {
-			fmt.Fprintln(conn, "+OK")
+			writer.WriteString("+OK\r\n")
 			break
 		}
 		request.Host = clientAddr
-		request.ClientChan = clientChan
-		request.Numdb = Numbd
-		reply, err := srv.Apply(request)
+		request.ClientChan = client.clientChan
+		request.DB = db
+		request.Numdb = numdb
+		request.Proto = proto
+		request.TLS = tlsState
+		request.Client = client
+		request.logger = logger
+		reply, err := srv.applyWithTimeout(client.ctx, request)
 		if err != nil {
 			return err
 		}
-		if _, err = reply.WriteTo(conn); err != nil {
-			clientChan <- struct{}{}
+		if db != request.DB {
+			db, numdb = request.DB, [][]byte{[]byte(strconv.Itoa(request.DB))}
+			client.setDB(db)
+		}
+		if proto != request.Proto {
+			proto = request.Proto
+			client.setProto(proto)
+		}
+		if _, err = reply.WriteTo(NewProtocolWriter(writer, proto)); err != nil {
 			return err
 		}
+		if !more || client.killed() {
+			if err = writer.Flush(); err != nil {
+				return err
+			}
+		}
 	}
 	return nil
 }
 
-func NewServer(c *Config) (*Server, error) {
-	srv := &Server{
-		Proto:        c.proto,
-		MonitorChans: []chan string{},
-		methods:      make(map[string]HandlerFn),
+// nextRequest waits for the next request of client. It returns false
+// once the client has been idle for the timeout, unless it is subscribed
+// to channels or blocked.
+func (srv *Server) nextRequest(client *Client, requests <-chan readResult) (readResult, bool) {
+	for {
+		timeout := srv.conf().timeout
+		if timeout <= 0 {
+			return <-requests, true
+		}
+		timer := time.NewTimer(timeout - client.Idle())
+		select {
+		case next := <-requests:
+			timer.Stop()
+			return next, true
+		case <-timer.C:
+			if client.Idle() >= timeout && client.Flags()&(ClientPubSub|ClientBlocked) == 0 {
+				return readResult{}, false
+			}
+		}
 	}
+}
+
+// deadlineWriter sets the write deadline of conn before every write.
+type deadlineWriter struct {
+	srv  *Server
+	conn net.Conn
+}
 
-	if srv.Proto == "unix" {
-		srv.Addr = c.host
-	} else {
-		srv.Addr = fmt.Sprintf("%s:%d", c.host, c.port)
+func (w deadlineWriter) Write(p []byte) (int, error) {
+	var deadline time.Time
+	if timeout := w.srv.conf().writeTimeout; timeout > 0 {
+		deadline = time.Now().Add(timeout)
 	}
+	w.conn.SetWriteDeadline(deadline)
+	return w.conn.Write(p)
+}
+
+// setKeepAlive sends TCP keepalives on conn every period, or disables
+// them when period is zero.
+func setKeepAlive(conn net.Conn, period time.Duration) {
+	if co, ok := conn.(*tls.Conn); ok {
+		conn = co.NetConn()
+	}
+	co, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	co.SetKeepAlive(period > 0)
+	if period > 0 {
+		co.SetKeepAlivePeriod(period)
+	}
+}
+
+// readResult is a request read by readRequests. more reports whether
+// the following request was already received.
+type readResult struct {
+	request *Request
+	more    bool
+	err     error
+}
+
+// readRequests reads the requests of client and sends them to requests,
+// until it fails to read or stop is closed. A failed read disconnects
+// the client.
+func (srv *Server) readRequests(client *Client, reader *requestReader, requests chan<- readResult, stop <-chan struct{}) {
+	for {
+		request, err := reader.readRequest()
+		if err != nil {
+			client.disconnect()
+		}
+		select {
+		case requests <- readResult{request, reader.r.Buffered() > 0, err}:
+		case <-stop:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// applyWithTimeout applies r with a context derived from ctx, cancelled
+// once the command timeout expires.
+func (srv *Server) applyWithTimeout(ctx context.Context, r *Request) (ReplyWriter, error) {
+	if timeout := srv.conf().commandTimeout; timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	r.SetContext(ctx)
+	return srv.Apply(r)
+}
+
+// monitors returns the streams of the clients running MONITOR.
+func (srv *Server) monitors() []*MonitorReply {
+	monitors, _ := srv.monitorReplies.Load().([]*MonitorReply)
+	return monitors
+}
+
+func (srv *Server) addMonitor(m *MonitorReply) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	monitors := srv.monitors()
+	srv.monitorReplies.Store(append(monitors[:len(monitors):len(monitors)], m))
+}
+
+func (srv *Server) removeMonitor(m *MonitorReply) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	var monitors []*MonitorReply
+	for _, monitor := range srv.monitors() {
+		if monitor != m {
+			monitors = append(monitors, monitor)
+		}
+	}
+	srv.monitorReplies.Store(monitors)
+}
+
+func NewServer(c *Config) (*Server, error) {
+	srv := &Server{
+		Proto:      c.proto,
+		methods:    make(map[string]HandlerFn),
+		chains:     make(map[string]HandlerFn),
+		maxBulkLen: c.maxBulkLen,
+		maxArgs:    c.maxArgs,
+	}
+	srv.liveConfig.Store(c.clone())
+	srv.started = time.Now()
 
 	if c.handler == nil {
 		c.handler = NewDefaultHandler()
 	}
+	srv.handler = c.handler
+
+	tlsConfig, err := c.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	for _, bind := range c.listenAddrs() {
+		if bind.tls && tlsConfig == nil {
+			return nil, fmt.Errorf("no TLS configuration to listen on %s over TLS", bind.addr)
+		}
+	}
+	srv.users = newACLUsers(c.requirePass)
+
+	srv.register("auth", srv.auth, 0)
+	srv.register("acl", srv.acl, 0)
+	srv.register("hello", srv.hello, 0)
+	srv.register("client", srv.client, 0)
+	srv.register("config", srv.config, 0)
+	srv.register("info", srv.info, 0)
+	srv.register("slowlog", srv.slowlogCommand, 0)
+	srv.register("command", srv.command, 0)
 
 	rh := reflect.TypeOf(c.handler)
 	for i := 0; i < rh.NumMethod(); i++ {
@@ -178,12 +496,29 @@ func NewServer(c *Config) (*Server, error) {
 		if err != nil {
 			return nil, err
 		}
-		srv.Register(method.Name, handlerFn)
+		arity := 0
+		if _, ok := c.handler.(redisHandler); !ok || commands[strings.ToLower(method.Name)] == nil {
+			arity = handlerArity(c.handler, &method.Func)
+		}
+		srv.register(method.Name, handlerFn, arity)
 	}
+	srv.configure(c)
 
-	err := srv.listen()
-	if err != nil {
+	if err := srv.listen(c.listenAddrs(), tlsConfig, c.unixSocketPerm); err != nil {
 		return nil, err
 	}
+	if c.metricsAddr != "" {
+		l, err := net.Listen("tcp", c.metricsAddr)
+		if err != nil {
+			srv.Close()
+			return nil, err
+		}
+		srv.metricsListener = l
+		srv.metricsServer = &http.Server{Handler: srv.MetricsHandler()}
+	}
+	if h, ok := c.handler.(expirer); ok {
+		h.startExpire()
+		srv.stopExpire = h.stopExpire
+	}
 	return srv, nil
 }
@@ -1,9 +1,308 @@
 package redis
 
 import (
+	"bufio"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestServer(t *testing.T) {
 	t.Skip("Not implemented")
 }
+
+// countingConn counts the writes reaching the connection.
+type countingConn struct {
+	net.Conn
+	writes int32
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	atomic.AddInt32(&c.writes, 1)
+	return c.Conn.Write(b)
+}
+
+func TestServeClientPipeline(t *testing.T) {
+	srv, err := NewServer(DefaultConfig().Port(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	client, server := net.Pipe()
+	conn := &countingConn{Conn: server}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		srv.ServeClient(conn)
+	}()
+
+	pipeline := strings.Repeat("*1\r\n$4\r\nPING\r\n", 10) + "*1\r\n$4\r\nQUIT\r\n"
+	go client.Write([]byte(pipeline))
+	replies, err := ioutil.ReadAll(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-done
+
+	expected := strings.Repeat("+PONG\r\n", 10) + "+OK\r\n"
+	if string(replies) != expected {
+		t.Fatalf("Expected %q, got %q", expected, replies)
+	}
+	if n := atomic.LoadInt32(&conn.writes); n != 1 {
+		t.Fatalf("Expected the pipeline to be answered with 1 write, got %d", n)
+	}
+}
+
+// startServer serves on a random port until the test ends.
+func startServer(t *testing.T, c *Config) (*Server, chan error) {
+	srv, err := NewServer(c.Port(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- srv.Start() }()
+	t.Cleanup(func() { srv.Close() })
+	return srv, served
+}
+
+// dial connects to srv and sends the given inline commands.
+func dial(t *testing.T, srv *Server, commands ...string) (net.Conn, *bufio.Reader) {
+	conn, err := net.Dial("tcp", srv.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	for _, command := range commands {
+		if _, err := conn.Write([]byte(command + "\r\n")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return conn, bufio.NewReader(conn)
+}
+
+func expectLine(t *testing.T, r *bufio.Reader, expected string) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatalf("Expected %q, got error %v", expected, err)
+	}
+	if line != expected+"\r\n" {
+		t.Fatalf("Expected %q, got %q", expected, line)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	srv, served := startServer(t, DefaultConfig().Handler(NewDefaultHandler()))
+
+	_, idle := dial(t, srv, "PING")
+	expectLine(t, idle, "+PONG")
+	_, monitor := dial(t, srv, "MONITOR")
+	_, blocked := dial(t, srv, "BRPOP q 0")
+	waitBlocked(t, srv, 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if err := <-served; err != ErrServerClosed {
+		t.Fatalf("Expected ErrServerClosed, got %v", err)
+	}
+
+	expectLine(t, blocked, "*-1")
+	for _, r := range []*bufio.Reader{idle, monitor, blocked} {
+		// The monitor stream may still hold the BRPOP line.
+		if _, err := ioutil.ReadAll(r); err != nil {
+			t.Fatalf("Expected connection to be closed, got %v", err)
+		}
+	}
+	if _, err := net.Dial("tcp", srv.Addr); err == nil {
+		t.Fatal("Expected the listener to be closed")
+	}
+}
+
+func TestShutdownSharedHandler(t *testing.T) {
+	h := NewDefaultHandler()
+	first, _ := startServer(t, DefaultConfig().Handler(h))
+	second, _ := startServer(t, DefaultConfig().Handler(h))
+	if err := first.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	// The clients of the other server still block.
+	_, blocked := dial(t, second, "BLPOP q 0")
+	waitBlocked(t, second, 1)
+	_, r := dial(t, second, "RPUSH q x")
+	expectLine(t, r, ":1")
+	expectReply(t, blocked, []interface{}{"q", "x"})
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	srv, _ := startServer(t, DefaultConfig())
+	release := make(chan struct{})
+	defer close(release)
+	srv.RegisterFct("hang", func() error {
+		<-release
+		return nil
+	})
+
+	_, r := dial(t, srv, "HANG")
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Expected deadline exceeded, got %v", err)
+	}
+	if _, err := r.ReadString('\n'); err != io.EOF {
+		t.Fatalf("Expected connection to be force closed, got %v", err)
+	}
+}
+
+func TestRequestContext(t *testing.T) {
+	srv, _ := startServer(t, DefaultConfig().CommandTimeout(100*time.Millisecond))
+	cancelled := make(chan error, 1)
+	if err := srv.RegisterFct("wait", func(ctx context.Context, what string) (string, error) {
+		<-ctx.Done()
+		cancelled <- ctx.Err()
+		return what, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.RegisterFct("bad", func(what string, ctx context.Context) error { return nil }); err == nil {
+		t.Fatal("Expected a context after the first argument to be rejected")
+	}
+
+	// The command timeout cancels the context.
+	_, r := dial(t, srv, "WAIT timeout")
+	expectReply(t, r, "timeout")
+	if err := <-cancelled; err != context.DeadlineExceeded {
+		t.Fatalf("Expected %v, got %v", context.DeadlineExceeded, err)
+	}
+
+	// Disconnecting cancels the context, and releases blocked clients.
+	conn, r := dial(t, srv, "CONFIG SET command-timeout 0")
+	expectLine(t, r, "+OK")
+	conn.Write([]byte("WAIT disconnect\r\n"))
+	time.Sleep(50 * time.Millisecond)
+	conn.Close()
+	select {
+	case err := <-cancelled:
+		if err != context.Canceled {
+			t.Fatalf("Expected %v, got %v", context.Canceled, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("The context was not cancelled on disconnect")
+	}
+
+	conn, _ = dial(t, srv, "BRPOP list 0")
+	waitBlocked(t, srv, 1)
+	conn.Close()
+	waitBlocked(t, srv, 0)
+}
+
+func TestMultipleListeners(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "redis.sock")
+	srv, served := startServer(t, DefaultConfig().
+		Bind("tcp", "127.0.0.1:0").
+		Bind("unix", sock).
+		UnixSocketPerm(0700))
+	if len(srv.Listeners()) != 2 || srv.Proto != "tcp" {
+		t.Fatalf("Unexpected listeners %v on %s", srv.Listeners(), srv.Proto)
+	}
+	if fi, err := os.Stat(sock); err != nil || fi.Mode().Perm() != 0700 {
+		t.Fatalf("Unexpected socket %v, %v", fi, err)
+	}
+
+	_, tcp := dial(t, srv, "SET key value")
+	expectLine(t, tcp, "+OK")
+
+	unix, err := net.Dial("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close()
+	unix.Write([]byte("GET key\r\nCLIENT LIST\r\n"))
+	r := bufio.NewReader(unix)
+	expectReply(t, r, "value")
+	if list := readReply(t, r).(string); strings.Count(list, "\n") != 2 {
+		t.Fatalf("Expected 2 clients, got %q", list)
+	}
+
+	if err := srv.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-served; err != ErrServerClosed {
+		t.Fatalf("Expected %v, got %v", ErrServerClosed, err)
+	}
+	if _, err := net.Dial("unix", sock); err == nil {
+		t.Fatal("Expected the unix socket to be closed")
+	}
+}
+
+func TestMaxClients(t *testing.T) {
+	srv, _ := startServer(t, DefaultConfig().MaxClients(1))
+
+	conn, r := dial(t, srv, "PING")
+	expectLine(t, r, "+PONG")
+	_, rejected := dial(t, srv, "PING")
+	expectLine(t, rejected, "-ERR max number of clients reached")
+	// The unread PING may reset the connection rather than close it.
+	if line, err := rejected.ReadString('\n'); err == nil {
+		t.Fatalf("Expected the connection to be closed, got %q", line)
+	}
+
+	conn.Write([]byte("INFO stats\r\n"))
+	if info := readReply(t, r).(string); !strings.Contains(info, "rejected_connections:1\r\n") {
+		t.Fatalf("Expected a rejected connection in %q", info)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	srv, _ := startServer(t, DefaultConfig().Timeout(100*time.Millisecond))
+
+	idle, r := dial(t, srv, "PING")
+	expectLine(t, r, "+PONG")
+	_, subscriber := dial(t, srv, "SUBSCRIBE ch")
+	readReply(t, subscriber)
+	_, blocked := dial(t, srv, "BRPOP list 0")
+	waitBlocked(t, srv, 1)
+
+	idle.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := r.ReadString('\n'); err != io.EOF {
+		t.Fatalf("Expected the idle client to be closed, got %v", err)
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	_, r = dial(t, srv, "PUBLISH ch hi", "RPUSH list x")
+	expectLine(t, r, ":1")
+	expectLine(t, r, ":1")
+	expectReply(t, subscriber, []interface{}{"message", "ch", "hi"})
+	expectReply(t, blocked, []interface{}{"list", "x"})
+}
+
+func TestWriteTimeout(t *testing.T) {
+	srv, _ := startServer(t, DefaultConfig().WriteTimeout(50*time.Millisecond))
+
+	client, server := net.Pipe()
+	defer client.Close()
+	served := make(chan error, 1)
+	go func() { served <- srv.ServeClient(server) }()
+	// The reply is never read.
+	client.Write([]byte("PING\r\n"))
+	select {
+	case err := <-served:
+		if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+			t.Fatalf("Expected a timeout, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the client to be closed")
+	}
+}
@@ -0,0 +1,136 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// ErrServerClosed is returned by Serve and Start once Shutdown was called.
+var ErrServerClosed = errors.New("redis: Server closed")
+
+// States of a client connection, as seen by Shutdown.
+const (
+	// connIdle connections wait for their next request and can be
+	// closed right away.
+	connIdle int32 = iota
+	// connActive connections are running a command, possibly a blocking
+	// one or a stream, and are let finish.
+	connActive
+)
+
+func (srv *Server) shuttingDown() bool {
+	return atomic.LoadInt32(&srv.inShutdown) != 0
+}
+
+func (srv *Server) trackListener(l net.Listener, add bool) bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.serving == nil {
+		srv.serving = make(map[net.Listener]struct{})
+	}
+	if add {
+		if srv.shuttingDown() {
+			return false
+		}
+		srv.serving[l] = struct{}{}
+	} else {
+		delete(srv.serving, l)
+	}
+	return true
+}
+
+// baseContext is the parent of the contexts of the clients. It is
+// cancelled when Shutdown is called.
+func (srv *Server) baseContext() context.Context {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.baseContextLocked()
+}
+
+func (srv *Server) baseContextLocked() context.Context {
+	if srv.ctx == nil {
+		srv.ctx, srv.cancel = context.WithCancel(context.Background())
+	}
+	return srv.ctx
+}
+
+// doneChan is closed when Shutdown is called, ending streaming replies.
+func (srv *Server) doneChan() <-chan struct{} {
+	return srv.baseContext().Done()
+}
+
+// streamDone is closed when the streaming reply to r must end: once its
+// client disconnected or the server shut down.
+func (srv *Server) streamDone(r *Request) <-chan struct{} {
+	if r.Client != nil {
+		return r.Client.ctx.Done()
+	}
+	return srv.doneChan()
+}
+
+// Shutdown gracefully shuts down the server, the way net/http does: it
+// closes the listeners, then idle connections, and waits for running
+// commands to complete before closing their connections. Clients blocked
+// in BRPOP or BLPOP get a null reply, the contexts of the requests are
+// cancelled and MONITOR and SUBSCRIBE streams are ended.
+//
+// If ctx expires first, the remaining connections are closed and the
+// context's error is returned. Serve and Start return ErrServerClosed.
+func (srv *Server) Shutdown(ctx context.Context) error {
+	srv.mu.Lock()
+	if !atomic.CompareAndSwapInt32(&srv.inShutdown, 0, 1) {
+		srv.mu.Unlock()
+		return ErrServerClosed
+	}
+	var err error
+	if srv.metricsServer != nil {
+		err = srv.metricsServer.Close()
+	}
+	for l := range srv.serving {
+		if cerr := l.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	srv.baseContextLocked()
+	srv.cancel()
+	srv.mu.Unlock()
+	srv.log(LevelNotice, "Shutting down")
+
+	srv.stopHandler()
+
+	pollInterval := time.Millisecond
+	for {
+		if srv.closeIdleConns() {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			srv.mu.Lock()
+			for _, c := range srv.clients {
+				c.conn.Close()
+			}
+			srv.mu.Unlock()
+			return ctx.Err()
+		case <-time.After(pollInterval):
+		}
+		if pollInterval < 500*time.Millisecond {
+			pollInterval *= 2
+		}
+	}
+}
+
+// closeIdleConns closes idle connections, and reports whether all
+// connections are gone.
+func (srv *Server) closeIdleConns() bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	for _, c := range srv.clients {
+		if atomic.LoadInt32(&c.state) == connIdle {
+			c.conn.Close()
+		}
+	}
+	return len(srv.clients) == 0
+}
@@ -0,0 +1,163 @@
+package redis
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// slowlogMaxArgs and slowlogMaxArgLen truncate the arguments of the
+	// entries, as redis does.
+	slowlogMaxArgs   = 32
+	slowlogMaxArgLen = 128
+)
+
+// slowlogEntry is a command slower than slowlog-log-slower-than.
+type slowlogEntry struct {
+	id       int64
+	time     time.Time
+	duration time.Duration
+	args     [][]byte
+	addr     string
+	name     string
+}
+
+func (e *slowlogEntry) reply() []interface{} {
+	args := make([]interface{}, len(e.args))
+	for i, arg := range e.args {
+		args[i] = arg
+	}
+	return []interface{}{
+		e.id,
+		e.time.Unix(),
+		int64(e.duration / time.Microsecond),
+		&MultiBulkReply{values: args},
+		e.addr,
+		e.name,
+	}
+}
+
+// slowlog holds the slowest commands, the newest last.
+type slowlog struct {
+	mu      sync.Mutex
+	entries []*slowlogEntry
+	nextID  int64
+}
+
+// slowlogArgs returns the name and arguments of r, keeping the first 31
+// arguments of longer commands and the first 128 bytes of longer
+// arguments.
+func slowlogArgs(r *Request) [][]byte {
+	argv := append([][]byte{[]byte(r.Name)}, r.Args...)
+	argc := len(argv)
+	if argc > slowlogMaxArgs {
+		argc = slowlogMaxArgs
+	}
+	args := make([][]byte, argc)
+	for i := range args {
+		switch arg := argv[i]; {
+		case argc != len(argv) && i == argc-1:
+			args[i] = []byte(fmt.Sprintf("... (%d more arguments)", len(argv)-argc+1))
+		case len(arg) > slowlogMaxArgLen:
+			args[i] = []byte(fmt.Sprintf("%s... (%d more bytes)", arg[:slowlogMaxArgLen], len(arg)-slowlogMaxArgLen))
+		default:
+			args[i] = append([]byte(nil), arg...)
+		}
+	}
+	return args
+}
+
+// recordSlowlog logs r, which took d, if it was slower than
+// slowlog-log-slower-than. Blocking commands, whose duration is mostly
+// waiting, and those taking a password are never logged.
+func (srv *Server) recordSlowlog(r *Request, d time.Duration) {
+	c := srv.conf()
+	if c.slowlogSlowerThan < 0 || d < c.slowlogSlowerThan {
+		return
+	}
+	name := strings.ToLower(r.Name)
+	if name == "auth" || name == "hello" {
+		return
+	}
+	if spec := commands[name]; spec != nil && spec.inCategory("blocking") {
+		return
+	}
+	entry := &slowlogEntry{
+		time:     time.Now().Add(-d),
+		duration: d,
+		args:     slowlogArgs(r),
+	}
+	if r.Client != nil {
+		entry.addr = r.Client.Addr()
+		entry.name = r.Client.Name()
+	}
+
+	srv.slowlog.mu.Lock()
+	defer srv.slowlog.mu.Unlock()
+	entry.id = srv.slowlog.nextID
+	srv.slowlog.nextID++
+	srv.slowlog.entries = append(srv.slowlog.entries, entry)
+	if n := len(srv.slowlog.entries) - c.slowlogMaxLen; n > 0 {
+		srv.slowlog.entries = append([]*slowlogEntry(nil), srv.slowlog.entries[n:]...)
+	}
+}
+
+// slowlogCommand implements SLOWLOG GET|LEN|RESET.
+func (srv *Server) slowlogCommand(r *Request) (ReplyWriter, error) {
+	if len(r.Args) == 0 {
+		return newErrorCode("ERR", "wrong number of arguments for 'slowlog' command"), nil
+	}
+	sub := strings.ToLower(string(r.Args[0]))
+	args := r.Args[1:]
+	s := &srv.slowlog
+	switch sub {
+	case "get":
+		if len(args) > 1 {
+			return newErrorCode("ERR", "wrong number of arguments for 'slowlog|get' command"), nil
+		}
+		count := 10
+		if len(args) == 1 {
+			n, err := strconv.Atoi(string(args[0]))
+			if err != nil || n < -1 {
+				return newErrorCode("ERR", "count should be greater than or equal to -1"), nil
+			}
+			count = n
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if count == -1 || count > len(s.entries) {
+			count = len(s.entries)
+		}
+		values := make([]interface{}, count)
+		for i := range values {
+			values[i] = &MultiBulkReply{values: s.entries[len(s.entries)-1-i].reply()}
+		}
+		return &MultiBulkReply{values: values}, nil
+	case "len":
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return &IntegerReply{number: len(s.entries)}, nil
+	case "reset":
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.entries = nil
+		return &StatusReply{Code: "OK"}, nil
+	case "help":
+		return &MultiBulkReply{values: []interface{}{
+			"SLOWLOG <subcommand> [<arg> [value] [opt] ...]. Subcommands are:",
+			"GET [<count>]",
+			"    Return top <count> entries from the slowlog (default: 10, -1 mean all).",
+			"    Entries are made of:",
+			"    id, timestamp, time in microseconds, arguments array, client IP and port,",
+			"    client name",
+			"LEN",
+			"    Return the length of the slowlog.",
+			"RESET",
+			"    Reset the slowlog.",
+		}}, nil
+	}
+	return wrongSubcommand("slowlog", sub), nil
+}
@@ -0,0 +1,54 @@
+package redis
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSlowlog(t *testing.T) {
+	srv, _ := startServer(t, DefaultConfig().SlowlogLogSlowerThan(0).SlowlogMaxLen(3))
+
+	long := strings.Repeat("x", 200)
+	mset := "MSET"
+	for i := 0; i < 20; i++ {
+		mset += " k v"
+	}
+	conn, r := dial(t, srv, "CLIENT SETNAME app", "SET a "+long, mset, "SLOWLOG LEN", "SLOWLOG GET -1")
+	expectReply(t, r, "OK")
+	expectReply(t, r, "OK")
+	expectReply(t, r, "OK")
+	expectReply(t, r, int64(3))
+
+	entries := readReply(t, r).([]interface{})
+	if len(entries) != 3 {
+		t.Fatalf("Expected 3 entries, got %#v", entries)
+	}
+	msetArgs := []interface{}{"mset"}
+	for i := 0; i < 15; i++ {
+		msetArgs = append(msetArgs, "k", "v")
+	}
+	msetArgs = append(msetArgs, "... (10 more arguments)")
+	for i, expected := range []struct {
+		id   int64
+		args []interface{}
+	}{
+		{3, []interface{}{"slowlog", "LEN"}},
+		{2, msetArgs},
+		{1, []interface{}{"set", "a", long[:128] + "... (72 more bytes)"}},
+	} {
+		entry := entries[i].([]interface{})
+		if len(entry) != 6 || entry[0] != expected.id || !reflect.DeepEqual(entry[3], expected.args) ||
+			entry[4] != conn.LocalAddr().String() || entry[5] != "app" {
+			t.Fatalf("Unexpected entry %#v", entry)
+		}
+	}
+
+	conn.Write([]byte("CONFIG SET slowlog-log-slower-than -1\r\n"))
+	expectReply(t, r, "OK")
+	conn.Write([]byte("SLOWLOG RESET\r\nPING\r\nSLOWLOG LEN\r\nSLOWLOG GET 1 2\r\n"))
+	expectReply(t, r, "OK")
+	expectReply(t, r, "PONG")
+	expectReply(t, r, int64(0))
+	expectLine(t, r, "-ERR wrong number of arguments for 'slowlog|get' command")
+}
@@ -9,7 +9,6 @@ type Stack struct {
 	sync.Mutex
 	Key   string
 	stack [][]byte
-	Chan  chan *Stack
 }
 
 func (s *Stack) PopBack() []byte {
@@ -41,11 +40,6 @@ func (s *Stack) PushBack(val []byte) {
 		s.stack = [][]byte{}
 	}
 
-	go func() {
-		if s.Chan != nil {
-			s.Chan <- s
-		}
-	}()
 	s.stack = append(s.stack, val)
 }
 
@@ -75,11 +69,6 @@ func (s *Stack) PushFront(val []byte) {
 	}
 
 	s.stack = append([][]byte{val}, s.stack...)
-	go func() {
-		if s.Chan != nil {
-			s.Chan <- s
-		}
-	}()
 }
 
 // GetIndex return the element at the requested index.
@@ -109,7 +98,6 @@ func (s *Stack) Len() int {
 func NewStack(key string) *Stack {
 	return &Stack{
 		stack: [][]byte{},
-		Chan:  make(chan *Stack),
 		Key:   key,
 	}
 }
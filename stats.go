@@ -0,0 +1,164 @@
+package redis
+
+import (
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// latencyBuckets are the upper bounds, in microseconds, of the buckets of
+// the command latency histograms.
+var latencyBuckets = []int64{100, 250, 500, 1000, 2500, 5000, 10000, 25000, 50000, 100000, 250000, 500000, 1000000}
+
+// commandStats counts the calls of a command. Its fields are updated
+// atomically, without locking.
+type commandStats struct {
+	calls    int64
+	failed   int64
+	rejected int64
+	usec     int64
+	// buckets counts the calls by latency, the last bucket holding those
+	// slower than the last of latencyBuckets.
+	buckets []int64
+}
+
+func newCommandStats() *commandStats {
+	return &commandStats{buckets: make([]int64, len(latencyBuckets)+1)}
+}
+
+func (s *commandStats) record(d time.Duration, failed bool) {
+	usec := int64(d / time.Microsecond)
+	atomic.AddInt64(&s.calls, 1)
+	atomic.AddInt64(&s.usec, usec)
+	if failed {
+		atomic.AddInt64(&s.failed, 1)
+	}
+	i := sort.Search(len(latencyBuckets), func(i int) bool { return usec <= latencyBuckets[i] })
+	atomic.AddInt64(&s.buckets[i], 1)
+}
+
+func (s *commandStats) reset() {
+	atomic.StoreInt64(&s.calls, 0)
+	atomic.StoreInt64(&s.failed, 0)
+	atomic.StoreInt64(&s.rejected, 0)
+	atomic.StoreInt64(&s.usec, 0)
+	for i := range s.buckets {
+		atomic.StoreInt64(&s.buckets[i], 0)
+	}
+}
+
+// serverStats are the counters of INFO stats, updated atomically.
+type serverStats struct {
+	connections int64 // total_connections_received
+	commands    int64 // total_commands_processed
+	rejected    int64 // rejected_connections
+
+	outputLimitDisconnections int64 // client_output_buffer_limit_disconnections
+}
+
+// dbStats is the size of a database, for INFO keyspace.
+type dbStats struct {
+	db      int
+	keys    int
+	expires int
+}
+
+// keyspaceReporter is implemented by handlers reporting the size of their
+// databases, in INFO keyspace and the metrics.
+type keyspaceReporter interface {
+	keyspaceStats() []dbStats
+}
+
+// addCommandStats creates the statistics of the command name and of its
+// subcommands.
+func (srv *Server) addCommandStats(name string) {
+	if srv.commandStats == nil {
+		srv.commandStats = make(map[string]*commandStats)
+	}
+	if _, exists := srv.commandStats[name]; !exists {
+		srv.commandStats[name] = newCommandStats()
+	}
+	if spec := commands[name]; spec != nil {
+		for _, sub := range spec.subcommands {
+			if _, exists := srv.commandStats[sub.fullName()]; !exists {
+				srv.commandStats[sub.fullName()] = newCommandStats()
+			}
+		}
+	}
+}
+
+// statsOf returns the statistics of the command, or subcommand, r.
+func (srv *Server) statsOf(r *Request) *commandStats {
+	name := strings.ToLower(r.Name)
+	stats := srv.commandStats[name]
+	if spec := lookupCommand(name, r.Args); spec != nil && spec.parent != nil {
+		if sub, exists := srv.commandStats[spec.fullName()]; exists {
+			stats = sub
+		}
+	}
+	return stats
+}
+
+// recordCommand counts the call of r, which took d and replied reply and
+// err.
+func (srv *Server) recordCommand(r *Request, d time.Duration, reply ReplyWriter, err error) {
+	atomic.AddInt64(&srv.stats.commands, 1)
+	if stats := srv.statsOf(r); stats != nil {
+		_, isError := reply.(*ErrorReply)
+		stats.record(d, isError || err != nil)
+	}
+}
+
+// rejectCommand counts r as refused before running, as rejected_calls.
+func (srv *Server) rejectCommand(r *Request) {
+	if stats := srv.statsOf(r); stats != nil {
+		atomic.AddInt64(&stats.rejected, 1)
+	}
+}
+
+// resetStats implements CONFIG RESETSTAT.
+func (srv *Server) resetStats() {
+	atomic.StoreInt64(&srv.stats.connections, 0)
+	atomic.StoreInt64(&srv.stats.commands, 0)
+	atomic.StoreInt64(&srv.stats.rejected, 0)
+	atomic.StoreInt64(&srv.stats.outputLimitDisconnections, 0)
+	for _, s := range srv.commandStats {
+		s.reset()
+	}
+}
+
+// commandNames returns the names of the commands with statistics, sorted.
+func (srv *Server) commandNames() []string {
+	names := make([]string, 0, len(srv.commandStats))
+	for name := range srv.commandStats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// clientCounts returns the number of connected clients, of those blocked
+// and of those subscribed to channels.
+func (srv *Server) clientCounts() (connected, blocked, pubsub int) {
+	for _, c := range srv.Clients() {
+		flags := c.Flags()
+		if flags&ClientBlocked != 0 {
+			blocked++
+		}
+		if flags&ClientPubSub != 0 {
+			pubsub++
+		}
+		connected++
+	}
+	return connected, blocked, pubsub
+}
+
+// keyspaceStats returns the sizes of the non-empty databases of the
+// handler, if it reports them.
+func (srv *Server) keyspaceStats() []dbStats {
+	if h, ok := srv.handler.(keyspaceReporter); ok {
+		return h.keyspaceStats()
+	}
+	return nil
+}
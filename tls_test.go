@@ -0,0 +1,104 @@
+package redis
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// testCert issues a certificate for name, signed by parent, or self-signed
+// when parent is nil.
+func testCert(t *testing.T, name string, parent *tls.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name, Organization: []string{"go-redis-server"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	signer, signerKey := template, interface{}(key)
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	} else {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestTLS(t *testing.T) {
+	ca := testCert(t, "Test CA", nil)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+	serverCert := testCert(t, "server", &ca)
+	clientCert := testCert(t, "client", &ca)
+
+	srv, _ := startServer(t, DefaultConfig().
+		TLS(&tls.Config{Certificates: []tls.Certificate{serverCert}, ClientCAs: pool}).
+		TLSAuthClients("yes"))
+	srv.Register("whoami", func(r *Request) (ReplyWriter, error) {
+		return &BulkReply{value: []byte(r.ClientCertSubject())}, nil
+	})
+
+	// Without a client certificate, the handshake fails.
+	conn, err := tls.Dial("tcp", srv.Addr, &tls.Config{RootCAs: pool})
+	if err == nil {
+		conn.SetDeadline(time.Now().Add(time.Second))
+		if _, err = conn.Write([]byte("PING\r\n")); err == nil {
+			_, err = conn.Read(make([]byte, 16))
+		}
+		conn.Close()
+	}
+	if err == nil {
+		t.Fatal("Expected the handshake to fail without a client certificate")
+	}
+
+	conn, err = tls.Dial("tcp", srv.Addr, &tls.Config{
+		RootCAs:      pool,
+		Certificates: []tls.Certificate{clientCert},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("WHOAMI\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 64)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "$27\r\nCN=client,O=go-redis-server\r\n"
+	if string(buf[:n]) != expected {
+		t.Fatalf("Expected %q, got %q", expected, buf[:n])
+	}
+}
+
+func TestTLSAuthClientsInvalid(t *testing.T) {
+	_, err := NewServer(DefaultConfig().Port(0).TLS(&tls.Config{}).TLSAuthClients("maybe"))
+	if err == nil {
+		t.Fatal("Expected an error for an invalid tls-auth-clients value")
+	}
+}